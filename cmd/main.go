@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"github.com/ffonord/yi4kplus-video-export/internal/app"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/supervisor"
 	"github.com/subosito/gotenv"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -17,7 +18,8 @@ import (
 const (
 	autoShutdownTimeOut = time.Minute * 5
 	surveyPeriod        = time.Minute * 1
-	cancelTimeout       = time.Second * 3
+	// defaultCancelTimeout leaves running encoders time to stop after an interrupt, see FFMPEG_STOP_TIMEOUT_SECONDS
+	defaultCancelTimeout = time.Second * 30
 )
 
 var (
@@ -28,9 +30,6 @@ func init() {
 	flag.StringVar(&envFilePath, "env-file-path", ".env", "path to .env file with variables")
 }
 
-// TODO: добавить команду декодирования через ffmpeg
-// пример запуска из golang приложения: https://gist.github.com/tpanum/374ca0a415a5d94ffcd9
-// пример команды `ffmpeg -i Y0030857.MP4 -vcodec libx265 -crf 28 output.mp4` - размер файла уменьшился в ~20 раз
 func main() {
 	handleError(loadDotEnvFile(), "gotenv load file")
 
@@ -38,16 +37,23 @@ func main() {
 	var wg sync.WaitGroup
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	wg.Add(1)
+	s := supervisor.New(apl.Logger, &wg)
 
-	go func() {
-		defer wg.Done()
+	s.Go(ctx, "MediaExporter", func(ctx context.Context) error {
+		return apl.MediaExporter.Run(ctx, surveyPeriod, autoShutdownTimeOut)
+	})
+	s.Go(ctx, "FileHandler", apl.FileHandler.Run)
 
-		err := apl.MediaExporter.Run(ctx, surveyPeriod, autoShutdownTimeOut)
-		apl.Logger.Error(errors.Unwrap(err).Error())
-	}()
+	wait(&wg, cancelFunc, cancelTimeout())
+}
+
+func cancelTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"))
+	if err != nil || seconds <= 0 {
+		return defaultCancelTimeout
+	}
 
-	wait(&wg, cancelFunc)
+	return time.Second * time.Duration(seconds)
 }
 
 func loadDotEnvFile() error {
@@ -55,7 +61,7 @@ func loadDotEnvFile() error {
 	return gotenv.Load(envFilePath)
 }
 
-func wait(wg *sync.WaitGroup, cancelFunc context.CancelFunc) {
+func wait(wg *sync.WaitGroup, cancelFunc context.CancelFunc, cancelTimeout time.Duration) {
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	<-s
@@ -70,6 +76,7 @@ func wait(wg *sync.WaitGroup, cancelFunc context.CancelFunc) {
 
 	select {
 	case <-time.After(cancelTimeout):
+		log.Printf("services did not stop in %s", cancelTimeout)
 	case <-doneChan:
 	}
 }
@@ -7,22 +7,48 @@ import (
 )
 
 type Config struct {
-	storageDir     string
-	encodedDir     string
-	pollingMinutes time.Duration
+	binary      string
+	videoCodec  string
+	crf         int
+	preset      string
+	stopTimeout time.Duration
 }
 
 func NewConfig() *Config {
-	pollingMinutes := time.Minute * 2
-	rawPollingMinutes := os.Getenv("FILE_HANDLER_POLLING_MINUTES")
+	binary := os.Getenv("FFMPEG_BINARY")
+	if binary == "" {
+		binary = "ffmpeg"
+	}
+
+	videoCodec := os.Getenv("FFMPEG_VIDEO_CODEC")
+	if videoCodec == "" {
+		videoCodec = "libx265"
+	}
+
+	crf := 28
+	rawCrf := os.Getenv("FFMPEG_CRF")
+
+	if i, err := strconv.Atoi(rawCrf); err == nil {
+		crf = i
+	}
+
+	preset := os.Getenv("FFMPEG_PRESET")
+	if preset == "" {
+		preset = "medium"
+	}
+
+	stopTimeout := time.Second * 10
+	rawStopTimeout := os.Getenv("FFMPEG_STOP_TIMEOUT_SECONDS")
 
-	if i, err := strconv.Atoi(rawPollingMinutes); err == nil {
-		pollingMinutes = time.Minute * time.Duration(i)
+	if i, err := strconv.Atoi(rawStopTimeout); err == nil && i > 0 {
+		stopTimeout = time.Second * time.Duration(i)
 	}
 
 	return &Config{
-		storageDir:     os.Getenv("LOCAL_STORAGE_DIR"),
-		encodedDir:     os.Getenv("LOCAL_ENCODED_DIR"),
-		pollingMinutes: pollingMinutes,
+		binary:      binary,
+		videoCodec:  videoCodec,
+		crf:         crf,
+		preset:      preset,
+		stopTimeout: stopTimeout,
 	}
 }
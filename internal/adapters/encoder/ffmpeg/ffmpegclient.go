@@ -1 +1,195 @@
 package ffmpeg
+
+import (
+	"context"
+	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/encoding"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	outputExtension = ".mp4"
+	partSuffix      = ".part"
+	// progressLogPeriod limits how often the progress of the running encoding is logged
+	progressLogPeriod = time.Second * 30
+	// stderrLimit is the size of the ffmpeg output tail kept for the error message
+	stderrLimit = 4096
+)
+
+// Client encodes media files by running ffmpeg, e.g. `ffmpeg -i Y0030857.MP4 -vcodec libx265 -crf 28 output.mp4`.
+// The output is written to a part file and renamed when ffmpeg succeeds, so a half-encoded file is never visible.
+type Client struct {
+	config *Config
+	logger *logger.Logger
+}
+
+func New(config *Config, logger *logger.Logger) *Client {
+	return &Client{
+		config: config,
+		logger: logger,
+	}
+}
+
+// Encode encodes the source file of the job into its destination with the mp4 extension,
+// a destination which already exists is the result of an earlier run and is not encoded again
+func (c *Client) Encode(ctx context.Context, job *encoding.Job) (*encoding.Result, error) {
+	const op = "FfmpegClient.Encode"
+
+	startedAt := time.Now()
+	dstFile := c.OutputPath(job)
+
+	if info, err := os.Stat(dstFile); err == nil {
+		c.logger.With(
+			slog.String("op", op),
+		).Info("Encoded file exists, skip: " + dstFile)
+
+		return &encoding.Result{
+			Path: dstFile,
+			Size: uint64(info.Size()),
+		}, nil
+	}
+
+	err := c.EncodeFile(ctx, job.SrcPath, dstFile)
+	if err != nil {
+		return nil, c.errWrap(op, "encode file", err)
+	}
+
+	info, err := os.Stat(dstFile)
+	if err != nil {
+		return nil, c.errWrap(op, "os stat, path: "+dstFile, err)
+	}
+
+	return &encoding.Result{
+		Path:     dstFile,
+		Size:     uint64(info.Size()),
+		Duration: time.Since(startedAt),
+	}, nil
+}
+
+// OutputPath returns the location of the encoded copy of the job source file
+func (c *Client) OutputPath(job *encoding.Job) string {
+	return job.DstPath + outputExtension
+}
+
+// EncodeFile runs ffmpeg for the file, on cancel of the context ffmpeg gets an interrupt and is killed after stop timeout
+func (c *Client) EncodeFile(ctx context.Context, srcFile, dstFile string) error {
+	const op = "FfmpegClient.EncodeFile"
+
+	log := c.logger.With(
+		slog.String("op", op),
+		slog.String("src", srcFile),
+	)
+
+	err := os.MkdirAll(filepath.Dir(dstFile), 0755)
+	if err != nil {
+		return c.errWrap(op, "os mkdir all, path: "+dstFile, err)
+	}
+
+	partFile := dstFile + partSuffix
+
+	cmd := exec.CommandContext(ctx, c.config.binary, c.args(srcFile, partFile)...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = c.config.stopTimeout
+
+	stderr := &tailBuffer{limit: stderrLimit}
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return c.errWrap(op, "stdout pipe", err)
+	}
+
+	log.Info("Start encoding to " + dstFile)
+
+	err = cmd.Start()
+	if err != nil {
+		return c.errWrap(op, "start "+c.config.binary, err)
+	}
+
+	lastLog := time.Now()
+	progressErr := readProgress(stdout, func(p Progress) {
+		if p.Done || time.Since(lastLog) < progressLogPeriod {
+			return
+		}
+
+		lastLog = time.Now()
+		log.Info(fmt.Sprintf("Encoding progress: frame %d, time %s, speed %s", p.Frame, p.OutTime, p.Speed))
+	})
+
+	err = cmd.Wait()
+	if err != nil {
+		_ = os.Remove(partFile)
+
+		if ctx.Err() != nil {
+			return c.errWrap(op, "encoding "+srcFile, ctx.Err())
+		}
+
+		return c.errWrap(op, "encoding "+srcFile+": "+strings.TrimSpace(stderr.String()), err)
+	}
+
+	if progressErr != nil {
+		log.Info("Read progress failed: " + progressErr.Error())
+	}
+
+	err = os.Rename(partFile, dstFile)
+	if err != nil {
+		_ = os.Remove(partFile)
+		return c.errWrap(op, "os rename, path: "+partFile, err)
+	}
+
+	log.Info("Success encoding to " + dstFile)
+
+	return nil
+}
+
+func (c *Client) args(srcFile, partFile string) []string {
+	return []string{
+		"-hide_banner",
+		"-nostdin",
+		"-nostats",
+		"-loglevel", "error",
+		"-y",
+		"-i", srcFile,
+		"-map_metadata", "0",
+		"-c:v", c.config.videoCodec,
+		"-crf", strconv.Itoa(c.config.crf),
+		"-preset", c.config.preset,
+		"-c:a", "copy",
+		"-progress", "pipe:1",
+		"-f", "mp4",
+		partFile,
+	}
+}
+
+func (c *Client) errWrap(methodName, message string, err error) error {
+	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
+}
+
+// tailBuffer keeps the last limit bytes written to it
+type tailBuffer struct {
+	limit int
+	data  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+
+	if len(b.data) > b.limit {
+		b.data = b.data[len(b.data)-b.limit:]
+	}
+
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.data)
+}
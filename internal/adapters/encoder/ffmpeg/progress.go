@@ -0,0 +1,50 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is a block of key=value lines written by ffmpeg with -progress option
+type Progress struct {
+	Frame   int
+	OutTime time.Duration
+	Speed   string
+	Done    bool
+}
+
+// readProgress parses progress blocks from the reader and sends them to the handler until the reader ends.
+// Every block is finished by the progress key with value continue or end.
+func readProgress(r io.Reader, handler func(Progress)) error {
+	scanner := bufio.NewScanner(r)
+	progress := Progress{}
+
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "frame":
+			if i, err := strconv.Atoi(value); err == nil {
+				progress.Frame = i
+			}
+		case "out_time_us":
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				progress.OutTime = time.Duration(i) * time.Microsecond
+			}
+		case "speed":
+			progress.Speed = value
+		case "progress":
+			progress.Done = value == "end"
+			handler(progress)
+			progress = Progress{}
+		}
+	}
+
+	return scanner.Err()
+}
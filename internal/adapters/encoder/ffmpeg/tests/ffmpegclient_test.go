@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"context"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/encoder/ffmpeg"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/encoding"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const loggerEnv = logger.EnvTest
+
+// fakeFfmpeg copies the input to the output and reports progress like ffmpeg with -progress pipe:1,
+// with FAKE_FFMPEG_HANG it waits for an interrupt instead
+const fakeFfmpeg = `#!/bin/sh
+while [ $# -gt 1 ]; do
+	if [ "$1" = "-i" ]; then
+		input="$2"
+	fi
+	shift
+done
+output="$1"
+
+if [ -n "$FAKE_FFMPEG_HANG" ]; then
+	trap 'exit 255' INT
+	: > "$output"
+	while true; do sleep 0.1; done
+fi
+
+if [ -n "$FAKE_FFMPEG_FAIL" ]; then
+	echo "Invalid data found when processing input" >&2
+	exit 1
+fi
+
+echo "frame=10"
+echo "out_time_us=1000000"
+echo "speed=1.5x"
+echo "progress=continue"
+echo "frame=20"
+echo "out_time_us=2000000"
+echo "speed=1.5x"
+echo "progress=end"
+cp "$input" "$output"
+`
+
+func newClient(t *testing.T) *ffmpeg.Client {
+	binary := filepath.Join(t.TempDir(), "ffmpeg")
+	assert.Nil(t, os.WriteFile(binary, []byte(fakeFfmpeg), 0755))
+
+	t.Setenv("FFMPEG_BINARY", binary)
+	t.Setenv("FFMPEG_STOP_TIMEOUT_SECONDS", "5")
+
+	return ffmpeg.New(ffmpeg.NewConfig(), logger.New(loggerEnv))
+}
+
+func TestClient_Encode(t *testing.T) {
+	c := newClient(t)
+
+	srcFile := filepath.Join(t.TempDir(), "YDXJ0001.MP4")
+	dstDir := t.TempDir()
+
+	assert.Nil(t, os.WriteFile(srcFile, []byte("video1"), 0644))
+
+	job := encoding.New("ffmpeg", srcFile, filepath.Join(dstDir, "2023/06-03/YDXJ0001"), 0, time.Now())
+
+	result, err := c.Encode(context.Background(), job)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dstDir, "2023/06-03/YDXJ0001.mp4"), result.Path)
+	assert.Equal(t, uint64(len("video1")), result.Size)
+
+	content, err := os.ReadFile(result.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, "video1", string(content))
+
+	entries, err := os.ReadDir(filepath.Join(dstDir, "2023/06-03"))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestClient_EncodeSkipsEncoded(t *testing.T) {
+	c := newClient(t)
+
+	srcFile := filepath.Join(t.TempDir(), "YDXJ0001.MP4")
+	dstDir := t.TempDir()
+
+	assert.Nil(t, os.WriteFile(srcFile, []byte("video1"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dstDir, "YDXJ0001.mp4"), []byte("encoded"), 0644))
+
+	job := encoding.New("ffmpeg", srcFile, filepath.Join(dstDir, "YDXJ0001"), 0, time.Now())
+
+	result, err := c.Encode(context.Background(), job)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dstDir, "YDXJ0001.mp4"), result.Path)
+	assert.Equal(t, uint64(len("encoded")), result.Size)
+
+	content, err := os.ReadFile(result.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, "encoded", string(content))
+}
+
+func TestClient_EncodeFileFailure(t *testing.T) {
+	c := newClient(t)
+	t.Setenv("FAKE_FFMPEG_FAIL", "1")
+
+	srcFile := filepath.Join(t.TempDir(), "YDXJ0001.MP4")
+	dstFile := filepath.Join(t.TempDir(), "YDXJ0001.mp4")
+
+	assert.Nil(t, os.WriteFile(srcFile, []byte("video1"), 0644))
+
+	err := c.EncodeFile(context.Background(), srcFile, dstFile)
+	assert.ErrorContains(t, err, "Invalid data found when processing input")
+
+	_, err = os.Stat(dstFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestClient_EncodeFileCancel(t *testing.T) {
+	c := newClient(t)
+	t.Setenv("FAKE_FFMPEG_HANG", "1")
+
+	srcFile := filepath.Join(t.TempDir(), "YDXJ0001.MP4")
+	dstFile := filepath.Join(t.TempDir(), "YDXJ0001.mp4")
+
+	assert.Nil(t, os.WriteFile(srcFile, []byte("video1"), 0644))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		cancelFunc()
+	}()
+
+	err := c.EncodeFile(ctx, srcFile, dstFile)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = os.Stat(dstFile)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(dstFile + ".part")
+	assert.True(t, os.IsNotExist(err))
+}
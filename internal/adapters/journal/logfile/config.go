@@ -0,0 +1,24 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// defaultFileName is the journal in the local storage dir, the storage skips hidden files
+const defaultFileName = ".export_journal"
+
+type Config struct {
+	path string
+}
+
+func NewConfig() *Config {
+	path := os.Getenv("EXPORT_JOURNAL_PATH")
+	if path == "" {
+		path = filepath.Join(os.Getenv("LOCAL_STORAGE_DIR"), defaultFileName)
+	}
+
+	return &Config{
+		path: path,
+	}
+}
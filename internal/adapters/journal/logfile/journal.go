@@ -0,0 +1,264 @@
+package logfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/journal"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Journal is an append-only log of export stages, one json entry per line.
+// The log is compacted on open: entries of files deleted on the camera are dropped.
+type Journal struct {
+	config  *Config
+	logger  *logger.Logger
+	mu      sync.Mutex
+	log     *os.File
+	entries map[string]*journal.Entry
+}
+
+func New(config *Config, logger *logger.Logger) *Journal {
+	return &Journal{
+		config: config,
+		logger: logger,
+	}
+}
+
+func (j *Journal) Record(f *file.File, stage journal.Stage) error {
+	const op = "Journal.Record"
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.open()
+	if err != nil {
+		return j.errWrap(op, "open", err)
+	}
+
+	entry := journal.New(f, stage, time.Now())
+
+	err = j.write(j.log, entry)
+	if err != nil {
+		return j.errWrap(op, "write entry", err)
+	}
+
+	err = j.log.Sync()
+	if err != nil {
+		return j.errWrap(op, "sync", err)
+	}
+
+	j.apply(entry)
+
+	return nil
+}
+
+// Pending returns the last recorded stage of every file which is not deleted on the camera yet
+func (j *Journal) Pending() ([]*journal.Entry, error) {
+	const op = "Journal.Pending"
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.open()
+	if err != nil {
+		return nil, j.errWrap(op, "open", err)
+	}
+
+	entries := make([]*journal.Entry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Time.Before(entries[b].Time)
+	})
+
+	return entries, nil
+}
+
+func (j *Journal) open() error {
+	if j.log != nil {
+		return nil
+	}
+
+	const op = "Journal.open"
+
+	err := j.load()
+	if err != nil {
+		return j.errWrap(op, "load", err)
+	}
+
+	err = j.compact()
+	if err != nil {
+		return j.errWrap(op, "compact", err)
+	}
+
+	j.log, err = os.OpenFile(j.config.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return j.errWrap(op, "os open file, path: "+j.config.path, err)
+	}
+
+	return nil
+}
+
+func (j *Journal) load() error {
+	const op = "Journal.load"
+
+	log := j.logger.With(
+		slog.String("op", op),
+		slog.Any("config", j.config),
+	)
+
+	j.entries = map[string]*journal.Entry{}
+
+	logFile, err := os.Open(j.config.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return j.errWrap(op, "os open, path: "+j.config.path, err)
+	}
+
+	defer func() {
+		_ = logFile.Close()
+	}()
+
+	scanner := bufio.NewScanner(logFile)
+	for scanner.Scan() {
+		entry := &journal.Entry{}
+
+		// the last line may be cut off by a crash in the middle of a write
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.File == nil {
+			log.Info("Skip broken journal entry: " + scanner.Text())
+			continue
+		}
+
+		j.apply(entry)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return j.errWrap(op, "scan", err)
+	}
+
+	return nil
+}
+
+func (j *Journal) compact() error {
+	const op = "Journal.compact"
+
+	tmpPath := j.config.path + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return j.errWrap(op, "os create, path: "+tmpPath, err)
+	}
+
+	for _, entry := range j.entries {
+		err = j.write(tmpFile, entry)
+		if err != nil {
+			_ = tmpFile.Close()
+			return j.errWrap(op, "write entry", err)
+		}
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		_ = tmpFile.Close()
+		return j.errWrap(op, "sync", err)
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return j.errWrap(op, "close, path: "+tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, j.config.path)
+	if err != nil {
+		return j.errWrap(op, "os rename, path: "+tmpPath, err)
+	}
+
+	err = syncDir(filepath.Dir(j.config.path))
+	if err != nil {
+		return j.errWrap(op, "sync dir, path: "+j.config.path, err)
+	}
+
+	return nil
+}
+
+// syncDir flushes the directory entry, so the rename survives a power loss
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if err != nil {
+		_ = d.Close()
+		return err
+	}
+
+	return d.Close()
+}
+
+func (j *Journal) write(dst *os.File, entry *journal.Entry) error {
+	const op = "Journal.write"
+
+	rawEntry, err := json.Marshal(entry)
+	if err != nil {
+		return j.errWrap(op, "json marshal", err)
+	}
+
+	_, err = dst.Write(append(rawEntry, '\n'))
+	if err != nil {
+		return j.errWrap(op, "write", err)
+	}
+
+	return nil
+}
+
+func (j *Journal) apply(entry *journal.Entry) {
+	key := journal.Key(entry.File)
+
+	if entry.Stage == journal.StageDeleted {
+		delete(j.entries, key)
+		return
+	}
+
+	j.entries[key] = entry
+}
+
+// Close releases the journal file, next call of Record or Pending opens it again
+func (j *Journal) Close() error {
+	const op = "Journal.Close"
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.log == nil {
+		return nil
+	}
+
+	err := j.log.Close()
+	j.log = nil
+
+	if err != nil {
+		return j.errWrap(op, "close", err)
+	}
+
+	return nil
+}
+
+func (j *Journal) errWrap(methodName, message string, err error) error {
+	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
+}
@@ -0,0 +1,82 @@
+package logfile
+
+import (
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/journal"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewConfig_DefaultPath(t *testing.T) {
+	t.Setenv("EXPORT_JOURNAL_PATH", "")
+	t.Setenv("LOCAL_STORAGE_DIR", "/data/videos")
+
+	// the journal is never written to an empty path
+	assert.Equal(t, "/data/videos/.export_journal", NewConfig().path)
+
+	t.Setenv("EXPORT_JOURNAL_PATH", "/data/journal")
+
+	assert.Equal(t, "/data/journal", NewConfig().path)
+}
+
+func TestJournal_Record(t *testing.T) {
+	config := NewConfig()
+	config.path = t.TempDir() + "/journal"
+
+	j := New(config, logger.New(logger.EnvTest))
+
+	f1 := file.New("video1.mp4", "/some/dir", time.Now(), 10)
+	f2 := file.New("video2.mp4", "/some/dir", time.Now(), 20)
+
+	assert.Nil(t, j.Record(f1, journal.StageDiscovered))
+	assert.Nil(t, j.Record(f2, journal.StageDiscovered))
+	assert.Nil(t, j.Record(f1, journal.StageVerified))
+	assert.Nil(t, j.Record(f2, journal.StageVerified))
+	assert.Nil(t, j.Record(f2, journal.StageDeleted))
+
+	entries, err := j.Pending()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, f1.Name, entries[0].File.Name)
+	assert.Equal(t, journal.StageVerified, entries[0].Stage)
+	assert.Nil(t, j.Close())
+}
+
+func TestJournal_Replay(t *testing.T) {
+	config := NewConfig()
+	config.path = t.TempDir() + "/journal"
+
+	f := file.New("video1.mp4", "/some/dir", time.Now(), 10)
+
+	j := New(config, logger.New(logger.EnvTest))
+	assert.Nil(t, j.Record(f, journal.StageDownloading))
+	assert.Nil(t, j.Close())
+
+	// emulate a crash in the middle of a write
+	logFile, err := os.OpenFile(config.path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = logFile.WriteString(`{"File":{"Name":"video1.mp4"`)
+	assert.Nil(t, err)
+	assert.Nil(t, logFile.Close())
+
+	j = New(config, logger.New(logger.EnvTest))
+
+	entries, err := j.Pending()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, journal.StageDownloading, entries[0].Stage)
+	assert.Equal(t, f.Size, entries[0].File.Size)
+
+	assert.Nil(t, j.Record(f, journal.StageDeleted))
+	assert.Nil(t, j.Close())
+
+	j = New(config, logger.New(logger.EnvTest))
+
+	entries, err = j.Pending()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+	assert.Nil(t, j.Close())
+}
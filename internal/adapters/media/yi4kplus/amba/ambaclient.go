@@ -3,10 +3,15 @@ package amba
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/eventbus"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"io"
 	"log/slog"
 	"net"
+	"sync"
+	"time"
 )
 
 // Message ids
@@ -17,6 +22,26 @@ import (
 const ambaStartSessionToken = 0
 const ambaStartSession = 257
 const ambaStopSession = 258
+const ambaPowerOff = 12
+
+// ambaInvalidToken is the rval of a request with the token of an expired session
+const ambaInvalidToken = -4
+
+// ambaNotification is the msg_id of messages the camera sends on its own, e.g. the end of a file transfer
+const ambaNotification = 7
+
+// responseTimeout limits the wait of the reply to a request
+const responseTimeout = time.Second * 10
+
+// dataTimeout limits the wait of the next chunk of a file transfer, so a stalled transfer fails instead of hanging
+const dataTimeout = time.Second * 30
+
+var (
+	ErrNotConnected    = errors.New("amba session is not started")
+	ErrRequestRejected = errors.New("amba request rejected by the camera")
+	ErrResponseTimeout = errors.New("amba response timeout")
+	ErrConnectionLost  = errors.New("amba connection lost")
+)
 
 type Conn interface {
 	net.Conn
@@ -27,7 +52,7 @@ type ConnFactory interface {
 }
 
 type Reader interface {
-	ReadString(delim byte) (string, error)
+	io.Reader
 }
 
 type ReaderFactory interface {
@@ -40,20 +65,46 @@ type Client struct {
 	logger        *logger.Logger
 	connFactory   ConnFactory
 	readerFactory ReaderFactory
-	conn          Conn
-	reader        Reader
+	// writeMu keeps requests of several goroutines from interleaving on the connection
+	writeMu sync.Mutex
+	// reconnectMu lets one of the failed requests re-establish the session
+	reconnectMu sync.Mutex
+	// mu guards the token, the connection and the data connections
+	mu   sync.Mutex
+	conn *connection
+	// dataConns are data connections of the transfers in progress, they are closed on shutdown
+	dataConns     map[Conn]struct{}
+	notifications *eventbus.Bus[Response]
+}
+
+// connection is the control connection with its reader goroutine state
+type connection struct {
+	conn Conn
+	// pending are channels of requests waiting for the reply, by msg_id in order of sending
+	pending map[int][]chan Response
+	// done is closed when the reader stops, err is the reason
+	done chan struct{}
+	err  error
 }
 
+// Response is a message of the camera, Param depends on the request: the token, a path, a setting value
 type Response struct {
-	Rval  int `json:"rval"`
-	MsgId int `json:"msg_id"`
-	Param int `json:"param"`
+	Rval    int                 `json:"rval"`
+	MsgId   int                 `json:"msg_id"`
+	Param   json.RawMessage     `json:"param,omitempty"`
+	Type    string              `json:"type,omitempty"`
+	Listing []map[string]string `json:"listing,omitempty"`
+	Size    uint64              `json:"size,omitempty"`
+	RemSize uint64              `json:"rem_size,omitempty"`
 }
 
 type Request struct {
-	MsgId int    `json:"msg_id"`
-	Token int    `json:"token"`
-	Param string `json:"param"`
+	MsgId     int    `json:"msg_id"`
+	Token     int    `json:"token"`
+	Param     string `json:"param"`
+	Type      string `json:"type,omitempty"`
+	Offset    uint64 `json:"offset,omitempty"`
+	FetchSize uint64 `json:"fetch_size,omitempty"`
 }
 
 func New(
@@ -67,9 +118,12 @@ func New(
 		logger:        logger,
 		connFactory:   connFactory,
 		readerFactory: readerFactory,
+		dataConns:     map[Conn]struct{}{},
+		notifications: eventbus.New[Response](),
 	}
 }
 
+// ConfigureConn dials the camera and starts the reader of its messages
 func (c *Client) ConfigureConn() error {
 	const op = "AmbaClient.ConfigureConn"
 
@@ -79,12 +133,26 @@ func (c *Client) ConfigureConn() error {
 		return c.errWrap(op, "net dial", err)
 	}
 
-	c.conn = conn
-	c.reader = c.readerFactory.NewReader(conn)
+	cc := &connection{
+		conn:    conn,
+		pending: map[int][]chan Response{},
+		done:    make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	c.conn = cc
+	c.mu.Unlock()
+
+	go c.read(cc, c.readerFactory.NewReader(conn))
 
 	return nil
 }
 
+// Subscribe returns a subscription to notifications of the camera, e.g. battery, card and file transfer events
+func (c *Client) Subscribe(size int) *eventbus.Subscription[Response] {
+	return c.notifications.Subscribe(size)
+}
+
 func (c *Client) errWrap(methodName, message string, err error) error {
 	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
 }
@@ -117,6 +185,83 @@ func (c *Client) Run(ctx context.Context) error {
 		return c.errWrap(op, "session start", err)
 	}
 
+	if period := c.heartbeatPeriod(); period > 0 {
+		go c.heartbeat(ctx, period)
+	}
+
+	return nil
+}
+
+// heartbeatPeriod is a third of the camera timeout, so a lost heartbeat does not drop the session, zero disables it
+func (c *Client) heartbeatPeriod() time.Duration {
+	return time.Second * time.Duration(c.config.autoShutdownTimeout) / 3
+}
+
+// heartbeat sends a request every period until the context is done,
+// so the camera keeps the session while files are transferred by ftp
+func (c *Client) heartbeat(ctx context.Context, period time.Duration) {
+	const op = "AmbaClient.heartbeat"
+
+	log := c.logger.With(
+		slog.String("op", op),
+	)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// the battery level request is cheap and keeps the token alive
+		_, err := c.request(Request{MsgId: ambaBatteryLevel})
+		if err != nil && ctx.Err() == nil {
+			log.Info("Heartbeat failed: " + err.Error())
+		}
+	}
+}
+
+// reconnect re-establishes the session which failed on the connection,
+// nothing is done if another request has already replaced it or the client was shut down
+func (c *Client) reconnect(failed *connection) error {
+	const op = "AmbaClient.reconnect"
+
+	log := c.logger.With(
+		slog.String("op", op),
+	)
+
+	c.reconnectMu.Lock()
+	defer c.reconnectMu.Unlock()
+
+	c.mu.Lock()
+	current := c.conn
+	c.mu.Unlock()
+
+	if current == nil {
+		return c.errWrap(op, "check connection", ErrNotConnected)
+	}
+
+	if current != failed {
+		return nil
+	}
+
+	log.Info("Re-establish amba session")
+
+	_ = current.conn.Close()
+
+	err := c.ConfigureConn()
+	if err != nil {
+		return c.errWrap(op, "configure connection", err)
+	}
+
+	err = c.startSession()
+	if err != nil {
+		return c.errWrap(op, "session start", err)
+	}
+
 	return nil
 }
 
@@ -139,7 +284,16 @@ func (c *Client) startSession() error {
 
 	log.Info("Success amba session start")
 
-	c.token = res.Param
+	token := 0
+
+	err = json.Unmarshal(res.Param, &token)
+	if err != nil {
+		return c.errWrap(op, "json unmarshal token", err)
+	}
+
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
 
 	log.Info("Success fetch token")
 
@@ -156,7 +310,7 @@ func (c *Client) stopSession() error {
 
 	_, err := c.sendRequest(Request{
 		MsgId: ambaStopSession,
-		Token: c.token,
+		Token: c.sessionToken(),
 	})
 
 	if err != nil {
@@ -168,6 +322,50 @@ func (c *Client) stopSession() error {
 	return nil
 }
 
+// PowerOff asks the camera to switch off, the connection is closed because the camera drops it anyway
+func (c *Client) PowerOff() error {
+	const op = "AmbaClient.PowerOff"
+
+	log := c.logger.With(
+		slog.String("op", op),
+		slog.Any("config", c.config),
+	)
+
+	_, err := c.request(Request{
+		MsgId: ambaPowerOff,
+	})
+
+	if err != nil {
+		return c.errWrap(op, "send power off request", err)
+	}
+
+	_ = c.closeConn()
+
+	log.Info("Success power off request")
+
+	return nil
+}
+
+// IsAlive reports whether the camera accepts connections to the amba port
+func (c *Client) IsAlive() bool {
+	conn, err := c.connFactory.NewConn(c.config.host, c.config.port)
+	if err != nil {
+		return false
+	}
+
+	_ = conn.Close()
+
+	return true
+}
+
+func (c *Client) sessionToken() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.token
+}
+
+// sendRequest writes the request and waits for the reply with the same msg_id, it is safe for concurrent use
 func (c *Client) sendRequest(request Request) (res Response, err error) {
 	const op = "AmbaClient.sendRequest"
 
@@ -177,34 +375,123 @@ func (c *Client) sendRequest(request Request) (res Response, err error) {
 		return res, c.errWrap(op, "json marshal", err)
 	}
 
-	_, err = fmt.Fprintf(c.conn, string(rawRequest)+"\n")
+	// the reply channel is registered before the write, so a quick reply is not lost
+	cc, replyChan, err := c.await(request.MsgId)
+	if err != nil {
+		return res, c.errWrap(op, "await reply", err)
+	}
+
+	c.writeMu.Lock()
+	_, err = cc.conn.Write(append(rawRequest, '\n'))
+	c.writeMu.Unlock()
 
 	if err != nil {
-		return res, c.errWrap(op, "fprintf to connection", err)
+		c.forget(cc, request.MsgId, replyChan)
+		return res, c.errWrap(op, "write to connection", err)
 	}
 
-	return c.fetchResponse()
+	select {
+	case res = <-replyChan:
+		return res, nil
+	case <-cc.done:
+		return res, c.errWrap(op, "read reply", fmt.Errorf("%w: %w", ErrConnectionLost, cc.err))
+	case <-time.After(responseTimeout):
+		c.forget(cc, request.MsgId, replyChan)
+		return res, c.errWrap(op, fmt.Sprintf("wait reply of msg_id %d", request.MsgId), ErrResponseTimeout)
+	}
 }
 
-func (c *Client) fetchResponse() (res Response, err error) {
-	const op = "AmbaClient.fetchResponse"
+func (c *Client) await(msgId int) (*connection, chan Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil, nil, ErrNotConnected
+	}
+
+	// the reader has stopped, the camera dropped the connection
+	if c.conn.pending == nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrConnectionLost, c.conn.err)
+	}
 
-	res = Response{}
+	replyChan := make(chan Response, 1)
+	c.conn.pending[msgId] = append(c.conn.pending[msgId], replyChan)
 
-	//TODO: добавить вычитывание по нужному msg_id (например, можно вычитывать пока не получим нужную строку)
-	rawRes, err := c.reader.ReadString('}')
+	return c.conn, replyChan, nil
+}
 
-	if err != nil {
-		return res, c.errWrap(op, "reader read string", err)
+func (c *Client) forget(cc *connection, msgId int, replyChan chan Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	waiting := cc.pending[msgId]
+	for i, ch := range waiting {
+		if ch == replyChan {
+			cc.pending[msgId] = append(waiting[:i:i], waiting[i+1:]...)
+			return
+		}
 	}
+}
 
-	err = json.Unmarshal([]byte(rawRes), &res)
+// read decodes messages of the connection until it fails:
+// replies go to the request waiting for their msg_id, notifications go to subscribers
+func (c *Client) read(cc *connection, reader Reader) {
+	const op = "AmbaClient.read"
 
-	if err != nil {
-		err = c.errWrap(op, "json unmarshal", err)
+	log := c.logger.With(
+		slog.String("op", op),
+	)
+
+	decoder := json.NewDecoder(reader)
+
+	for {
+		res := Response{}
+
+		err := decoder.Decode(&res)
+		if err != nil {
+			c.mu.Lock()
+			cc.err = err
+			cc.pending = nil
+			c.mu.Unlock()
+
+			close(cc.done)
+			return
+		}
+
+		if res.MsgId == ambaNotification {
+			c.notifications.Publish(res)
+			continue
+		}
+
+		c.mu.Lock()
+		var replyChan chan Response
+		if waiting := cc.pending[res.MsgId]; len(waiting) > 0 {
+			replyChan = waiting[0]
+			cc.pending[res.MsgId] = waiting[1:]
+		}
+		c.mu.Unlock()
+
+		if replyChan == nil {
+			log.Info(fmt.Sprintf("Skip unexpected message, msg_id %d, rval %d", res.MsgId, res.Rval))
+			continue
+		}
+
+		replyChan <- res
+	}
+}
+
+// closeConn closes the control connection, the reader stops and fails requests waiting for replies
+func (c *Client) closeConn() error {
+	c.mu.Lock()
+	cc := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if cc == nil {
+		return nil
 	}
 
-	return res, err
+	return cc.conn.Close()
 }
 
 func (c *Client) Shutdown(ctx context.Context) error {
@@ -217,25 +504,34 @@ func (c *Client) Shutdown(ctx context.Context) error {
 
 	<-ctx.Done()
 
-	if c.conn == nil {
+	c.mu.Lock()
+	connected := c.conn != nil
+	dataConns := c.dataConns
+	c.dataConns = map[Conn]struct{}{}
+	c.mu.Unlock()
+
+	// a transfer in progress fails at once instead of waiting for the data timeout
+	for dataConn := range dataConns {
+		_ = dataConn.Close()
+	}
+
+	if !connected {
 		return nil
 	}
 
 	err := c.stopSession()
 
 	if err != nil {
+		_ = c.closeConn()
 		return c.errWrap(op, "session stop", err)
 	}
 
-	err = c.conn.Close()
+	err = c.closeConn()
 
 	if err != nil {
 		return c.errWrap(op, "connection close", err)
 	}
 
-	c.conn = nil
-	c.reader = nil
-
 	log.Info("Success closing connection")
 
 	return nil
@@ -0,0 +1,40 @@
+package amba
+
+import (
+	"time"
+)
+
+const (
+	// settingCameraClock is the setting with the local time of the camera
+	settingCameraClock = "camera_clock"
+	cameraClockLayout  = "2006-01-02 15:04:05"
+)
+
+// Clock returns the time of the camera, the camera has no time zone so its clock is read as local time
+func (c *Client) Clock() (time.Time, error) {
+	const op = "AmbaClient.Clock"
+
+	value, err := c.Setting(settingCameraClock)
+	if err != nil {
+		return time.Time{}, c.errWrap(op, "setting "+settingCameraClock, err)
+	}
+
+	t, err := time.ParseInLocation(cameraClockLayout, value, time.Local)
+	if err != nil {
+		return time.Time{}, c.errWrap(op, "parse clock "+value, err)
+	}
+
+	return t, nil
+}
+
+// SetClock sets the time of the camera in local time
+func (c *Client) SetClock(t time.Time) error {
+	const op = "AmbaClient.SetClock"
+
+	err := c.SetSetting(settingCameraClock, t.In(time.Local).Format(cameraClockLayout))
+	if err != nil {
+		return c.errWrap(op, "set setting "+settingCameraClock, err)
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 type Config struct {
 	host                string
 	port                string
+	dataPort            string
 	autoShutdownTimeout int
 }
 
@@ -19,9 +20,15 @@ func NewConfig() *Config {
 		autoShutdownTimeout = i
 	}
 
+	dataPort := os.Getenv("AMBA_SERVER_DATA_PORT")
+	if dataPort == "" {
+		dataPort = "8787"
+	}
+
 	return &Config{
 		host:                os.Getenv("AMBA_SERVER_HOST"),
 		port:                os.Getenv("AMBA_SERVER_PORT"),
+		dataPort:            dataPort,
 		autoShutdownTimeout: autoShutdownTimeout,
 	}
 }
@@ -0,0 +1,252 @@
+package amba
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ambaDelete        = 1281
+	ambaList          = 1282
+	ambaGetFile       = 1285
+	ambaCancelGetFile = 1287
+	// listOptions asks for the size and time of every entry
+	listOptions    = " -D -S"
+	listTimeLayout = "2006-01-02 15:04:05"
+)
+
+var ErrBadListing = errors.New("amba listing entry has unexpected format")
+
+// Entry is an item of the dir listing
+type Entry struct {
+	Name  string
+	IsDir bool
+	Size  uint64
+	Time  time.Time
+}
+
+// List returns entries of the dir on the camera, e.g. /tmp/fuse_d/DCIM
+func (c *Client) List(dir string) ([]*Entry, error) {
+	const op = "AmbaClient.List"
+
+	res, err := c.request(Request{
+		MsgId: ambaList,
+		Param: dir + listOptions,
+	})
+	if err != nil {
+		return nil, c.errWrap(op, "send ls request, dir: "+dir, err)
+	}
+
+	entries := make([]*Entry, 0, len(res.Listing))
+
+	for _, item := range res.Listing {
+		for name, description := range item {
+			entry, err := parseEntry(name, description)
+			if err != nil {
+				return nil, c.errWrap(op, "parse entry "+name, err)
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// parseEntry parses a listing item like "YDXJ0001.MP4": "1048576 bytes|2023-06-03 10:00:00", dir names end with slash
+func parseEntry(name, description string) (*Entry, error) {
+	entry := &Entry{
+		Name:  strings.TrimSuffix(name, "/"),
+		IsDir: strings.HasSuffix(name, "/"),
+	}
+
+	rawSize, rawTime, found := strings.Cut(description, "|")
+	if !found {
+		rawTime = rawSize
+		rawSize = ""
+	}
+
+	if rawSize != "" {
+		size, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rawSize), "bytes")), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadListing, description)
+		}
+
+		entry.Size = size
+	}
+
+	t, err := time.ParseInLocation(listTimeLayout, strings.TrimSpace(rawTime), time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadListing, description)
+	}
+
+	entry.Time = t
+
+	return entry, nil
+}
+
+// GetFile streams the file from offset over the data port, closing the reader before the end cancels the transfer.
+// A read fails when no data comes for the data timeout or when the session is shut down.
+func (c *Client) GetFile(path string, offset, size uint64) (io.ReadCloser, error) {
+	const op = "AmbaClient.GetFile"
+
+	// the camera sends the data as soon as the request is accepted, so the data connection goes first
+	dataConn, err := c.connFactory.NewConn(c.config.host, c.config.dataPort)
+	if err != nil {
+		return nil, c.errWrap(op, "net dial data port", err)
+	}
+
+	c.mu.Lock()
+	c.dataConns[dataConn] = struct{}{}
+	c.mu.Unlock()
+
+	res, err := c.request(Request{
+		MsgId:     ambaGetFile,
+		Param:     path,
+		Offset:    offset,
+		FetchSize: size - offset,
+	})
+	if err != nil {
+		_ = c.closeDataConn(dataConn)
+		return nil, c.errWrap(op, "send get_file request, path: "+path, err)
+	}
+
+	remaining := size - offset
+	if res.RemSize > 0 {
+		remaining = res.RemSize
+	}
+
+	return &fileReader{
+		client:    c,
+		path:      path,
+		conn:      dataConn,
+		remaining: remaining,
+	}, nil
+}
+
+// DeleteFile deletes the file on the camera
+func (c *Client) DeleteFile(path string) error {
+	const op = "AmbaClient.DeleteFile"
+
+	_, err := c.request(Request{
+		MsgId: ambaDelete,
+		Param: path,
+	})
+	if err != nil {
+		return c.errWrap(op, "send del request, path: "+path, err)
+	}
+
+	return nil
+}
+
+// closeDataConn closes the data connection of the transfer unless the shutdown has closed it
+func (c *Client) closeDataConn(dataConn Conn) error {
+	c.mu.Lock()
+	_, open := c.dataConns[dataConn]
+	delete(c.dataConns, dataConn)
+	c.mu.Unlock()
+
+	if !open {
+		return nil
+	}
+
+	return dataConn.Close()
+}
+
+func (c *Client) cancelGetFile(path string) error {
+	const op = "AmbaClient.cancelGetFile"
+
+	_, err := c.request(Request{
+		MsgId: ambaCancelGetFile,
+		Param: path,
+	})
+	if err != nil {
+		return c.errWrap(op, "send cancel get_file request, path: "+path, err)
+	}
+
+	return nil
+}
+
+// request sends the request with the token of the started session and checks the result code of the response.
+// An expired token or a dropped connection re-establishes the session and the request is sent once again.
+func (c *Client) request(request Request) (Response, error) {
+	const op = "AmbaClient.request"
+
+	for attempt := 1; ; attempt++ {
+		c.mu.Lock()
+		cc := c.conn
+		request.Token = c.token
+		c.mu.Unlock()
+
+		res, err := c.sendRequest(request)
+
+		expired := err == nil && res.Rval == ambaInvalidToken
+		lost := errors.Is(err, ErrConnectionLost)
+
+		if (expired || lost) && attempt == 1 {
+			reconnectErr := c.reconnect(cc)
+			if reconnectErr != nil {
+				return res, c.errWrap(op, "reconnect", errors.Join(err, reconnectErr))
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return res, c.errWrap(op, "send request", err)
+		}
+
+		if res.Rval != 0 {
+			return res, c.errWrap(op, fmt.Sprintf("msg_id %d, rval %d", request.MsgId, res.Rval), ErrRequestRejected)
+		}
+
+		return res, nil
+	}
+}
+
+// fileReader reads the transferred file from the data connection
+type fileReader struct {
+	client    *Client
+	path      string
+	conn      Conn
+	remaining uint64
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	const op = "AmbaClient.fileReader.Read"
+
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if uint64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	err := r.conn.SetReadDeadline(time.Now().Add(dataTimeout))
+	if err != nil {
+		return 0, r.client.errWrap(op, "set read deadline", err)
+	}
+
+	n, err := r.conn.Read(p)
+	r.remaining -= uint64(n)
+
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (r *fileReader) Close() error {
+	var cancelErr error
+	if r.remaining > 0 {
+		cancelErr = r.client.cancelGetFile(r.path)
+	}
+
+	return errors.Join(r.client.closeDataConn(r.conn), cancelErr)
+}
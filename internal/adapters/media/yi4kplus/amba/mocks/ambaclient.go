@@ -216,19 +216,19 @@ func (m *MockReader) EXPECT() *MockReaderMockRecorder {
 	return m.recorder
 }
 
-// ReadString mocks base method.
-func (m *MockReader) ReadString(delim byte) (string, error) {
+// Read mocks base method.
+func (m *MockReader) Read(p []byte) (int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ReadString", delim)
-	ret0, _ := ret[0].(string)
+	ret := m.ctrl.Call(m, "Read", p)
+	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// ReadString indicates an expected call of ReadString.
-func (mr *MockReaderMockRecorder) ReadString(delim any) *gomock.Call {
+// Read indicates an expected call of Read.
+func (mr *MockReaderMockRecorder) Read(p any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadString", reflect.TypeOf((*MockReader)(nil).ReadString), delim)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Read", reflect.TypeOf((*MockReader)(nil).Read), p)
 }
 
 // MockReaderFactory is a mock of ReaderFactory interface.
@@ -2,12 +2,16 @@ package amba
 
 import (
 	"net"
+	"time"
 )
 
+// dialTimeout keeps a dial to the switched off camera from hanging until the system tcp timeout
+const dialTimeout = time.Second * 5
+
 type NetTCPConnFactory struct {
 }
 
 func (*NetTCPConnFactory) NewConn(host, port string) (Conn, error) {
 	addr := net.JoinHostPort(host, port)
-	return net.Dial("tcp", addr)
+	return net.DialTimeout("tcp", addr, dialTimeout)
 }
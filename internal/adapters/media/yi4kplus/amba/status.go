@@ -0,0 +1,148 @@
+package amba
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ambaGetSetting   = 1
+	ambaSetSetting   = 2
+	ambaGetSpace     = 5
+	ambaBatteryLevel = 13
+	// batteryTypeAdapter is the type of the battery response when the camera is on usb power
+	batteryTypeAdapter = "adapter"
+	// settingAppStatus is the setting with the state of the camera app, e.g. idle, record
+	settingAppStatus = "app_status"
+	appStatusRecord  = "record"
+)
+
+// Setting returns the value of the camera setting, e.g. app_status, video_resolution
+func (c *Client) Setting(name string) (string, error) {
+	const op = "AmbaClient.Setting"
+
+	res, err := c.request(Request{
+		MsgId: ambaGetSetting,
+		Type:  name,
+	})
+	if err != nil {
+		return "", c.errWrap(op, "send get_setting request, name: "+name, err)
+	}
+
+	value, err := paramString(res.Param)
+	if err != nil {
+		return "", c.errWrap(op, "parse param", err)
+	}
+
+	return value, nil
+}
+
+// BatteryLevel returns the charge in percent and whether the camera is powered by usb
+func (c *Client) BatteryLevel() (int, bool, error) {
+	const op = "AmbaClient.BatteryLevel"
+
+	res, err := c.request(Request{
+		MsgId: ambaBatteryLevel,
+	})
+	if err != nil {
+		return 0, false, c.errWrap(op, "send battery level request", err)
+	}
+
+	level, err := paramNumber(res.Param)
+	if err != nil {
+		return 0, false, c.errWrap(op, "parse param", err)
+	}
+
+	return int(level), res.Type == batteryTypeAdapter, nil
+}
+
+// Space returns free and total bytes of the sd card
+func (c *Client) Space() (uint64, uint64, error) {
+	const op = "AmbaClient.Space"
+
+	free, err := c.space("free")
+	if err != nil {
+		return 0, 0, c.errWrap(op, "free space", err)
+	}
+
+	total, err := c.space("total")
+	if err != nil {
+		return 0, 0, c.errWrap(op, "total space", err)
+	}
+
+	return free, total, nil
+}
+
+// SetSetting changes the value of the camera setting
+func (c *Client) SetSetting(name, value string) error {
+	const op = "AmbaClient.SetSetting"
+
+	_, err := c.request(Request{
+		MsgId: ambaSetSetting,
+		Type:  name,
+		Param: value,
+	})
+	if err != nil {
+		return c.errWrap(op, "send set_setting request, name: "+name, err)
+	}
+
+	return nil
+}
+
+// IsRecording reports whether the camera records a video now
+func (c *Client) IsRecording() (bool, error) {
+	const op = "AmbaClient.IsRecording"
+
+	appStatus, err := c.Setting(settingAppStatus)
+	if err != nil {
+		return false, c.errWrap(op, "setting "+settingAppStatus, err)
+	}
+
+	return strings.HasPrefix(appStatus, appStatusRecord), nil
+}
+
+// space returns the space of the kind in bytes, the camera reports it in kilobytes
+func (c *Client) space(kind string) (uint64, error) {
+	const op = "AmbaClient.space"
+
+	res, err := c.request(Request{
+		MsgId: ambaGetSpace,
+		Param: kind,
+	})
+	if err != nil {
+		return 0, c.errWrap(op, "send get space request, type: "+kind, err)
+	}
+
+	kilobytes, err := paramNumber(res.Param)
+	if err != nil {
+		return 0, c.errWrap(op, "parse param", err)
+	}
+
+	return kilobytes * 1024, nil
+}
+
+// paramString returns the param which the camera sends as a json string or a bare value
+func paramString(param json.RawMessage) (string, error) {
+	value := ""
+	if json.Unmarshal(param, &value) == nil {
+		return value, nil
+	}
+
+	if len(param) == 0 {
+		return "", fmt.Errorf("empty param")
+	}
+
+	return string(param), nil
+}
+
+// paramNumber returns the param which the camera sends as a json number or a quoted number
+func paramNumber(param json.RawMessage) (uint64, error) {
+	value, err := paramString(param)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+}
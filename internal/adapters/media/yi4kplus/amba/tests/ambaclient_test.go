@@ -2,98 +2,514 @@ package tests
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba/mocks"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/mock/gomock"
+	"io"
+	"net"
+	"sync"
 	"testing"
 	"time"
 )
 
 const loggerEnv = logger.EnvTest
 
-func TestClient_Run(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+// camera answers requests written to the control connection with the replies of their msg_id
+type camera struct {
+	mu       sync.Mutex
+	replies  map[int][]string
+	requests []amba.Request
+	stream   *io.PipeWriter
+}
+
+func newCamera(ctrl *gomock.Controller, replies map[int][]string) (*camera, *mocks.MockConn, *mocks.MockReaderFactory) {
+	mrf := mocks.NewMockReaderFactory(ctrl)
+	cam, mc := newCameraConn(ctrl, mrf, replies)
+
+	return cam, mc, mrf
+}
+
+// newCameraConn returns a connection of the camera, the reader factory reads its stream
+func newCameraConn(ctrl *gomock.Controller, mrf *mocks.MockReaderFactory, replies map[int][]string) (*camera, *mocks.MockConn) {
+	pr, pw := io.Pipe()
+
+	cam := &camera{
+		replies: replies,
+		stream:  pw,
+	}
 
 	mc := mocks.NewMockConn(ctrl)
 
 	mc.EXPECT().
 		Write(gomock.Any()).
+		DoAndReturn(func(b []byte) (int, error) {
+			request := amba.Request{}
+			if err := json.Unmarshal(b, &request); err != nil {
+				return 0, err
+			}
+
+			cam.mu.Lock()
+			defer cam.mu.Unlock()
+
+			cam.requests = append(cam.requests, request)
+
+			if replies := cam.replies[request.MsgId]; len(replies) > 0 {
+				cam.replies[request.MsgId] = replies[1:]
+				go cam.send(replies[0])
+			}
+
+			return len(b), nil
+		}).
 		AnyTimes()
 
 	mc.EXPECT().
-		Read(gomock.Any()).
+		Close().
+		DoAndReturn(func() error {
+			return pw.Close()
+		}).
 		AnyTimes()
 
+	mrf.EXPECT().
+		NewReader(mc).
+		Return(pr)
+
+	return cam, mc
+}
+
+func (cam *camera) send(message string) {
+	_, _ = cam.stream.Write([]byte(message))
+}
+
+func (cam *camera) sentRequests() []amba.Request {
+	cam.mu.Lock()
+	defer cam.mu.Unlock()
+
+	return append([]amba.Request{}, cam.requests...)
+}
+
+func newClient(ctrl *gomock.Controller, mc *mocks.MockConn, mrf *mocks.MockReaderFactory) *amba.Client {
 	mcf := mocks.NewMockConnFactory(ctrl)
 	mcf.EXPECT().
-		NewConn(gomock.Any(), gomock.Any()).
+		NewConn(gomock.Any(), "").
 		Return(mc, nil)
 
-	mr := mocks.NewMockReader(ctrl)
-
-	mr.EXPECT().
-		ReadString(gomock.Any()).
-		Return("{\"rval\": 1, \"msg_id\": 1, \"param\": 1}", nil)
-
-	mrf := mocks.NewMockReaderFactory(ctrl)
+	return amba.New(amba.NewConfig(), logger.New(loggerEnv), mcf, mrf)
+}
 
-	mrf.EXPECT().
-		NewReader(mc).
-		Return(mr)
+func TestClient_Run(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
 
-	c := amba.NewConfig()
-	l := logger.New(loggerEnv)
+	cam, mc, mrf := newCamera(ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+	})
 
-	tc := amba.New(c, l, mcf, mrf)
+	tc := newClient(ctrl, mc, mrf)
 
 	err := tc.Run(context.Background())
 
 	assert.Nil(t, err)
+	assert.Len(t, cam.sentRequests(), 1)
 }
 
 func TestClient_Shutdown(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	mc := mocks.NewMockConn(ctrl)
-	mc.EXPECT().
-		Write(gomock.Any())
-	mc.EXPECT().
-		Close()
+	cam, mc, mrf := newCamera(ctrl, map[int][]string{
+		258: {`{"rval": 0, "msg_id": 258}`},
+	})
 
-	mcf := mocks.NewMockConnFactory(ctrl)
-	mcf.EXPECT().
-		NewConn(gomock.Any(), gomock.Any()).
-		Return(mc, nil)
+	tc := newClient(ctrl, mc, mrf)
 
-	mr := mocks.NewMockReader(ctrl)
-	mr.EXPECT().
-		ReadString(gomock.Any()).
-		Return("{\"rval\": 1, \"msg_id\": 1, \"param\": 1}", nil)
+	err := tc.ConfigureConn()
+	assert.Nil(t, err)
 
-	mrf := mocks.NewMockReaderFactory(ctrl)
-	mrf.EXPECT().
-		NewReader(mc).
-		Return(mr)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancelFunc()
+	}()
+
+	err = tc.Shutdown(ctx)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 258, cam.sentRequests()[0].MsgId)
+}
 
-	c := amba.NewConfig()
-	l := logger.New(loggerEnv)
+func TestClient_PowerOff(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	_, mc, mrf := newCamera(ctrl, map[int][]string{
+		12: {`{"rval": 0, "msg_id": 12}`},
+	})
 
-	tc := amba.New(c, l, mcf, mrf)
+	tc := newClient(ctrl, mc, mrf)
+
+	assert.ErrorIs(t, tc.PowerOff(), amba.ErrNotConnected)
 
 	err := tc.ConfigureConn()
 	assert.Nil(t, err)
 
+	err = tc.PowerOff()
+	assert.Nil(t, err)
+
+	// the session is gone, shutdown has nothing to stop
 	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+
+	assert.Nil(t, tc.Shutdown(ctx))
+}
+
+func TestClient_PowerOffRejected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	_, mc, mrf := newCamera(ctrl, map[int][]string{
+		12: {`{"rval": -13, "msg_id": 12}`},
+	})
+
+	tc := newClient(ctrl, mc, mrf)
+
+	assert.Nil(t, tc.ConfigureConn())
+	assert.ErrorIs(t, tc.PowerOff(), amba.ErrRequestRejected)
+}
+
+func TestClient_List(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the listing has nested objects and spans several lines
+	_, mc, mrf := newCamera(ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1282: {`{"rval": 0, "msg_id": 1282, "listing": [
+			{"100MEDIA/": "2023-06-03 10:00:00"},
+			{"YDXJ0001.MP4": "1048576 bytes|2023-06-03 10:01:02"}
+		]}`},
+	})
+
+	tc := newClient(ctrl, mc, mrf)
+
+	assert.Nil(t, tc.Run(context.Background()))
+
+	entries, err := tc.List("/tmp/fuse_d/DCIM")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	assert.Equal(t, "100MEDIA", entries[0].Name)
+	assert.True(t, entries[0].IsDir)
+
+	assert.Equal(t, "YDXJ0001.MP4", entries[1].Name)
+	assert.False(t, entries[1].IsDir)
+	assert.Equal(t, uint64(1048576), entries[1].Size)
+	assert.Equal(t, time.Date(2023, 6, 3, 10, 1, 2, 0, time.Local), entries[1].Time)
+}
+
+func TestClient_GetFile(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cam, mc, mrf := newCamera(ctrl, map[int][]string{
+		257:  {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1285: {`{"rval": 0, "msg_id": 1285, "size": 10, "rem_size": 6}`},
+		1287: {`{"rval": 0, "msg_id": 1287}`},
+	})
+
+	content := []byte("0123456789")
+
+	dataConn := mocks.NewMockConn(ctrl)
+	// every read waits for the next chunk with a deadline
+	dataConn.EXPECT().
+		SetReadDeadline(gomock.Any()).
+		DoAndReturn(func(deadline time.Time) error {
+			assert.True(t, deadline.After(time.Now()))
+			return nil
+		})
+	dataConn.EXPECT().
+		Read(gomock.Any()).
+		DoAndReturn(func(p []byte) (int, error) {
+			return copy(p, content[4:6]), nil
+		})
+	dataConn.EXPECT().
+		Close()
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	gomock.InOrder(
+		mcf.EXPECT().
+			NewConn(gomock.Any(), "").
+			Return(mc, nil),
+		mcf.EXPECT().
+			NewConn(gomock.Any(), "8787").
+			Return(dataConn, nil),
+	)
+
+	tc := amba.New(amba.NewConfig(), logger.New(loggerEnv), mcf, mrf)
+
+	assert.Nil(t, tc.Run(context.Background()))
+
+	reader, err := tc.GetFile("/tmp/fuse_d/DCIM/100MEDIA/YDXJ0001.MP4", 4, 10)
+	assert.Nil(t, err)
+
+	buf := make([]byte, 2)
+	n, err := reader.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "45", string(buf[:n]))
+
+	// the transfer is not complete, so close cancels it
+	assert.Nil(t, reader.Close())
+
+	requests := cam.sentRequests()
+	assert.Equal(t, 1287, requests[len(requests)-1].MsgId)
+	assert.Equal(t, 3, requests[len(requests)-1].Token)
+}
+
+func TestClient_GetFileShutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	_, mc, mrf := newCamera(ctrl, map[int][]string{
+		257:  {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		258:  {`{"rval": 0, "msg_id": 258}`},
+		1285: {`{"rval": 0, "msg_id": 1285, "size": 10, "rem_size": 10}`},
+	})
+
+	// the camera stalls, no data comes
+	server, dataConn := net.Pipe()
+	defer func() {
+		_ = server.Close()
+	}()
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	gomock.InOrder(
+		mcf.EXPECT().
+			NewConn(gomock.Any(), "").
+			Return(mc, nil),
+		mcf.EXPECT().
+			NewConn(gomock.Any(), "8787").
+			Return(dataConn, nil),
+	)
+
+	tc := amba.New(amba.NewConfig(), logger.New(loggerEnv), mcf, mrf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, tc.Run(ctx))
+
+	reader, err := tc.GetFile("/tmp/fuse_d/DCIM/100MEDIA/YDXJ0001.MP4", 0, 10)
+	assert.Nil(t, err)
+
+	readErr := make(chan error)
 	go func() {
-		time.Sleep(1 * time.Second)
-		cancelFunc()
+		_, err := reader.Read(make([]byte, 10))
+		readErr <- err
 	}()
 
-	err = tc.Shutdown(ctx)
+	// the end of the session stops the transfer in progress
+	cancel()
+
+	select {
+	case err := <-readErr:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("read is not stopped by the end of the session")
+	}
+}
+
+func TestClient_Notifications(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cam, mc, mrf := newCamera(ctrl, map[int][]string{})
+
+	tc := newClient(ctrl, mc, mrf)
+	notifications := tc.Subscribe(1)
+
+	assert.Nil(t, tc.ConfigureConn())
+
+	cam.send(`{"msg_id": 7, "type": "battery", "param": "45"}`)
+
+	select {
+	case n := <-notifications.C:
+		assert.Equal(t, "battery", n.Type)
+		assert.Equal(t, `"45"`, string(n.Param))
+	case <-time.After(time.Second):
+		t.Fatal("notification is not delivered")
+	}
+}
+
+func TestClient_ConcurrentRequests(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cam, mc, mrf := newCamera(ctrl, map[int][]string{})
+
+	tc := newClient(ctrl, mc, mrf)
+
+	assert.Nil(t, tc.ConfigureConn())
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		assert.Nil(t, tc.DeleteFile("/tmp/fuse_d/DCIM/100MEDIA/YDXJ0001.MP4"))
+	}()
+
+	var entries []*amba.Entry
+	go func() {
+		defer wg.Done()
+
+		var err error
+		entries, err = tc.List("/tmp/fuse_d/DCIM")
+		assert.Nil(t, err)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(cam.sentRequests()) == 2
+	}, time.Second, time.Millisecond)
+
+	// the replies come in another order than the requests, with a notification in between
+	cam.send(`{"rval": 0, "msg_id": 1282, "listing": [{"100MEDIA/": "2023-06-03 10:00:00"}]}`)
+	cam.send(`{"msg_id": 7, "type": "sd_card_status", "param": "insert"}`)
+	cam.send(`{"rval": 0, "msg_id": 1281}`)
+
+	wg.Wait()
+
+	assert.Len(t, entries, 1)
+}
 
+func TestClient_ReconnectOnInvalidToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mrf := mocks.NewMockReaderFactory(ctrl)
+
+	// the first session expires, the camera rejects its token
+	expired, expiredConn := newCameraConn(ctrl, mrf, map[int][]string{
+		257:  {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1281: {`{"rval": -4, "msg_id": 1281}`},
+	})
+
+	renewed, renewedConn := newCameraConn(ctrl, mrf, map[int][]string{
+		257:  {`{"rval": 0, "msg_id": 257, "param": 4}`},
+		1281: {`{"rval": 0, "msg_id": 1281}`},
+	})
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	gomock.InOrder(
+		mcf.EXPECT().
+			NewConn(gomock.Any(), "").
+			Return(expiredConn, nil),
+		mcf.EXPECT().
+			NewConn(gomock.Any(), "").
+			Return(renewedConn, nil),
+	)
+
+	tc := amba.New(amba.NewConfig(), logger.New(loggerEnv), mcf, mrf)
+
+	assert.Nil(t, tc.Run(context.Background()))
+	assert.Nil(t, tc.DeleteFile("/tmp/fuse_d/DCIM/100MEDIA/YDXJ0001.MP4"))
+
+	assert.Len(t, expired.sentRequests(), 2)
+
+	requests := renewed.sentRequests()
+	assert.Len(t, requests, 2)
+	assert.Equal(t, 1281, requests[1].MsgId)
+	assert.Equal(t, 4, requests[1].Token)
+}
+
+func TestClient_Heartbeat(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Setenv("AMBA_SERVER_AUTO_SHUTDOWN_WITHOUT_CONNECTION_TIMEOUT", "1")
+
+	cam, mc, mrf := newCamera(ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		13:  {`{"rval": 0, "msg_id": 13, "param": 80}`},
+	})
+
+	tc := newClient(ctrl, mc, mrf)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	assert.Nil(t, tc.Run(ctx))
+
+	assert.Eventually(t, func() bool {
+		requests := cam.sentRequests()
+		return len(requests) == 2 && requests[1].MsgId == 13 && requests[1].Token == 3
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestClient_Status(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the camera sends numbers as strings
+	_, mc, mrf := newCamera(ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		13: {
+			`{"rval": 0, "msg_id": 13, "type": "adapter", "param": "80"}`,
+			`{"rval": 0, "msg_id": 13, "type": "battery", "param": "15"}`,
+		},
+		5: {
+			`{"rval": 0, "msg_id": 5, "param": "1024"}`,
+			`{"rval": 0, "msg_id": 5, "param": 4096}`,
+		},
+		1: {`{"rval": 0, "msg_id": 1, "type": "app_status", "param": "record"}`},
+	})
+
+	tc := newClient(ctrl, mc, mrf)
+
+	assert.Nil(t, tc.Run(context.Background()))
+
+	level, externalPower, err := tc.BatteryLevel()
+	assert.Nil(t, err)
+	assert.Equal(t, 80, level)
+	assert.True(t, externalPower)
+
+	level, externalPower, err = tc.BatteryLevel()
+	assert.Nil(t, err)
+	assert.Equal(t, 15, level)
+	assert.False(t, externalPower)
+
+	free, total, err := tc.Space()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1024*1024), free)
+	assert.Equal(t, uint64(4096*1024), total)
+
+	recording, err := tc.IsRecording()
+	assert.Nil(t, err)
+	assert.True(t, recording)
+}
+
+func TestClient_Clock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cam, mc, mrf := newCamera(ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1:   {`{"rval": 0, "msg_id": 1, "type": "camera_clock", "param": "2015-01-01 00:00:12"}`},
+		2:   {`{"rval": 0, "msg_id": 2}`},
+	})
+
+	tc := newClient(ctrl, mc, mrf)
+
+	assert.Nil(t, tc.Run(context.Background()))
+
+	clock, err := tc.Clock()
 	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2015, 1, 1, 0, 0, 12, 0, time.Local), clock)
+
+	assert.Nil(t, tc.SetClock(time.Date(2023, 6, 3, 10, 1, 2, 0, time.Local)))
+
+	requests := cam.sentRequests()
+	set := requests[len(requests)-1]
+	assert.Equal(t, 2, set.MsgId)
+	assert.Equal(t, "camera_clock", set.Type)
+	assert.Equal(t, "2023-06-03 10:01:02", set.Param)
 }
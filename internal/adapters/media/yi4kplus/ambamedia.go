@@ -0,0 +1,190 @@
+package yi4kplus
+
+import (
+	"context"
+	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/camera"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
+	"io"
+	"sync"
+)
+
+// AmbaMedia lists, streams and deletes files of the camera with the amba protocol only,
+// so it works on cameras without telnet and ftp server
+type AmbaMedia struct {
+	config      *Config
+	ambaClient  *amba.Client
+	ambaSession *ambaSession
+	// transferMu is held from GetReader until the reader is closed, the data port carries one transfer at a time
+	transferMu sync.Mutex
+}
+
+func NewAmbaMedia(config *Config, ambaClient *amba.Client) *AmbaMedia {
+	return &AmbaMedia{
+		config:      config,
+		ambaClient:  ambaClient,
+		ambaSession: newAmbaSession(ambaClient),
+	}
+}
+
+func (a *AmbaMedia) SessionStart(ctx context.Context) error {
+	const op = "AmbaMedia.SessionStart"
+
+	err := a.ambaSession.run(ctx)
+	if err != nil {
+		return a.errWrap(op, "amba client run", err)
+	}
+
+	return nil
+}
+
+// GetFiles lists the dirs of the media dir, e.g. 100MEDIA, and sends media groups of every dir.
+// The listing is done before the return, so the error channel is closed without an error.
+func (a *AmbaMedia) GetFiles(ctx context.Context) (<-chan *file.File, <-chan error, error) {
+	const op = "AmbaMedia.GetFiles"
+
+	mediaDirs, err := a.ambaClient.List(a.config.mediaDir)
+	if err != nil {
+		return nil, nil, a.errWrap(op, "amba list "+a.config.mediaDir, err)
+	}
+
+	groups := make([]*file.File, 0)
+
+	for _, dir := range mediaDirs {
+		if !dir.IsDir {
+			continue
+		}
+
+		entries, err := a.ambaClient.List(a.config.mediaDir + "/" + dir.Name)
+		if err != nil {
+			return nil, nil, a.errWrap(op, "amba list "+dir.Name, err)
+		}
+
+		files := make([]*file.File, 0, len(entries))
+		for _, entry := range entries {
+			if entry.IsDir {
+				continue
+			}
+
+			f := file.New(entry.Name, dir.Name, entry.Time, entry.Size)
+			f.Camera = a.config.name
+			files = append(files, f)
+		}
+
+		groups = append(groups, file.Group(files)...)
+	}
+
+	fileChan := make(chan *file.File)
+	errChan := make(chan error)
+
+	go func() {
+		defer close(errChan)
+		defer close(fileChan)
+
+		for _, group := range groups {
+			select {
+			case <-ctx.Done():
+				return
+			case fileChan <- group:
+			}
+		}
+	}()
+
+	return fileChan, errChan, nil
+}
+
+// GetReader waits for the transfer in progress to be closed, so several exporter workers take turns on the data port
+func (a *AmbaMedia) GetReader(f *file.File, offset uint64) (io.ReadCloser, error) {
+	const op = "AmbaMedia.GetReader"
+
+	a.transferMu.Lock()
+
+	filepath := a.path(f)
+	reader, err := a.ambaClient.GetFile(filepath, offset, f.Size)
+	if err != nil {
+		a.transferMu.Unlock()
+		return nil, a.errWrap(op, "amba get file "+filepath, err)
+	}
+
+	return &transferReader{
+		ReadCloser: reader,
+		unlock:     a.transferMu.Unlock,
+	}, nil
+}
+
+func (a *AmbaMedia) Delete(f *file.File) error {
+	const op = "AmbaMedia.Delete"
+
+	filepath := a.path(f)
+	err := a.ambaClient.DeleteFile(filepath)
+	if err != nil {
+		return a.errWrap(op, "amba delete file "+filepath, err)
+	}
+
+	return nil
+}
+
+// Checksum is not available without a shell on the camera
+func (a *AmbaMedia) Checksum(ctx context.Context, f *file.File) (string, error) {
+	const op = "AmbaMedia.Checksum"
+
+	return "", a.errWrap(op, "checksum "+f.Name, ports.ErrNotSupported)
+}
+
+// Status reads the state of the camera, it may be called before SessionStart
+func (a *AmbaMedia) Status(ctx context.Context) (*camera.Status, error) {
+	const op = "AmbaMedia.Status"
+
+	err := a.ambaSession.run(ctx)
+	if err != nil {
+		return nil, a.errWrap(op, "amba client run", err)
+	}
+
+	status, err := cameraStatus(a.ambaClient)
+	if err != nil {
+		return nil, a.errWrap(op, "camera status", err)
+	}
+
+	return status, nil
+}
+
+func (a *AmbaMedia) PowerOff(ctx context.Context) error {
+	const op = "AmbaMedia.PowerOff"
+
+	err := a.ambaClient.PowerOff()
+	if err != nil {
+		return a.errWrap(op, "amba power off", err)
+	}
+
+	err = waitOffline(ctx, a.ambaClient, a.config.powerOffTimeout)
+	if err != nil {
+		return a.errWrap(op, "wait offline", err)
+	}
+
+	return nil
+}
+
+// transferReader releases the data port when the reader is closed
+type transferReader struct {
+	io.ReadCloser
+	unlock func()
+	once   sync.Once
+}
+
+func (r *transferReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.unlock)
+
+	return err
+}
+
+// path returns the location of the file on the camera file system
+func (a *AmbaMedia) path(f *file.File) string {
+	return a.config.mediaDir + "/" + f.Path + "/" + f.Name
+}
+
+func (a *AmbaMedia) errWrap(methodName, message string, err error) error {
+	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
+}
@@ -0,0 +1,71 @@
+package yi4kplus
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// AdapterFtp uses telnet and the ftp server of the camera
+	AdapterFtp = "ftp"
+	// AdapterAmba uses the amba protocol only
+	AdapterAmba = "amba"
+)
+
+type Config struct {
+	adapter         string
+	name            string
+	mediaDir        string
+	powerOffTimeout time.Duration
+	// syncClock sets the camera clock to the host time when it drifts more than maxClockDrift
+	syncClock     bool
+	maxClockDrift time.Duration
+}
+
+func NewConfig() *Config {
+	adapter := os.Getenv("MEDIA_ADAPTER")
+	if adapter != AdapterAmba {
+		adapter = AdapterFtp
+	}
+
+	name := os.Getenv("CAMERA_NAME")
+	if name == "" {
+		name = os.Getenv("CAMERA_HOST")
+	}
+
+	mediaDir := os.Getenv("CAMERA_MEDIA_DIR")
+	if mediaDir == "" {
+		mediaDir = os.Getenv("FTP_SERVER_MEDIA_DIR")
+	}
+
+	powerOffTimeout := time.Second * 30
+	rawPowerOffTimeout := os.Getenv("CAMERA_POWER_OFF_TIMEOUT_SECONDS")
+
+	if i, err := strconv.Atoi(rawPowerOffTimeout); err == nil && i > 0 {
+		powerOffTimeout = time.Second * time.Duration(i)
+	}
+
+	syncClock := true
+	rawSyncClock := os.Getenv("CAMERA_CLOCK_SYNC")
+
+	if b, err := strconv.ParseBool(rawSyncClock); err == nil {
+		syncClock = b
+	}
+
+	maxClockDrift := time.Second * 5
+	rawMaxClockDrift := os.Getenv("CAMERA_CLOCK_MAX_DRIFT_SECONDS")
+
+	if i, err := strconv.Atoi(rawMaxClockDrift); err == nil && i >= 0 {
+		maxClockDrift = time.Second * time.Duration(i)
+	}
+
+	return &Config{
+		adapter:         adapter,
+		name:            name,
+		mediaDir:        mediaDir,
+		powerOffTimeout: powerOffTimeout,
+		syncClock:       syncClock,
+		maxClockDrift:   maxClockDrift,
+	}
+}
@@ -1,18 +1,126 @@
 package ftp
 
-import "os"
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultInclude are the clips, photos and sidecars of the Yi 4K+
+const defaultInclude = "*.MP4,*.MOV,*.JPG,*.DNG,*.SEC,*.THM,*.LRV"
 
 type Config struct {
 	host     string
 	port     string
 	user     string
 	password string
+	// timeout limits the dial and every command of the connection
+	timeout time.Duration
+	// disableEPSV makes the client use PASV for servers which reject EPSV, the library has no active mode
+	disableEPSV bool
+	// disableMLSD makes the client list directories by LIST for servers with a broken MLSD
+	disableMLSD bool
+	// explicitTLS upgrades the control and data connections with AUTH TLS
+	explicitTLS bool
+	// tlsInsecureSkipVerify accepts a self-signed certificate of the camera
+	tlsInsecureSkipVerify bool
+	// debug logs the ftp protocol exchange
+	debug bool
+	// walkMaxDepth limits the nesting of directories under the media dir
+	walkMaxDepth int
+	// include and exclude are case-insensitive globs of file names, a file must match include and not exclude,
+	// an empty include accepts every name
+	include []string
+	exclude []string
+	// minSize and maxSize limit the file size in bytes, zero is no limit
+	minSize uint64
+	maxSize uint64
 }
 
 func NewConfig() *Config {
+	timeout := time.Second * 5
+	rawTimeout := os.Getenv("FTP_SERVER_TIMEOUT_SECONDS")
+
+	if i, err := strconv.Atoi(rawTimeout); err == nil && i > 0 {
+		timeout = time.Second * time.Duration(i)
+	}
+
+	walkMaxDepth := 4
+	rawWalkMaxDepth := os.Getenv("FTP_WALK_MAX_DEPTH")
+
+	if i, err := strconv.Atoi(rawWalkMaxDepth); err == nil && i > 0 {
+		walkMaxDepth = i
+	}
+
+	include, ok := os.LookupEnv("FTP_WALK_INCLUDE")
+	if !ok {
+		include = defaultInclude
+	}
+
 	return &Config{
-		host: os.Getenv("FTP_SERVER_HOST"),
-		port: os.Getenv("FTP_SERVER_PORT"),
-		user: os.Getenv("FTP_SERVER_USER"),
+		host:                  os.Getenv("FTP_SERVER_HOST"),
+		port:                  os.Getenv("FTP_SERVER_PORT"),
+		user:                  os.Getenv("FTP_SERVER_USER"),
+		password:              os.Getenv("FTP_SERVER_PASSWORD"),
+		timeout:               timeout,
+		disableEPSV:           parseBool(os.Getenv("FTP_SERVER_DISABLE_EPSV")),
+		disableMLSD:           parseBool(os.Getenv("FTP_SERVER_DISABLE_MLSD")),
+		explicitTLS:           parseBool(os.Getenv("FTP_SERVER_EXPLICIT_TLS")),
+		tlsInsecureSkipVerify: parseBool(os.Getenv("FTP_SERVER_TLS_INSECURE_SKIP_VERIFY")),
+		debug:                 parseBool(os.Getenv("FTP_SERVER_DEBUG")),
+		walkMaxDepth:          walkMaxDepth,
+		include:               parseGlobs(include),
+		exclude:               parseGlobs(os.Getenv("FTP_WALK_EXCLUDE")),
+		minSize:               parseSize(os.Getenv("FTP_WALK_MIN_SIZE_BYTES")),
+		maxSize:               parseSize(os.Getenv("FTP_WALK_MAX_SIZE_BYTES")),
+	}
+}
+
+// LogValue keeps the password out of the logs
+func (c *Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("host", c.host),
+		slog.String("port", c.port),
+		slog.String("user", c.user),
+		slog.Duration("timeout", c.timeout),
+		slog.Bool("disableEPSV", c.disableEPSV),
+		slog.Bool("disableMLSD", c.disableMLSD),
+		slog.Bool("explicitTLS", c.explicitTLS),
+		slog.Bool("debug", c.debug),
+		slog.Int("walkMaxDepth", c.walkMaxDepth),
+		slog.Any("include", c.include),
+		slog.Any("exclude", c.exclude),
+		slog.Uint64("minSize", c.minSize),
+		slog.Uint64("maxSize", c.maxSize),
+	)
+}
+
+func parseBool(raw string) bool {
+	b, err := strconv.ParseBool(raw)
+	return err == nil && b
+}
+
+// parseGlobs parses a list like "*.MP4, *.JPG", the globs are upper-cased for the case-insensitive match
+func parseGlobs(raw string) []string {
+	globs := make([]string, 0)
+
+	for _, glob := range strings.Split(raw, ",") {
+		glob = strings.TrimSpace(glob)
+		if glob != "" {
+			globs = append(globs, strings.ToUpper(glob))
+		}
 	}
+
+	return globs
+}
+
+func parseSize(raw string) uint64 {
+	size, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return size
 }
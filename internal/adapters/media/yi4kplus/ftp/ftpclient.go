@@ -2,33 +2,61 @@ package ftp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 	"github.com/jlaffaye/ftp"
 	"io"
 	"log/slog"
-	"time"
+	"net/textproto"
+	"sync"
 )
 
+var ErrNotConnected = errors.New("ftp session is not started")
+
 type Conn interface {
-	NameList(path string) (entries []string, err error)
 	List(path string) (entries []*ftp.Entry, err error)
 	Retr(path string) (*ftp.Response, error)
+	RetrFrom(path string, offset uint64) (*ftp.Response, error)
 	Delete(path string) error
 	Login(user, password string) error
 	Quit() error
 }
 
 type ConnFactory interface {
-	NewConn(host, port string, timeout time.Duration) (Conn, error)
+	NewConn(config *Config) (Conn, error)
 }
 
+// Client lists files over the main connection, transfers and deletes go over a pool of connections,
+// so every goroutine working with files has its own ftp session
 type Client struct {
 	config      *Config
 	logger      *logger.Logger
 	connFactory ConnFactory
 	conn        Conn
+	mu          sync.Mutex
+	idleConns   []Conn
+}
+
+// pooledResponse returns the connection to the pool when the transfer is closed
+type pooledResponse struct {
+	*ftp.Response
+	client *Client
+	conn   Conn
+}
+
+func (r *pooledResponse) Close() error {
+	err := r.Response.Close()
+	if err != nil {
+		r.client.discard(r.conn)
+		return err
+	}
+
+	r.client.release(r.conn)
+
+	return nil
 }
 
 func New(config *Config, logger *logger.Logger, connFactory ConnFactory) *Client {
@@ -40,13 +68,16 @@ func New(config *Config, logger *logger.Logger, connFactory ConnFactory) *Client
 }
 
 func (c *Client) ConfigureConn() error {
+	const op = "FtpClient.ConfigureConn"
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.conn != nil {
 		return nil
 	}
 
-	const op = "FtpClient.ConfigureConn"
-
-	conn, err := c.connFactory.NewConn(c.config.host, c.config.port, 5*time.Second)
+	conn, err := c.connFactory.NewConn(c.config)
 
 	if err != nil {
 		return c.errWrap(op, "ftp dial", err)
@@ -90,84 +121,141 @@ func (c *Client) Run(ctx context.Context) error {
 	return nil
 }
 
-func (c *Client) GetFiles(ctx context.Context) (<-chan *file.File, error) {
+// GetFiles walks the media dir and sends the media groups of every directory,
+// see walk for the entries which are skipped.
+// The media dir is listed before the return, a failure deeper in the walk is sent to the error channel
+// after the file channel is closed, so a partial listing is never taken for the whole media.
+func (c *Client) GetFiles(ctx context.Context) (<-chan *file.File, <-chan error, error) {
 	const op = "FtpClient.GetFiles"
 
-	log := c.logger.With(
-		slog.String("op", op),
-		slog.Any("config", c.config),
-	)
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil, nil, c.errWrap(op, "check connection", ErrNotConnected)
+	}
 
-	mediaDirs, err := c.conn.NameList("")
+	entries, err := conn.List("")
 	if err != nil {
-		return nil, c.errWrap(op, "name list request", err)
+		return nil, nil, c.errWrap(op, "list request", err)
 	}
 
 	fileChan := make(chan *file.File)
+	errChan := make(chan error, 1)
 
 	go func() {
-		for _, dirName := range mediaDirs {
-
-			select {
-			case <-ctx.Done():
-				close(fileChan)
-				return
-			default:
-
-				entries, err := c.conn.List(dirName)
-
-				if err != nil {
-					log.Error("list request failed: " + err.Error())
-					close(fileChan)
-					return
-				}
-
-				for _, entry := range entries {
-					select {
-					case <-ctx.Done():
-						close(fileChan)
-						return
-					default:
-
-						fileChan <- file.New(
-							entry.Name,
-							dirName,
-							entry.Time,
-							entry.Size,
-						)
-					}
-				}
-			}
-		}
+		defer close(errChan)
 
+		err := c.walkEntries(ctx, conn, "", 0, entries, fileChan)
 		close(fileChan)
+
+		if err != nil {
+			errChan <- c.errWrap(op, "walk", err)
+		}
 	}()
 
-	return fileChan, nil
+	return fileChan, errChan, nil
 }
 
-func (c *Client) GetReader(path string) (io.ReadCloser, error) {
+// GetReader opens the remote file for reading, starting at offset bytes (REST command) when offset is not zero
+func (c *Client) GetReader(path string, offset uint64) (io.ReadCloser, error) {
 	const op = "FtpClient.GetReader"
 
-	response, err := c.conn.Retr(path)
+	conn, err := c.acquire()
 	if err != nil {
-		return nil, c.errWrap(op, "send retr request: "+path, err)
+		return nil, c.errWrap(op, "acquire connection", err)
 	}
 
-	return response, nil
+	var response *ftp.Response
+
+	if offset == 0 {
+		response, err = conn.Retr(path)
+	} else {
+		response, err = conn.RetrFrom(path, offset)
+	}
+
+	if err != nil {
+		c.discard(conn)
+		return nil, c.errWrap(op, fmt.Sprintf("send retr request from offset %d: %s", offset, path), c.mapError(err))
+	}
+
+	return &pooledResponse{
+		Response: response,
+		client:   c,
+		conn:     conn,
+	}, nil
 }
 
 func (c *Client) Delete(path string) error {
 	const op = "FtpClient.Delete"
 
-	err := c.conn.Delete(path)
+	conn, err := c.acquire()
+	if err != nil {
+		return c.errWrap(op, "acquire connection", err)
+	}
+
+	err = conn.Delete(path)
 	if err != nil {
-		return c.errWrap(op, "send delete request file "+path, err)
+		c.discard(conn)
+		return c.errWrap(op, "send delete request file "+path, c.mapError(err))
 	}
 
+	c.release(conn)
+
 	return nil
 }
 
+// acquire takes an idle connection from the pool or opens a new one
+func (c *Client) acquire() (Conn, error) {
+	const op = "FtpClient.acquire"
+
+	c.mu.Lock()
+	if n := len(c.idleConns); n > 0 {
+		conn := c.idleConns[n-1]
+		c.idleConns = c.idleConns[:n-1]
+		c.mu.Unlock()
+
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	conn, err := c.connFactory.NewConn(c.config)
+	if err != nil {
+		return nil, c.errWrap(op, "ftp dial", err)
+	}
+
+	err = conn.Login(c.config.user, c.config.password)
+	if err != nil {
+		_ = conn.Quit()
+		return nil, c.errWrap(op, "send login request with user "+c.config.user, err)
+	}
+
+	return conn, nil
+}
+
+func (c *Client) release(conn Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.idleConns = append(c.idleConns, conn)
+}
+
+// discard closes the connection which state is unknown after a failed request
+func (c *Client) discard(conn Conn) {
+	_ = conn.Quit()
+}
+
+// mapError marks errors of missing files, so the caller does not retry them
+func (c *Client) mapError(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code == ftp.StatusFileUnavailable {
+		return fmt.Errorf("%w: %w", ports.ErrNotFound, err)
+	}
+
+	return err
+}
+
 func (c *Client) startSession() error {
 	const op = "FtpClient.startSession"
 
@@ -176,7 +264,15 @@ func (c *Client) startSession() error {
 		slog.Any("config", c.config),
 	)
 
-	err := c.conn.Login(c.config.user, c.config.password)
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return c.errWrap(op, "check connection", ErrNotConnected)
+	}
+
+	err := conn.Login(c.config.user, c.config.password)
 
 	if err != nil {
 		return c.errWrap(op, "send login request with user "+c.config.user, err)
@@ -197,16 +293,28 @@ func (c *Client) Shutdown(ctx context.Context) error {
 
 	<-ctx.Done()
 
-	if c.conn == nil {
+	// the connection is dropped even if quit fails, so the next session dials a new one
+	c.mu.Lock()
+	idleConns := c.idleConns
+	c.idleConns = nil
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	for _, idleConn := range idleConns {
+		if err := idleConn.Quit(); err != nil {
+			log.Info("Close pooled ftp connection failed: " + err.Error())
+		}
+	}
+
+	if conn == nil {
 		return nil
 	}
 
-	if err := c.conn.Quit(); err != nil {
+	if err := conn.Quit(); err != nil {
 		return c.errWrap(op, "connection close ftp", err)
 	}
 
-	c.conn = nil
-
 	log.Info("Success closing ftp connection")
 
 	return nil
@@ -1,15 +1,56 @@
 package ftp
 
 import (
+	"crypto/tls"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 	"github.com/jlaffaye/ftp"
+	"log/slog"
 	"net"
-	"time"
+	"strings"
 )
 
 type FTPConnFactory struct {
+	// Logger receives the protocol exchange when the debug is on
+	Logger *logger.Logger
 }
 
-func (c *FTPConnFactory) NewConn(host, port string, timeout time.Duration) (Conn, error) {
-	addr := net.JoinHostPort(host, port)
-	return ftp.Dial(addr, ftp.DialWithTimeout(timeout))
+func (c *FTPConnFactory) NewConn(config *Config) (Conn, error) {
+	addr := net.JoinHostPort(config.host, config.port)
+
+	options := []ftp.DialOption{
+		ftp.DialWithTimeout(config.timeout),
+		ftp.DialWithDisabledEPSV(config.disableEPSV),
+		ftp.DialWithDisabledMLSD(config.disableMLSD),
+	}
+
+	if config.explicitTLS {
+		options = append(options, ftp.DialWithExplicitTLS(&tls.Config{
+			ServerName:         config.host,
+			InsecureSkipVerify: config.tlsInsecureSkipVerify,
+		}))
+	}
+
+	if config.debug && c.Logger != nil {
+		options = append(options, ftp.DialWithDebugOutput(&debugWriter{logger: c.Logger}))
+	}
+
+	return ftp.Dial(addr, options...)
+}
+
+// debugWriter logs the protocol exchange line by line with the password masked
+type debugWriter struct {
+	logger *logger.Logger
+}
+
+func (w *debugWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\r\n"), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(strings.ToUpper(line), "PASS ") {
+			line = "PASS ***"
+		}
+
+		w.logger.Debug("Ftp exchange", slog.String("line", line))
+	}
+
+	return len(p), nil
 }
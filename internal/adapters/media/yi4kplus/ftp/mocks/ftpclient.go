@@ -11,7 +11,6 @@ package mocks
 
 import (
 	reflect "reflect"
-	time "time"
 
 	ftp "github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/ftp"
 	ftp0 "github.com/jlaffaye/ftp"
@@ -84,21 +83,6 @@ func (mr *MockConnMockRecorder) Login(user, password any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Login", reflect.TypeOf((*MockConn)(nil).Login), user, password)
 }
 
-// NameList mocks base method.
-func (m *MockConn) NameList(path string) ([]string, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "NameList", path)
-	ret0, _ := ret[0].([]string)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// NameList indicates an expected call of NameList.
-func (mr *MockConnMockRecorder) NameList(path any) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NameList", reflect.TypeOf((*MockConn)(nil).NameList), path)
-}
-
 // Quit mocks base method.
 func (m *MockConn) Quit() error {
 	m.ctrl.T.Helper()
@@ -128,6 +112,21 @@ func (mr *MockConnMockRecorder) Retr(path any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Retr", reflect.TypeOf((*MockConn)(nil).Retr), path)
 }
 
+// RetrFrom mocks base method.
+func (m *MockConn) RetrFrom(path string, offset uint64) (*ftp0.Response, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RetrFrom", path, offset)
+	ret0, _ := ret[0].(*ftp0.Response)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RetrFrom indicates an expected call of RetrFrom.
+func (mr *MockConnMockRecorder) RetrFrom(path, offset any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RetrFrom", reflect.TypeOf((*MockConn)(nil).RetrFrom), path, offset)
+}
+
 // MockConnFactory is a mock of ConnFactory interface.
 type MockConnFactory struct {
 	ctrl     *gomock.Controller
@@ -152,16 +151,16 @@ func (m *MockConnFactory) EXPECT() *MockConnFactoryMockRecorder {
 }
 
 // NewConn mocks base method.
-func (m *MockConnFactory) NewConn(host, port string, timeout time.Duration) (ftp.Conn, error) {
+func (m *MockConnFactory) NewConn(config *ftp.Config) (ftp.Conn, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "NewConn", host, port, timeout)
+	ret := m.ctrl.Call(m, "NewConn", config)
 	ret0, _ := ret[0].(ftp.Conn)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // NewConn indicates an expected call of NewConn.
-func (mr *MockConnFactoryMockRecorder) NewConn(host, port, timeout any) *gomock.Call {
+func (mr *MockConnFactoryMockRecorder) NewConn(config any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewConn", reflect.TypeOf((*MockConnFactory)(nil).NewConn), host, port, timeout)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewConn", reflect.TypeOf((*MockConnFactory)(nil).NewConn), config)
 }
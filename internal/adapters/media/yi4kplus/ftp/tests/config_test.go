@@ -0,0 +1,24 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/ftp"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"testing"
+)
+
+func TestConfig_LogValue(t *testing.T) {
+	t.Setenv("FTP_SERVER_HOST", "yi4kplus")
+	t.Setenv("FTP_SERVER_USER", "root")
+	t.Setenv("FTP_SERVER_PASSWORD", "secret")
+
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, nil))
+
+	log.Info("Run connection", slog.Any("config", ftp.NewConfig()))
+
+	assert.Contains(t, buf.String(), "config.host=yi4kplus")
+	assert.Contains(t, buf.String(), "config.user=root")
+	assert.NotContains(t, buf.String(), "secret")
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/ftp"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/ftp/mocks"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
@@ -25,7 +26,7 @@ func TestClient_Run(t *testing.T) {
 
 	mcf := mocks.NewMockConnFactory(ctrl)
 	mcf.EXPECT().
-		NewConn(gomock.Any(), gomock.Any(), gomock.Any()).
+		NewConn(gomock.Any()).
 		Return(mc, nil)
 
 	c := ftp.NewConfig()
@@ -43,15 +44,23 @@ func TestClient_Delete(t *testing.T) {
 	defer ctrl.Finish()
 
 	mc := mocks.NewMockConn(ctrl)
+	mp := mocks.NewMockConn(ctrl)
+	mp.EXPECT().
+		Login(gomock.Any(), gomock.Any())
 
 	filepathForDelete := "test.mp4"
-	mc.EXPECT().
+	mp.EXPECT().
 		Delete(filepathForDelete)
 
 	mcf := mocks.NewMockConnFactory(ctrl)
-	mcf.EXPECT().
-		NewConn(gomock.Any(), gomock.Any(), gomock.Any()).
-		Return(mc, nil)
+	gomock.InOrder(
+		mcf.EXPECT().
+			NewConn(gomock.Any()).
+			Return(mc, nil),
+		mcf.EXPECT().
+			NewConn(gomock.Any()).
+			Return(mp, nil),
+	)
 
 	c := ftp.NewConfig()
 	l := logger.New(loggerEnv)
@@ -71,16 +80,24 @@ func TestClient_GetReader(t *testing.T) {
 	defer ctrl.Finish()
 
 	mc := mocks.NewMockConn(ctrl)
+	mp := mocks.NewMockConn(ctrl)
+	mp.EXPECT().
+		Login(gomock.Any(), gomock.Any())
 
 	filepathForRead := "/some/dir/video1.mp4"
-	mc.EXPECT().
+	mp.EXPECT().
 		Retr(filepathForRead).
 		Return(&bftp.Response{}, nil)
 
 	mcf := mocks.NewMockConnFactory(ctrl)
-	mcf.EXPECT().
-		NewConn(gomock.Any(), gomock.Any(), gomock.Any()).
-		Return(mc, nil)
+	gomock.InOrder(
+		mcf.EXPECT().
+			NewConn(gomock.Any()).
+			Return(mc, nil),
+		mcf.EXPECT().
+			NewConn(gomock.Any()).
+			Return(mp, nil),
+	)
 
 	c := ftp.NewConfig()
 	l := logger.New(loggerEnv)
@@ -90,7 +107,46 @@ func TestClient_GetReader(t *testing.T) {
 	err := fc.ConfigureConn()
 	assert.Nil(t, err)
 
-	r, err := fc.GetReader(filepathForRead)
+	r, err := fc.GetReader(filepathForRead, 0)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+}
+
+func TestClient_GetReaderFromOffset(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mc := mocks.NewMockConn(ctrl)
+	mp := mocks.NewMockConn(ctrl)
+	mp.EXPECT().
+		Login(gomock.Any(), gomock.Any())
+
+	filepathForRead := "/some/dir/video1.mp4"
+	offset := uint64(1024)
+	mp.EXPECT().
+		RetrFrom(filepathForRead, offset).
+		Return(&bftp.Response{}, nil)
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	gomock.InOrder(
+		mcf.EXPECT().
+			NewConn(gomock.Any()).
+			Return(mc, nil),
+		mcf.EXPECT().
+			NewConn(gomock.Any()).
+			Return(mp, nil),
+	)
+
+	c := ftp.NewConfig()
+	l := logger.New(loggerEnv)
+
+	fc := ftp.New(c, l, mcf)
+
+	err := fc.ConfigureConn()
+	assert.Nil(t, err)
+
+	r, err := fc.GetReader(filepathForRead, offset)
 
 	assert.Nil(t, err)
 	assert.NotNil(t, r)
@@ -119,6 +175,43 @@ func TestClient_Shutdown(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestClient_ShutdownQuitFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	quitErr := errors.New("421 service not available")
+
+	first := mocks.NewMockConn(ctrl)
+	first.EXPECT().
+		Quit().
+		Return(quitErr)
+
+	second := mocks.NewMockConn(ctrl)
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	gomock.InOrder(
+		mcf.EXPECT().
+			NewConn(gomock.Any()).
+			Return(first, nil),
+		mcf.EXPECT().
+			NewConn(gomock.Any()).
+			Return(second, nil),
+	)
+
+	fc := ftp.New(ftp.NewConfig(), logger.New(loggerEnv), mcf)
+
+	assert.Nil(t, fc.ConfigureConn())
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+
+	err := fc.Shutdown(ctx)
+	assert.ErrorIs(t, err, quitErr)
+
+	// the failed connection is not reused by the next session
+	assert.Nil(t, fc.ConfigureConn())
+}
+
 func TestClient_GetFiles(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -126,7 +219,7 @@ func TestClient_GetFiles(t *testing.T) {
 	mc := mocks.NewMockConn(ctrl)
 
 	mediaDirs := []string{
-		"/some/dir",
+		"100MEDIA",
 	}
 
 	mediaFiles := []*bftp.Entry{
@@ -135,8 +228,8 @@ func TestClient_GetFiles(t *testing.T) {
 	}
 
 	mc.EXPECT().
-		NameList("").
-		Return(mediaDirs, nil)
+		List("").
+		Return([]*bftp.Entry{{Name: mediaDirs[0], Type: bftp.EntryTypeFolder}}, nil)
 
 	mc.EXPECT().
 		List(mediaDirs[0]).
@@ -144,7 +237,7 @@ func TestClient_GetFiles(t *testing.T) {
 
 	mcf := mocks.NewMockConnFactory(ctrl)
 	mcf.EXPECT().
-		NewConn(gomock.Any(), gomock.Any(), gomock.Any()).
+		NewConn(gomock.Any()).
 		Return(mc, nil)
 
 	c := ftp.NewConfig()
@@ -155,7 +248,7 @@ func TestClient_GetFiles(t *testing.T) {
 	err := fc.ConfigureConn()
 	assert.Nil(t, err)
 
-	cf, err := fc.GetFiles(context.Background())
+	cf, ce, err := fc.GetFiles(context.Background())
 
 	fileNumber := 0
 	for file := range cf {
@@ -165,4 +258,262 @@ func TestClient_GetFiles(t *testing.T) {
 	}
 
 	assert.Nil(t, err)
+	assert.Nil(t, <-ce)
+}
+
+func TestClient_GetFilesGroupsSidecars(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mc := mocks.NewMockConn(ctrl)
+
+	mediaDirs := []string{
+		"100MEDIA",
+	}
+
+	mediaFiles := []*bftp.Entry{
+		{Name: "YDXJ0001.SEC"},
+		{Name: "YDXJ0001.MP4"},
+		{Name: "YDXJ0001.THM"},
+		{Name: "YDXJ0002.MP4"},
+	}
+
+	mc.EXPECT().
+		List("").
+		Return([]*bftp.Entry{{Name: mediaDirs[0], Type: bftp.EntryTypeFolder}}, nil)
+
+	mc.EXPECT().
+		List(mediaDirs[0]).
+		Return(mediaFiles, nil)
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	mcf.EXPECT().
+		NewConn(gomock.Any()).
+		Return(mc, nil)
+
+	c := ftp.NewConfig()
+	l := logger.New(loggerEnv)
+
+	fc := ftp.New(c, l, mcf)
+
+	err := fc.ConfigureConn()
+	assert.Nil(t, err)
+
+	cf, ce, err := fc.GetFiles(context.Background())
+	assert.Nil(t, err)
+
+	group := <-cf
+	assert.Equal(t, "YDXJ0001.MP4", group.Name)
+	assert.Len(t, group.Sidecars, 2)
+	assert.Equal(t, "YDXJ0001.SEC", group.Sidecars[0].Name)
+	assert.Equal(t, "YDXJ0001.THM", group.Sidecars[1].Name)
+
+	group = <-cf
+	assert.Equal(t, "YDXJ0002.MP4", group.Name)
+	assert.Empty(t, group.Sidecars)
+
+	_, ok := <-cf
+	assert.False(t, ok)
+	assert.Nil(t, <-ce)
+}
+
+func TestClient_GetFilesWalk(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Setenv("FTP_WALK_EXCLUDE", "*_TMP.*")
+	t.Setenv("FTP_WALK_MIN_SIZE_BYTES", "1")
+	t.Setenv("FTP_WALK_MAX_DEPTH", "2")
+
+	mc := mocks.NewMockConn(ctrl)
+
+	mc.EXPECT().
+		List("").
+		Return([]*bftp.Entry{
+			{Name: ".", Type: bftp.EntryTypeFolder},
+			{Name: "..", Type: bftp.EntryTypeFolder},
+			{Name: "101MEDIA", Type: bftp.EntryTypeFolder},
+			{Name: "100MEDIA", Type: bftp.EntryTypeFolder},
+			{Name: "LAST", Type: bftp.EntryTypeLink, Target: "100MEDIA"},
+			{Name: "DCIM.INFO", Type: bftp.EntryTypeFile, Size: 10},
+		}, nil)
+
+	mc.EXPECT().
+		List("100MEDIA").
+		Return([]*bftp.Entry{
+			{Name: "YDXJ0001.MP4", Type: bftp.EntryTypeFile, Size: 100},
+			{Name: "YDXJ0001.thm", Type: bftp.EntryTypeFile, Size: 10},
+			{Name: "YDXJ0002.MP4", Type: bftp.EntryTypeFile, Size: 0},
+			{Name: "YDXJ0003_TMP.MP4", Type: bftp.EntryTypeFile, Size: 100},
+			{Name: "NESTED", Type: bftp.EntryTypeFolder},
+		}, nil)
+
+	mc.EXPECT().
+		List("100MEDIA/NESTED").
+		Return([]*bftp.Entry{
+			{Name: "YDXJ0004.MP4", Type: bftp.EntryTypeFile, Size: 100},
+			{Name: "DEEPER", Type: bftp.EntryTypeFolder},
+		}, nil)
+
+	mc.EXPECT().
+		List("101MEDIA").
+		Return([]*bftp.Entry{
+			{Name: "YDXJ0005.JPG", Type: bftp.EntryTypeFile, Size: 100},
+		}, nil)
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	mcf.EXPECT().
+		NewConn(gomock.Any()).
+		Return(mc, nil)
+
+	fc := ftp.New(ftp.NewConfig(), logger.New(loggerEnv), mcf)
+
+	assert.Nil(t, fc.ConfigureConn())
+
+	cf, ce, err := fc.GetFiles(context.Background())
+	assert.Nil(t, err)
+
+	paths := make([]string, 0)
+	for group := range cf {
+		for _, f := range group.Files() {
+			paths = append(paths, f.Path+"/"+f.Name)
+		}
+	}
+
+	// the symlink, the empty clip, the excluded clip, the non-media file and the too deep dir are skipped
+	assert.Equal(t, []string{
+		"100MEDIA/YDXJ0001.MP4",
+		"100MEDIA/YDXJ0001.thm",
+		"100MEDIA/NESTED/YDXJ0004.MP4",
+		"101MEDIA/YDXJ0005.JPG",
+	}, paths)
+	assert.Nil(t, <-ce)
+}
+
+func TestClient_GetFilesListFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	listErr := errors.New("550 permission denied")
+
+	mc := mocks.NewMockConn(ctrl)
+
+	mc.EXPECT().
+		List("").
+		Return(nil, listErr)
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	mcf.EXPECT().
+		NewConn(gomock.Any()).
+		Return(mc, nil)
+
+	fc := ftp.New(ftp.NewConfig(), logger.New(loggerEnv), mcf)
+
+	assert.Nil(t, fc.ConfigureConn())
+
+	cf, ce, err := fc.GetFiles(context.Background())
+
+	assert.ErrorIs(t, err, listErr)
+	assert.Nil(t, cf)
+	assert.Nil(t, ce)
+}
+
+func TestClient_GetFilesWalkFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	listErr := errors.New("426 connection closed")
+
+	mc := mocks.NewMockConn(ctrl)
+
+	mc.EXPECT().
+		List("").
+		Return([]*bftp.Entry{
+			{Name: "100MEDIA", Type: bftp.EntryTypeFolder},
+			{Name: "101MEDIA", Type: bftp.EntryTypeFolder},
+		}, nil)
+
+	mc.EXPECT().
+		List("100MEDIA").
+		Return([]*bftp.Entry{
+			{Name: "YDXJ0001.MP4", Type: bftp.EntryTypeFile, Size: 100},
+		}, nil)
+
+	mc.EXPECT().
+		List("101MEDIA").
+		Return(nil, listErr)
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	mcf.EXPECT().
+		NewConn(gomock.Any()).
+		Return(mc, nil)
+
+	fc := ftp.New(ftp.NewConfig(), logger.New(loggerEnv), mcf)
+
+	assert.Nil(t, fc.ConfigureConn())
+
+	cf, ce, err := fc.GetFiles(context.Background())
+	assert.Nil(t, err)
+
+	names := make([]string, 0)
+	for group := range cf {
+		names = append(names, group.Name)
+	}
+
+	// the groups listed before the failure are sent, the failure tells the listing is partial
+	assert.Equal(t, []string{"YDXJ0001.MP4"}, names)
+	assert.ErrorIs(t, <-ce, listErr)
+}
+
+func TestClient_GetFilesShutdownDuringWalk(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	closedErr := errors.New("use of closed network connection")
+	quit := make(chan struct{})
+
+	mc := mocks.NewMockConn(ctrl)
+
+	mc.EXPECT().
+		List("").
+		Return([]*bftp.Entry{
+			{Name: "100MEDIA", Type: bftp.EntryTypeFolder},
+		}, nil)
+
+	// the walk lists the subdir on its connection after the shutdown has dropped it
+	mc.EXPECT().
+		List("100MEDIA").
+		DoAndReturn(func(path string) ([]*bftp.Entry, error) {
+			<-quit
+			return nil, closedErr
+		})
+
+	mc.EXPECT().
+		Quit().
+		DoAndReturn(func() error {
+			close(quit)
+			return nil
+		})
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	mcf.EXPECT().
+		NewConn(gomock.Any()).
+		Return(mc, nil)
+
+	fc := ftp.New(ftp.NewConfig(), logger.New(loggerEnv), mcf)
+
+	assert.Nil(t, fc.ConfigureConn())
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	cf, ce, err := fc.GetFiles(ctx)
+	assert.Nil(t, err)
+
+	cancelFunc()
+	assert.Nil(t, fc.Shutdown(ctx))
+
+	for range cf {
+	}
+
+	assert.ErrorIs(t, <-ce, closedErr)
 }
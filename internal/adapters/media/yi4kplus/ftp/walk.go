@@ -0,0 +1,120 @@
+package ftp
+
+import (
+	"context"
+	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/jlaffaye/ftp"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+)
+
+// walk lists the dir and sends its media groups before it descends into the subdirectories.
+// The library lists by MLSD when the server announces MLST and falls back to LIST otherwise.
+// Links, "." and ".." entries and files rejected by the filters are skipped.
+// The walk lists over the connection taken when it starts, the shutdown may drop the one of the client meanwhile.
+func (c *Client) walk(ctx context.Context, conn Conn, dir string, depth int, fileChan chan<- *file.File) error {
+	const op = "FtpClient.walk"
+
+	entries, err := conn.List(dir)
+	if err != nil {
+		return c.errWrap(op, "list request "+dir, err)
+	}
+
+	return c.walkEntries(ctx, conn, dir, depth, entries, fileChan)
+}
+
+// walkEntries sends the media groups of the listed dir and walks its subdirectories
+func (c *Client) walkEntries(
+	ctx context.Context,
+	conn Conn,
+	dir string,
+	depth int,
+	entries []*ftp.Entry,
+	fileChan chan<- *file.File,
+) error {
+	const op = "FtpClient.walkEntries"
+
+	files := make([]*file.File, 0, len(entries))
+	dirs := make([]string, 0)
+
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." || entry.Name == "" {
+			continue
+		}
+
+		switch entry.Type {
+		case ftp.EntryTypeFolder:
+			dirs = append(dirs, path.Join(dir, entry.Name))
+		case ftp.EntryTypeFile:
+			if c.accept(entry.Name, entry.Size) {
+				files = append(files, file.New(
+					entry.Name,
+					dir,
+					entry.Time,
+					entry.Size,
+				))
+			}
+		}
+	}
+
+	for _, group := range file.Group(files) {
+		select {
+		case <-ctx.Done():
+			return c.errWrap(op, "send group", ctx.Err())
+		case fileChan <- group:
+		}
+	}
+
+	if depth >= c.config.walkMaxDepth {
+		if len(dirs) > 0 {
+			c.logger.With(
+				slog.String("op", op),
+			).Info(fmt.Sprintf("Max depth %d reached, skip subdirectories of %q", c.config.walkMaxDepth, dir))
+		}
+
+		return nil
+	}
+
+	sort.Strings(dirs)
+
+	for _, subdir := range dirs {
+		err := c.walk(ctx, conn, subdir, depth+1, fileChan)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// accept reports whether the file passes the globs and the size limits
+func (c *Client) accept(name string, size uint64) bool {
+	name = strings.ToUpper(name)
+
+	if len(c.config.include) > 0 && !matchAny(c.config.include, name) {
+		return false
+	}
+
+	if matchAny(c.config.exclude, name) {
+		return false
+	}
+
+	if size < c.config.minSize {
+		return false
+	}
+
+	return c.config.maxSize == 0 || size <= c.config.maxSize
+}
+
+func matchAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
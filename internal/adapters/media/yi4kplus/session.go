@@ -0,0 +1,48 @@
+package yi4kplus
+
+import (
+	"context"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba"
+	"sync"
+)
+
+// ambaSession runs the amba client once per session context, so the status of the camera
+// can be read before the session starts the transfer stack and the session start reuses the connection
+type ambaSession struct {
+	client  *amba.Client
+	mu      sync.Mutex
+	running bool
+}
+
+func newAmbaSession(client *amba.Client) *ambaSession {
+	return &ambaSession{
+		client: client,
+	}
+}
+
+// run starts the amba client unless it runs for the session already, the client stops when the context is done
+func (s *ambaSession) run(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return nil
+	}
+
+	err := s.client.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.running = true
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	return nil
+}
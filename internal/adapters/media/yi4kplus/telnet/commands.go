@@ -0,0 +1,211 @@
+package telnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	diskUsageCmdFormat = "df -k %s"
+	processesCmd       = "ps"
+	killCmdFormat      = "kill -%d %d"
+	// statCmdFormat prints size, modification time in unix seconds and the file type, e.g. "regular file"
+	statCmdFormat  = "stat -c '%%s %%Y %%F' %s"
+	statTypeDir    = "directory"
+	isDirCmdFormat = "test -d %s"
+)
+
+var ErrUnexpectedOutput = errors.New("unexpected command output")
+
+// DiskUsage is the usage of the filesystem with the path, in bytes
+type DiskUsage struct {
+	Filesystem string
+	MountedOn  string
+	TotalBytes uint64
+	UsedBytes  uint64
+	FreeBytes  uint64
+}
+
+// Process is a line of ps
+type Process struct {
+	PID     int
+	User    string
+	Command string
+}
+
+// FileInfo is the stat of the file on the camera
+type FileInfo struct {
+	Path    string
+	Size    uint64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// DiskUsage returns the usage of the filesystem with the path by df
+func (c *Client) DiskUsage(ctx context.Context, path string) (*DiskUsage, error) {
+	const op = "TelnetClient.DiskUsage"
+
+	output, err := c.run(ctx, fmt.Sprintf(diskUsageCmdFormat, quote(path)))
+	if err != nil {
+		return nil, c.errWrap(op, "df "+path, err)
+	}
+
+	// a long filesystem name moves the numbers to the next line, so the fields are taken from the end
+	lines := strings.SplitN(strings.TrimSpace(output), "\n", 2)
+	if len(lines) < 2 {
+		return nil, c.errWrap(op, "parse df output "+output, ErrUnexpectedOutput)
+	}
+
+	fields := strings.Fields(lines[1])
+	if len(fields) < 6 {
+		return nil, c.errWrap(op, "parse df output "+output, ErrUnexpectedOutput)
+	}
+
+	fields = fields[len(fields)-6:]
+
+	var kilobytes [3]uint64
+	for i := range kilobytes {
+		kilobytes[i], err = strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, c.errWrap(op, "parse df output "+output, err)
+		}
+	}
+
+	return &DiskUsage{
+		Filesystem: fields[0],
+		MountedOn:  fields[5],
+		TotalBytes: kilobytes[0] * 1024,
+		UsedBytes:  kilobytes[1] * 1024,
+		FreeBytes:  kilobytes[2] * 1024,
+	}, nil
+}
+
+// Processes returns the processes of the camera by ps, the columns are found by the header
+// because busybox builds differ in them
+func (c *Client) Processes(ctx context.Context) ([]Process, error) {
+	const op = "TelnetClient.Processes"
+
+	output, err := c.run(ctx, processesCmd)
+	if err != nil {
+		return nil, c.errWrap(op, "ps", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+
+	pidColumn, userColumn, commandColumn := -1, -1, -1
+	for i, name := range strings.Fields(lines[0]) {
+		switch strings.ToUpper(name) {
+		case "PID":
+			pidColumn = i
+		case "USER", "UID":
+			userColumn = i
+		case "COMMAND", "CMD":
+			commandColumn = i
+		}
+	}
+
+	if pidColumn < 0 || commandColumn < 0 {
+		return nil, c.errWrap(op, "parse ps header "+lines[0], ErrUnexpectedOutput)
+	}
+
+	processes := make([]Process, 0, len(lines)-1)
+
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) <= commandColumn {
+			continue
+		}
+
+		pid, err := strconv.Atoi(fields[pidColumn])
+		if err != nil {
+			return nil, c.errWrap(op, "parse ps line "+line, err)
+		}
+
+		p := Process{
+			PID:     pid,
+			Command: strings.Join(fields[commandColumn:], " "),
+		}
+
+		if userColumn >= 0 {
+			p.User = fields[userColumn]
+		}
+
+		processes = append(processes, p)
+	}
+
+	return processes, nil
+}
+
+// Kill sends the signal to the process
+func (c *Client) Kill(ctx context.Context, pid int, signal syscall.Signal) error {
+	const op = "TelnetClient.Kill"
+
+	_, err := c.run(ctx, fmt.Sprintf(killCmdFormat, signal, pid))
+	if err != nil {
+		return c.errWrap(op, fmt.Sprintf("kill %d", pid), err)
+	}
+
+	return nil
+}
+
+// Stat returns the file info of the path, a missing file is ErrCommandFailed
+func (c *Client) Stat(ctx context.Context, path string) (*FileInfo, error) {
+	const op = "TelnetClient.Stat"
+
+	output, err := c.run(ctx, fmt.Sprintf(statCmdFormat, quote(path)))
+	if err != nil {
+		return nil, c.errWrap(op, "stat "+path, err)
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(output), " ", 3)
+	if len(fields) < 3 {
+		return nil, c.errWrap(op, "parse stat output "+output, ErrUnexpectedOutput)
+	}
+
+	size, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, c.errWrap(op, "parse size "+fields[0], err)
+	}
+
+	modTime, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, c.errWrap(op, "parse modification time "+fields[1], err)
+	}
+
+	return &FileInfo{
+		Path:    path,
+		Size:    size,
+		ModTime: time.Unix(modTime, 0),
+		IsDir:   fields[2] == statTypeDir,
+	}, nil
+}
+
+// IsDir reports whether the path is a directory by test, which exits with 1 when it is not.
+// Any other status means the check itself failed, e.g. 127 when the shell has no test applet.
+func (c *Client) IsDir(ctx context.Context, path string) (bool, error) {
+	const op = "TelnetClient.IsDir"
+
+	output, status, err := c.Exec(ctx, fmt.Sprintf(isDirCmdFormat, quote(path)))
+	if err != nil {
+		return false, c.errWrap(op, "test "+path, err)
+	}
+
+	switch status {
+	case 0:
+		return true, nil
+	case 1:
+		return false, nil
+	}
+
+	return false, c.errWrap(op, fmt.Sprintf("test %s, status %d, output %q", path, status, output), ErrCommandFailed)
+}
+
+// quote makes the value a single shell word
+func quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -1,23 +1,49 @@
 package telnet
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 type Config struct {
 	host          string
 	port          string
 	user          string
+	ftpServerHost string
 	ftpServerPort string
 	ftpServerUser string
 	ftpMediaDir   string
+	// commandTimeout limits the wait of the prompt after the login or a command, md5sum of a large clip takes a while
+	commandTimeout time.Duration
+	// ftpStartTimeout limits the wait of the ftp server port after the start
+	ftpStartTimeout time.Duration
 }
 
 func NewConfig() *Config {
+	commandTimeout := time.Minute * 5
+	rawCommandTimeout := os.Getenv("TELNET_COMMAND_TIMEOUT_SECONDS")
+
+	if i, err := strconv.Atoi(rawCommandTimeout); err == nil && i > 0 {
+		commandTimeout = time.Second * time.Duration(i)
+	}
+
+	ftpStartTimeout := time.Second * 10
+	rawFtpStartTimeout := os.Getenv("TELNET_FTP_START_TIMEOUT_SECONDS")
+
+	if i, err := strconv.Atoi(rawFtpStartTimeout); err == nil && i > 0 {
+		ftpStartTimeout = time.Second * time.Duration(i)
+	}
+
 	return &Config{
-		host:          os.Getenv("TELNET_SERVER_HOST"),
-		port:          os.Getenv("TELNET_SERVER_PORT"),
-		user:          os.Getenv("TELNET_SERVER_USER"),
-		ftpServerPort: os.Getenv("FTP_SERVER_PORT"),
-		ftpServerUser: os.Getenv("FTP_SERVER_USER"),
-		ftpMediaDir:   os.Getenv("FTP_SERVER_MEDIA_DIR"),
+		host:            os.Getenv("TELNET_SERVER_HOST"),
+		port:            os.Getenv("TELNET_SERVER_PORT"),
+		user:            os.Getenv("TELNET_SERVER_USER"),
+		ftpServerHost:   os.Getenv("FTP_SERVER_HOST"),
+		ftpServerPort:   os.Getenv("FTP_SERVER_PORT"),
+		ftpServerUser:   os.Getenv("FTP_SERVER_USER"),
+		ftpMediaDir:     os.Getenv("FTP_SERVER_MEDIA_DIR"),
+		commandTimeout:  commandTimeout,
+		ftpStartTimeout: ftpStartTimeout,
 	}
 }
@@ -0,0 +1,187 @@
+package telnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// startFtpServerCmdFormat starts the server in the background and prints its pid
+	startFtpServerCmdFormat = "tcpsvd -u %s -vE 0.0.0.0 %s ftpd -w %s 1>/dev/null 2>&1 & echo $!"
+	ftpServerName           = "tcpsvd"
+	netstatCmd              = "netstat -ltn"
+	netstatListen           = "LISTEN"
+	// ftpServerPollPeriod is how often the port is dialed while the server starts
+	ftpServerPollPeriod = time.Millisecond * 200
+	// ftpServerStopTimeout limits the kill of the server at the end of the session
+	ftpServerStopTimeout = time.Second * 10
+)
+
+var ErrFtpServerNotReady = errors.New("ftp server does not accept connections")
+
+// startFtpServer starts tcpsvd with ftpd unless the port is already served and waits until the port accepts connections
+func (c *Client) startFtpServer(ctx context.Context) error {
+	const op = "TelnetClient.startFtpServer"
+
+	log := c.logger.With(
+		slog.String("op", op),
+	)
+
+	running, err := c.ftpServerRunning(ctx)
+	if err != nil {
+		return c.errWrap(op, "check ftp server", err)
+	}
+
+	if running {
+		log.Info("Ftp server is already running on port " + c.config.ftpServerPort)
+	} else {
+		output, err := c.run(ctx, c.startFtpServerCmd)
+		if err != nil {
+			return c.errWrap(op, "send start ftp request", err)
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(output))
+		if err != nil {
+			return c.errWrap(op, "parse ftp server pid "+output, err)
+		}
+
+		c.mu.Lock()
+		c.ftpServerPID = pid
+		c.mu.Unlock()
+
+		log.Info(fmt.Sprintf("Ftp server started, pid %d", pid))
+	}
+
+	err = c.waitFtpServer(ctx)
+	if err != nil {
+		return c.errWrap(op, "wait ftp server", err)
+	}
+
+	return nil
+}
+
+// ftpServerRunning reports whether the ftp port is listened on the camera, ps is used when netstat is missing
+func (c *Client) ftpServerRunning(ctx context.Context) (bool, error) {
+	const op = "TelnetClient.ftpServerRunning"
+
+	output, status, err := c.Exec(ctx, netstatCmd)
+	if err != nil {
+		return false, c.errWrap(op, "netstat", err)
+	}
+
+	if status == 0 {
+		return listensOn(output, c.config.ftpServerPort), nil
+	}
+
+	processes, err := c.Processes(ctx)
+	if err != nil {
+		return false, c.errWrap(op, "processes", err)
+	}
+
+	for _, p := range processes {
+		if isFtpServer(p.Command, c.config.ftpServerPort) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// waitFtpServer dials the ftp port until it accepts a connection
+func (c *Client) waitFtpServer(ctx context.Context) error {
+	const op = "TelnetClient.waitFtpServer"
+
+	deadline := time.Now().Add(c.config.ftpStartTimeout)
+
+	for {
+		conn, err := c.connFactory.NewConn(c.config.ftpServerHost, c.config.ftpServerPort)
+		if err == nil {
+			_ = conn.Close()
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return c.errWrap(op, "dial "+c.config.ftpServerPort, errors.Join(ErrFtpServerNotReady, err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return c.errWrap(op, "wait", ctx.Err())
+		case <-time.After(ftpServerPollPeriod):
+		}
+	}
+}
+
+// stopFtpServer kills the tcpsvd started by the client, the connection is restored if the session dropped it.
+// The caller holds mu.
+func (c *Client) stopFtpServer() error {
+	const op = "TelnetClient.stopFtpServer"
+
+	if c.ftpServerPID == 0 {
+		return nil
+	}
+
+	pid := c.ftpServerPID
+	c.ftpServerPID = 0
+
+	err := c.configureConn()
+	if err != nil {
+		return c.errWrap(op, "configure connection", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ftpServerStopTimeout)
+	defer cancel()
+
+	output, status, err := c.exec(ctx, fmt.Sprintf(killCmdFormat, syscall.SIGTERM, pid))
+	if err != nil {
+		return c.errWrap(op, fmt.Sprintf("kill %d", pid), err)
+	}
+
+	if status != 0 {
+		return c.errWrap(op, fmt.Sprintf("kill %d, status %d, output %q", pid, status, output), ErrCommandFailed)
+	}
+
+	c.logger.With(
+		slog.String("op", op),
+	).Info(fmt.Sprintf("Ftp server stopped, pid %d", pid))
+
+	return nil
+}
+
+// listensOn reports whether netstat output has a listening socket on the port
+func listensOn(netstat, port string) bool {
+	for _, line := range strings.Split(netstat, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[5] != netstatListen {
+			continue
+		}
+
+		if strings.HasSuffix(fields[3], ":"+port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isFtpServer reports whether the ps command is tcpsvd serving the port
+func isFtpServer(command, port string) bool {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || !strings.HasSuffix(fields[0], ftpServerName) {
+		return false
+	}
+
+	for _, field := range fields[1:] {
+		if field == port {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,138 @@
+package telnet
+
+import (
+	"strings"
+)
+
+// Telnet commands and options
+// [RFC 854]: https://www.rfc-editor.org/rfc/rfc854
+// [RFC 1143]: https://www.rfc-editor.org/rfc/rfc1143
+const (
+	iac  = 255
+	dont = 254
+	do   = 253
+	wont = 252
+	will = 251
+	sb   = 250
+	se   = 240
+
+	optEcho            = 1
+	optSuppressGoAhead = 3
+)
+
+// promptSuffix ends the prompt of the camera shell, e.g. "# " or "/tmp # "
+const promptSuffix = "# "
+
+// loginSuffix ends the login prompt of telnetd
+const loginSuffix = "login: "
+
+// promptEnd is the last byte of every prompt, the end of the response is checked only after it
+const promptEnd = ' '
+
+// readByte returns the next data byte of the connection, option requests of the server are answered on the way.
+// The server may echo and suppress go ahead, the client refuses every option of its own.
+func (c *Client) readByte() (byte, error) {
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil || b != iac {
+			return b, err
+		}
+
+		cmd, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch cmd {
+		case iac:
+			return iac, nil
+		case do, dont, will, wont:
+			opt, err := c.reader.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+
+			err = c.negotiate(cmd, opt)
+			if err != nil {
+				return 0, err
+			}
+		case sb:
+			err = c.skipSubnegotiation()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// negotiate answers the option request, every answer is sent once to not loop with the server
+func (c *Client) negotiate(cmd, opt byte) error {
+	var answer byte
+
+	switch cmd {
+	case will:
+		answer = dont
+		if opt == optEcho || opt == optSuppressGoAhead {
+			answer = do
+		}
+	case wont:
+		answer = dont
+	case do, dont:
+		answer = wont
+	}
+
+	key := [2]byte{answer, opt}
+	if c.answered[key] {
+		return nil
+	}
+	c.answered[key] = true
+
+	_, err := c.conn.Write([]byte{iac, answer, opt})
+
+	return err
+}
+
+// skipSubnegotiation drops the bytes up to IAC SE, no option with parameters is enabled
+func (c *Client) skipSubnegotiation() error {
+	prev := byte(0)
+
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if prev == iac && b == se {
+			return nil
+		}
+
+		if prev == iac && b == iac {
+			b = 0
+		}
+
+		prev = b
+	}
+}
+
+// readUntil reads the data of the connection until done reports the end, done is called only after promptEnd,
+// so long output is not checked on every byte. Carriage returns and NUL padding of the telnet line ending are dropped
+func (c *Client) readUntil(done func(data string) bool) (string, error) {
+	var data strings.Builder
+
+	for {
+		b, err := c.readByte()
+		if err != nil {
+			return data.String(), err
+		}
+
+		if b == '\r' || b == 0 {
+			continue
+		}
+
+		data.WriteByte(b)
+
+		if b == promptEnd && done(data.String()) {
+			return data.String(), nil
+		}
+	}
+}
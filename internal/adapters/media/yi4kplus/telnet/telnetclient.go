@@ -2,20 +2,42 @@ package telnet
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"io"
 	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	startFtpServerCmdFormat = "tcpsvd -u %s -vE 0.0.0.0 %s ftpd -w %s 1>/dev/null 2>&1"
+	md5sumCmdFormat   = "md5sum %s"
+	clockCmd          = "date '+%Y-%m-%d %H:%M:%S'"
+	clockLayout       = "2006-01-02 15:04:05"
+	setClockCmdFormat = "date -s %s >/dev/null"
+	// powerOffCmd falls back to the reboot applet when busybox is built without poweroff
+	powerOffCmd = "poweroff || reboot -p"
+	// statusMarkerFormat prefixes the exit status printed after the command, the sequence number keeps
+	// the output of a previous command from being taken for the current one
+	statusMarkerFormat = "__status_%d__="
+)
+
+var (
+	ErrMd5sumFailed  = errors.New("md5sum command failed on the camera")
+	ErrClockFailed   = errors.New("date command failed on the camera")
+	ErrCommandFailed = errors.New("command exited with non-zero status")
+	ErrNotConnected  = errors.New("telnet session is not started")
+
+	md5sumRegexp = regexp.MustCompile(`(?m)^([0-9a-f]{32})\s`)
 )
 
 type Conn interface {
-	Read(b []byte) (n int, err error)
-	Write(b []byte) (n int, err error)
-	Close() error
+	net.Conn
 }
 
 type ConnFactory interface {
@@ -23,7 +45,7 @@ type ConnFactory interface {
 }
 
 type Reader interface {
-	ReadString(delim byte) (string, error)
+	io.ByteReader
 }
 
 type ReaderFactory interface {
@@ -36,8 +58,16 @@ type Client struct {
 	logger            *logger.Logger
 	connFactory       ConnFactory
 	readerFactory     ReaderFactory
-	conn              Conn
-	reader            Reader
+	// mu keeps one command at a time in the shell, conn and reader are changed under it
+	mu     sync.Mutex
+	conn   Conn
+	reader Reader
+	// answered are the option answers sent on the connection
+	answered map[[2]byte]bool
+	// seq numbers the commands for the status marker
+	seq int
+	// ftpServerPID is the tcpsvd started by the client, zero if the server was already running
+	ftpServerPID int
 }
 
 func New(
@@ -48,9 +78,9 @@ func New(
 ) *Client {
 	startFtpServerCmd := fmt.Sprintf(
 		startFtpServerCmdFormat,
-		config.ftpServerUser,
-		config.ftpServerPort,
-		config.ftpMediaDir,
+		quote(config.ftpServerUser),
+		quote(config.ftpServerPort),
+		quote(config.ftpMediaDir),
 	)
 
 	return &Client{
@@ -62,6 +92,7 @@ func New(
 	}
 }
 
+// configureConn connects and logs in if telnetd asks for it, it returns at the shell prompt
 func (c *Client) configureConn() error {
 	if c.conn != nil {
 		return nil
@@ -77,11 +108,15 @@ func (c *Client) configureConn() error {
 
 	c.conn = conn
 	c.reader = c.readerFactory.NewReader(conn)
+	c.answered = map[[2]byte]bool{}
 
-	_, err = c.fetchResponse()
-	time.Sleep(1 * time.Second)
+	err = c.login()
+	if err != nil {
+		c.closeConn()
+		return c.errWrap(op, "login", err)
+	}
 
-	return err
+	return nil
 }
 
 // Run is simple configuration and start telnet session and send command of start ftp server
@@ -100,20 +135,15 @@ func (c *Client) Run(ctx context.Context) error {
 		}
 	}()
 
-	err := c.configureConn()
-	if err != nil {
-		return c.errWrap(op, "configure connection", err)
-	}
-
-	log.Info("Run connection")
-
-	err = c.startSession()
+	err := c.startSession()
 
 	if err != nil {
 		return c.errWrap(op, "telnet session start", err)
 	}
 
-	err = c.startFtpServer()
+	log.Info("Run connection")
+
+	err = c.startFtpServer(ctx)
 
 	if err != nil {
 		return c.errWrap(op, "start ftp server by telnet", err)
@@ -124,34 +154,116 @@ func (c *Client) Run(ctx context.Context) error {
 	return nil
 }
 
+// login waits for the login or the shell prompt, the user is sent only when telnetd asks for it
 func (c *Client) login() error {
 	const op = "TelnetClient.login"
 
-	_, err := c.sendRequest(c.config.user)
+	c.setDeadline(context.Background())
+	defer c.clearDeadline()
+
+	data, err := c.readUntil(func(data string) bool {
+		return strings.HasSuffix(data, loginSuffix) || strings.HasSuffix(data, promptSuffix)
+	})
+	if err != nil {
+		return c.errWrap(op, "read prompt", err)
+	}
+
+	if strings.HasSuffix(data, promptSuffix) {
+		return nil
+	}
 
+	_, err = io.WriteString(c.conn, c.config.user+"\n")
 	if err != nil {
 		return c.errWrap(op, "send login request", err)
 	}
 
+	_, err = c.readUntil(func(data string) bool {
+		return strings.HasSuffix(data, promptSuffix)
+	})
+	if err != nil {
+		return c.errWrap(op, "read shell prompt", err)
+	}
+
+	return nil
+}
+
+// Md5sum calculates md5 of the file on the camera, path is relative to the ftp media dir
+func (c *Client) Md5sum(ctx context.Context, path string) (string, error) {
+	const op = "TelnetClient.Md5sum"
+
+	output, err := c.run(ctx, fmt.Sprintf(md5sumCmdFormat, quote(c.config.ftpMediaDir+"/"+path)))
+	if err != nil {
+		return "", c.errWrap(op, "md5sum "+path, errors.Join(ErrMd5sumFailed, err))
+	}
+
+	matches := md5sumRegexp.FindStringSubmatch(output)
+	if matches == nil {
+		return "", c.errWrap(op, "md5sum "+path, ErrMd5sumFailed)
+	}
+
+	return matches[1], nil
+}
+
+// Clock returns the time of the camera, it is read as local time like the amba camera_clock setting
+func (c *Client) Clock(ctx context.Context) (time.Time, error) {
+	const op = "TelnetClient.Clock"
+
+	output, err := c.run(ctx, clockCmd)
+	if err != nil {
+		return time.Time{}, c.errWrap(op, "date", errors.Join(ErrClockFailed, err))
+	}
+
+	t, err := time.ParseInLocation(clockLayout, strings.TrimSpace(output), time.Local)
+	if err != nil {
+		return time.Time{}, c.errWrap(op, "parse clock "+output, err)
+	}
+
+	return t, nil
+}
+
+// SetClock sets the time of the camera in local time
+func (c *Client) SetClock(ctx context.Context, t time.Time) error {
+	const op = "TelnetClient.SetClock"
+
+	value := t.In(time.Local).Format(clockLayout)
+
+	_, err := c.run(ctx, fmt.Sprintf(setClockCmdFormat, quote(value)))
+	if err != nil {
+		return c.errWrap(op, "date -s "+value, errors.Join(ErrClockFailed, err))
+	}
+
 	return nil
 }
 
-func (c *Client) startFtpServer() error {
-	const op = "TelnetClient.startFtpServer"
+// PowerOff switches the camera off, the response is not awaited because the camera drops the connection
+func (c *Client) PowerOff() error {
+	const op = "TelnetClient.PowerOff"
 
-	_, err := c.sendRequest(c.startFtpServerCmd)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
+	if c.conn == nil {
+		return c.errWrap(op, "check connection", net.ErrClosed)
+	}
+
+	_, err := io.WriteString(c.conn, powerOffCmd+"\n")
 	if err != nil {
-		return c.errWrap(op, "send start ftp request", err)
+		return c.errWrap(op, "write to connection", err)
 	}
 
-	time.Sleep(1 * time.Second)
+	// the ftp server goes down with the camera
+	c.ftpServerPID = 0
+	c.closeConn()
+
 	return nil
 }
 
 func (c *Client) startSession() error {
 	const op = "TelnetClient.startSession"
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	err := c.configureConn()
 	if err != nil {
 		return c.errWrap(op, "configure connection", err)
@@ -162,39 +274,162 @@ func (c *Client) startSession() error {
 		slog.Any("config", c.config),
 	)
 
-	err = c.login()
+	log.Info("Success telnet session start")
+
+	return nil
+}
+
+// Exec executes the command in the shell of the camera and returns its output with the exit status.
+// The exit status is printed behind a marker after the command and the shell prompt ends the response.
+// A cancelled ctx interrupts the wait and drops the connection, the command may still run on the camera.
+func (c *Client) Exec(ctx context.Context, command string) (string, int, error) {
+	const op = "TelnetClient.Exec"
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	output, status, err := c.exec(ctx, command)
 	if err != nil {
-		return c.errWrap(op, "login", err)
+		return output, status, c.errWrap(op, "exec "+command, err)
 	}
 
-	log.Info("Success telnet session start")
+	return output, status, nil
+}
 
-	return nil
+// run executes the command like Exec, a non-zero exit status is ErrCommandFailed
+func (c *Client) run(ctx context.Context, command string) (string, error) {
+	const op = "TelnetClient.run"
+
+	output, status, err := c.Exec(ctx, command)
+	if err != nil {
+		return output, c.errWrap(op, "exec", err)
+	}
+
+	if status != 0 {
+		return output, c.errWrap(op, fmt.Sprintf("exec %q, status %d, output %q", command, status, output), ErrCommandFailed)
+	}
+
+	return output, nil
 }
 
-func (c *Client) sendRequest(command string) (res string, err error) {
-	const op = "TelnetClient.sendRequest"
+// exec sends the command with the status marker and reads up to the prompt after it, the caller holds mu
+func (c *Client) exec(ctx context.Context, command string) (string, int, error) {
+	const op = "TelnetClient.exec"
+
+	if c.conn == nil {
+		return "", 0, c.errWrap(op, "check connection", ErrNotConnected)
+	}
 
-	_, err = fmt.Fprintf(c.conn, command+"\n")
+	c.seq++
+	marker := fmt.Sprintf(statusMarkerFormat, c.seq)
+	echo := fmt.Sprintf(`echo "%s$?"`, marker)
+
+	// a background command is already terminated by &
+	separator := "; "
+	if strings.HasSuffix(strings.TrimSpace(command), "&") {
+		separator = " "
+	}
 
+	statusRegexp := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(marker) + `(\d+)\n`)
+
+	c.setDeadline(ctx)
+	defer c.clearDeadline()
+
+	stopWatch := c.interruptOnDone(ctx)
+	defer stopWatch()
+
+	_, err := io.WriteString(c.conn, command+separator+echo+"\n")
 	if err != nil {
-		return res, c.errWrap(op, "fprintf to connection", err)
+		c.closeConn()
+		return "", 0, c.errWrap(op, "write to connection", err)
 	}
 
-	return c.fetchResponse()
-}
+	// the status is searched from the last line which was not complete at the previous prompt,
+	// so the output is scanned once however many prompts it contains
+	scanned := 0
+	data, err := c.readUntil(func(data string) bool {
+		if !strings.HasSuffix(data, promptSuffix) {
+			return false
+		}
 
-func (c *Client) fetchResponse() (res string, err error) {
-	const op = "TelnetClient.fetchResponse"
+		found := statusRegexp.MatchString(data[scanned:])
+		scanned = strings.LastIndexByte(data, '\n') + 1
 
-	res, err = c.reader.ReadString('\n')
+		return found
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 
+		// the shell is in an unknown state after a broken read
+		c.closeConn()
+		return data, 0, c.errWrap(op, "read response", err)
+	}
+
+	loc := statusRegexp.FindStringSubmatchIndex(data)
+	status, err := strconv.Atoi(data[loc[2]:loc[3]])
 	if err != nil {
-		err = c.errWrap(op, "read string", err)
+		return "", 0, c.errWrap(op, "parse status", err)
+	}
+
+	output := data[:loc[0]]
+
+	// the terminal echoes the command line first
+	if i := strings.Index(output, echo); i >= 0 {
+		output = output[i+len(echo):]
+		output = strings.TrimPrefix(output, "\n")
 	}
 
-	return res, err
+	return output, status, nil
+}
+
+// setDeadline limits the read by the command timeout or the deadline of ctx if it is earlier
+func (c *Client) setDeadline(ctx context.Context) {
+	deadline := time.Now().Add(c.config.commandTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	_ = c.conn.SetReadDeadline(deadline)
+}
+
+// interruptOnDone breaks the read when ctx is done, the returned func stops the watch and waits for it
+func (c *Client) interruptOnDone(ctx context.Context) func() {
+	conn := c.conn
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func (c *Client) clearDeadline() {
+	if c.conn != nil {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *Client) closeConn() {
+	if c.conn == nil {
+		return
+	}
+
+	_ = c.conn.Close()
+	c.conn = nil
+	c.reader = nil
 }
 
 func (c *Client) Shutdown(ctx context.Context) error {
@@ -207,17 +442,25 @@ func (c *Client) Shutdown(ctx context.Context) error {
 
 	<-ctx.Done()
 
+	// a command of the ended session is interrupted by its context, so the lock is free soon
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stopErr := c.stopFtpServer()
+
 	if c.conn == nil {
+		if stopErr != nil {
+			return c.errWrap(op, "stop ftp server", stopErr)
+		}
+
 		return nil
 	}
 
-	err := (c.conn).Close()
-	if err != nil {
-		return c.errWrap(op, "connection close", err)
-	}
+	c.closeConn()
 
-	c.conn = nil
-	c.reader = nil
+	if stopErr != nil {
+		return c.errWrap(op, "stop ftp server", stopErr)
+	}
 
 	log.Info("Success closing telnet connection")
 
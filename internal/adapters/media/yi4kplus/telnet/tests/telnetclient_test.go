@@ -1,57 +1,489 @@
 package tests
 
 import (
+	"bufio"
 	"context"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/telnet"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/telnet/mocks"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/mock/gomock"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
 
 const loggerEnv = logger.EnvTest
 
+// negotiation is what busybox telnetd sends first: will echo, will suppress go ahead, do naws
+// and a terminal type subnegotiation
+var negotiation = []byte{255, 251, 1, 255, 251, 3, 255, 253, 31, 255, 250, 24, 1, 255, 240}
+
+// answers are the expected replies of the client: do echo, do suppress go ahead, wont naws
+var answers = []byte{255, 253, 1, 255, 253, 3, 255, 252, 31}
+
+var commandRegexp = regexp.MustCompile(`^(.*?)(?:; | )echo "(__status_\d+__=)\$\?"$`)
+
+// result is the reply of the shell to a command, hang keeps the shell silent
+type result struct {
+	output string
+	status int
+	hang   bool
+}
+
+// shell is the camera side of the telnet connection, it answers commands with the results by command line
+type shell struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	login    bool
+	results  map[string]result
+	mu       sync.Mutex
+	commands []string
+	answers  []byte
+}
+
+func newShell(t *testing.T, login bool, results map[string]result) (*shell, net.Conn) {
+	server, client := net.Pipe()
+
+	// the ftp server is not running and starts with pid 412 unless the test says otherwise
+	defaults := map[string]result{
+		netstatCmd:        {output: netstatHeader},
+		startFtpServerCmd: {output: "412\n"},
+	}
+	for command, res := range defaults {
+		if _, ok := results[command]; !ok {
+			results[command] = res
+		}
+	}
+
+	sh := &shell{
+		conn:    server,
+		reader:  bufio.NewReader(server),
+		login:   login,
+		results: results,
+	}
+
+	go sh.serve()
+
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	return sh, client
+}
+
+func (sh *shell) serve() {
+	prompt := "/ # "
+	if sh.login {
+		prompt = "\r\nyi4kplus login: "
+	}
+
+	if _, err := sh.conn.Write(append(append([]byte{}, negotiation...), prompt...)); err != nil {
+		return
+	}
+
+	answers := make([]byte, len(answers))
+	if _, err := io.ReadFull(sh.reader, answers); err != nil {
+		return
+	}
+
+	sh.mu.Lock()
+	sh.answers = answers
+	sh.mu.Unlock()
+
+	if sh.login {
+		user, err := sh.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		sh.write(strings.TrimSuffix(user, "\n") + "\r\n\r\nBusyBox v1.20.2 built-in shell (ash)\r\n\r\n/ # ")
+	}
+
+	for {
+		line, err := sh.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		sh.write(line + "\r\n")
+
+		matches := commandRegexp.FindStringSubmatch(line)
+		if matches == nil {
+			sh.record(line)
+			continue
+		}
+
+		sh.record(matches[1])
+
+		res, ok := sh.results[matches[1]]
+		if !ok {
+			res = result{output: "sh: not found\n", status: 127}
+		}
+
+		if res.hang {
+			continue
+		}
+
+		sh.write(strings.ReplaceAll(res.output, "\n", "\r\n") + matches[2] + strconv.Itoa(res.status) + "\r\n/ # ")
+	}
+}
+
+func (sh *shell) write(data string) {
+	_, _ = sh.conn.Write([]byte(data))
+}
+
+func (sh *shell) record(command string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.commands = append(sh.commands, command)
+}
+
+func (sh *shell) received() ([]string, []byte) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return append([]string{}, sh.commands...), append([]byte{}, sh.answers...)
+}
+
+func newClient(t *testing.T, ctrl *gomock.Controller, conn net.Conn) *telnet.Client {
+	t.Setenv("TELNET_SERVER_PORT", "23")
+	t.Setenv("TELNET_SERVER_USER", "root")
+	t.Setenv("FTP_SERVER_PORT", "21")
+	t.Setenv("FTP_SERVER_USER", "root")
+	t.Setenv("FTP_SERVER_MEDIA_DIR", "/tmp/fuse_d/DCIM")
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	mcf.EXPECT().
+		NewConn(gomock.Any(), "23").
+		Return(conn, nil)
+
+	// the ftp port accepts connections
+	mcf.EXPECT().
+		NewConn(gomock.Any(), "21").
+		DoAndReturn(func(host, port string) (telnet.Conn, error) {
+			server, client := net.Pipe()
+			_ = server.Close()
+			return client, nil
+		}).
+		AnyTimes()
+
+	return telnet.New(telnet.NewConfig(), logger.New(loggerEnv), mcf, &telnet.BufioReaderFactory{})
+}
+
+const (
+	startFtpServerCmd = "tcpsvd -u 'root' -vE 0.0.0.0 '21' ftpd -w '/tmp/fuse_d/DCIM' 1>/dev/null 2>&1 & echo $!"
+	netstatCmd        = "netstat -ltn"
+	netstatHeader     = "Active Internet connections (only servers)\n" +
+		"Proto Recv-Q Send-Q Local Address           Foreign Address         State\n"
+)
+
 func TestClient_Run(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	mc := mocks.NewMockConn(ctrl)
+	sh, conn := newShell(t, true, map[string]result{})
 
-	mc.EXPECT().
-		Write(gomock.Any()).
-		AnyTimes()
+	tc := newClient(t, ctrl, conn)
 
-	mc.EXPECT().
-		Read(gomock.Any()).
-		AnyTimes()
+	err := tc.Run(context.Background())
+	assert.Nil(t, err)
 
-	mcf := mocks.NewMockConnFactory(ctrl)
-	mcf.EXPECT().
-		NewConn(gomock.Any(), gomock.Any()).
-		Return(mc, nil)
+	commands, received := sh.received()
+	assert.Equal(t, answers, received)
+	assert.Equal(t, []string{netstatCmd, startFtpServerCmd}, commands)
+}
 
-	mr := mocks.NewMockReader(ctrl)
+func TestClient_RunWithoutLogin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
 
-	mr.EXPECT().
-		ReadString(gomock.Any()).
-		AnyTimes()
+	sh, conn := newShell(t, false, map[string]result{})
 
-	mrf := mocks.NewMockReaderFactory(ctrl)
+	tc := newClient(t, ctrl, conn)
 
-	mrf.EXPECT().
-		NewReader(mc).
-		Return(mr)
+	err := tc.Run(context.Background())
+	assert.Nil(t, err)
 
-	c := telnet.NewConfig()
-	l := logger.New(loggerEnv)
+	commands, _ := sh.received()
+	assert.Equal(t, []string{netstatCmd, startFtpServerCmd}, commands)
+}
 
-	tc := telnet.New(c, l, mcf, mrf)
+func TestClient_RunFtpServerAlreadyRunning(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sh, conn := newShell(t, true, map[string]result{
+		netstatCmd: {output: netstatHeader +
+			"tcp        0      0 0.0.0.0:21              0.0.0.0:*               LISTEN\n"},
+	})
+
+	tc := newClient(t, ctrl, conn)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	err := tc.Run(ctx)
+	assert.Nil(t, err)
+
+	// the server of somebody else is left running
+	cancelFunc()
+	time.Sleep(100 * time.Millisecond)
+
+	commands, _ := sh.received()
+	assert.Equal(t, []string{netstatCmd}, commands)
+}
+
+func TestClient_RunWithoutNetstat(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sh, conn := newShell(t, true, map[string]result{
+		netstatCmd: {output: "sh: netstat: not found\n", status: 127},
+		"ps": {output: "  PID USER       VSZ STAT COMMAND\n" +
+			"  301 root      1376 S    tcpsvd -u root -vE 0.0.0.0 21 ftpd -w /tmp/fuse_d/DCIM\n"},
+	})
+
+	tc := newClient(t, ctrl, conn)
+
+	err := tc.Run(context.Background())
+	assert.Nil(t, err)
+
+	commands, _ := sh.received()
+	assert.Equal(t, []string{netstatCmd, "ps"}, commands)
+}
+
+func TestClient_ShutdownStopsFtpServer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sh, conn := newShell(t, true, map[string]result{
+		"kill -15 412": {},
+	})
+
+	tc := newClient(t, ctrl, conn)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	err := tc.Run(ctx)
+	assert.Nil(t, err)
+
+	cancelFunc()
+
+	assert.Eventually(t, func() bool {
+		commands, _ := sh.received()
+		return commands[len(commands)-1] == "kill -15 412"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestClient_Md5sum(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	checksum := "d41d8cd98f00b204e9800998ecf8427e"
+
+	_, conn := newShell(t, true, map[string]result{
+		"md5sum '/tmp/fuse_d/DCIM/100MEDIA/video1.mp4'": {
+			output: checksum + "  /tmp/fuse_d/DCIM/100MEDIA/video1.mp4\n",
+		},
+		"md5sum '/tmp/fuse_d/DCIM/100MEDIA/video2.mp4'": {
+			output: "md5sum: can't open '/tmp/fuse_d/DCIM/100MEDIA/video2.mp4': No such file or directory\n",
+			status: 1,
+		},
+	})
+
+	tc := newClient(t, ctrl, conn)
+
+	err := tc.Run(context.Background())
+	assert.Nil(t, err)
+
+	res, err := tc.Md5sum(context.Background(), "100MEDIA/video1.mp4")
+	assert.Nil(t, err)
+	assert.Equal(t, checksum, res)
+
+	_, err = tc.Md5sum(context.Background(), "100MEDIA/video2.mp4")
+	assert.ErrorIs(t, err, telnet.ErrMd5sumFailed)
+	assert.ErrorIs(t, err, telnet.ErrCommandFailed)
+}
+
+func TestClient_SetClock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sh, conn := newShell(t, true, map[string]result{
+		"date '+%Y-%m-%d %H:%M:%S'":                {output: "2015-01-01 00:00:12\n"},
+		"date -s '2023-06-03 10:01:02' >/dev/null": {},
+	})
+
+	tc := newClient(t, ctrl, conn)
+
+	err := tc.Run(context.Background())
+	assert.Nil(t, err)
+
+	clock, err := tc.Clock(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2015, 1, 1, 0, 0, 12, 0, time.Local), clock)
+
+	err = tc.SetClock(context.Background(), time.Date(2023, 6, 3, 10, 1, 2, 0, time.Local))
+	assert.Nil(t, err)
+
+	commands, _ := sh.received()
+	assert.Equal(t, "date -s '2023-06-03 10:01:02' >/dev/null", commands[len(commands)-1])
+}
+
+func TestClient_CommandTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	_, conn := newShell(t, true, map[string]result{
+		"md5sum '/tmp/fuse_d/DCIM/100MEDIA/video1.mp4'": {hang: true},
+	})
+
+	t.Setenv("TELNET_COMMAND_TIMEOUT_SECONDS", "1")
+	tc := newClient(t, ctrl, conn)
 
 	err := tc.Run(context.Background())
+	assert.Nil(t, err)
+
+	_, err = tc.Md5sum(context.Background(), "100MEDIA/video1.mp4")
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
 
+func TestClient_Commands(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sh, conn := newShell(t, true, map[string]result{
+		"df -k '/tmp/fuse_d/DCIM'": {
+			output: "Filesystem           1K-blocks      Used Available Use% Mounted on\n" +
+				"/dev/mmcblk0p1\n" +
+				"                      62504960  20834992  41669968  33% /tmp/fuse_d\n",
+		},
+		"ps": {
+			output: "  PID USER       VSZ STAT COMMAND\n" +
+				"    1 root      1372 S    init\n" +
+				"  412 root      1376 S    tcpsvd -u root -vE 0.0.0.0 21 ftpd -w /tmp/fuse_d/DCIM\n",
+		},
+		"kill -15 412": {},
+		"stat -c '%s %Y %F' '/tmp/fuse_d/DCIM/100MEDIA/YDXJ0001.MP4'": {output: "1048576 1685786462 regular file\n"},
+		"stat -c '%s %Y %F' '/tmp/fuse_d/DCIM/100MEDIA/YDXJ0002.MP4'": {
+			output: "stat: can't stat '/tmp/fuse_d/DCIM/100MEDIA/YDXJ0002.MP4': No such file or directory\n",
+			status: 1,
+		},
+		"test -d '/tmp/fuse_d/DCIM'":          {},
+		"test -d '/tmp/fuse_d/DCIM/100MEDIA'": {status: 1},
+	})
+
+	tc := newClient(t, ctrl, conn)
+	ctx := context.Background()
+
+	assert.Nil(t, tc.Run(ctx))
+
+	usage, err := tc.DiskUsage(ctx, "/tmp/fuse_d/DCIM")
+	assert.Nil(t, err)
+	assert.Equal(t, &telnet.DiskUsage{
+		Filesystem: "/dev/mmcblk0p1",
+		MountedOn:  "/tmp/fuse_d",
+		TotalBytes: 62504960 * 1024,
+		UsedBytes:  20834992 * 1024,
+		FreeBytes:  41669968 * 1024,
+	}, usage)
+
+	processes, err := tc.Processes(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []telnet.Process{
+		{PID: 1, User: "root", Command: "init"},
+		{PID: 412, User: "root", Command: "tcpsvd -u root -vE 0.0.0.0 21 ftpd -w /tmp/fuse_d/DCIM"},
+	}, processes)
+
+	assert.Nil(t, tc.Kill(ctx, 412, syscall.SIGTERM))
+
+	info, err := tc.Stat(ctx, "/tmp/fuse_d/DCIM/100MEDIA/YDXJ0001.MP4")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1048576), info.Size)
+	assert.Equal(t, time.Unix(1685786462, 0), info.ModTime)
+	assert.False(t, info.IsDir)
+
+	_, err = tc.Stat(ctx, "/tmp/fuse_d/DCIM/100MEDIA/YDXJ0002.MP4")
+	assert.ErrorIs(t, err, telnet.ErrCommandFailed)
+
+	isDir, err := tc.IsDir(ctx, "/tmp/fuse_d/DCIM")
+	assert.Nil(t, err)
+	assert.True(t, isDir)
+
+	isDir, err = tc.IsDir(ctx, "/tmp/fuse_d/DCIM/100MEDIA")
+	assert.Nil(t, err)
+	assert.False(t, isDir)
+
+	// the shell has no such command, so the dir is not known to be missing
+	_, err = tc.IsDir(ctx, "/tmp/fuse_d/MISC")
+	assert.ErrorIs(t, err, telnet.ErrCommandFailed)
+
+	output, status, err := tc.Exec(ctx, "ls /tmp/fuse_d")
+	assert.Nil(t, err)
+	assert.Equal(t, 127, status)
+	assert.Equal(t, "sh: not found\n", output)
+
+	commands, _ := sh.received()
+	assert.Contains(t, commands, "kill -15 412")
+}
+
+func TestClient_ExecLongOutput(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the output contains the prompt suffix on every line
+	lines := &strings.Builder{}
+	for i := 0; i < 10000; i++ {
+		lines.WriteString(strconv.Itoa(i) + " # comment\n")
+	}
+
+	_, conn := newShell(t, true, map[string]result{
+		"cat /tmp/fuse_d/script.sh": {output: lines.String()},
+	})
+
+	tc := newClient(t, ctrl, conn)
+
+	assert.Nil(t, tc.Run(context.Background()))
+
+	output, status, err := tc.Exec(context.Background(), "cat /tmp/fuse_d/script.sh")
 	assert.Nil(t, err)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, lines.String(), output)
+}
+
+func TestClient_ExecCancel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	_, conn := newShell(t, true, map[string]result{
+		"sleep 60": {hang: true},
+	})
+
+	tc := newClient(t, ctrl, conn)
+
+	assert.Nil(t, tc.Run(context.Background()))
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancelFunc()
+	}()
+
+	_, _, err := tc.Exec(ctx, "sleep 60")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the connection is dropped with the command
+	_, _, err = tc.Exec(context.Background(), "ls")
+	assert.ErrorIs(t, err, telnet.ErrNotConnected)
 }
 
 func TestClient_Shutdown(t *testing.T) {
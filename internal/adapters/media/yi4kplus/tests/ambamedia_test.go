@@ -0,0 +1,324 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba/mocks"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+const loggerEnv = logger.EnvTest
+
+const mediaDir = "/tmp/fuse_d/DCIM"
+
+// camera answers amba requests written to the control connection with the replies of their msg_id
+type camera struct {
+	mu       sync.Mutex
+	replies  map[int][]string
+	requests []amba.Request
+	stream   *io.PipeWriter
+}
+
+func newCamera(ctrl *gomock.Controller, mrf *mocks.MockReaderFactory, replies map[int][]string) (*camera, *mocks.MockConn) {
+	pr, pw := io.Pipe()
+
+	cam := &camera{
+		replies: replies,
+		stream:  pw,
+	}
+
+	mc := mocks.NewMockConn(ctrl)
+
+	mc.EXPECT().
+		Write(gomock.Any()).
+		DoAndReturn(func(b []byte) (int, error) {
+			request := amba.Request{}
+			if err := json.Unmarshal(b, &request); err != nil {
+				return 0, err
+			}
+
+			cam.mu.Lock()
+			defer cam.mu.Unlock()
+
+			cam.requests = append(cam.requests, request)
+
+			if replies := cam.replies[request.MsgId]; len(replies) > 0 {
+				cam.replies[request.MsgId] = replies[1:]
+				go func() {
+					_, _ = pw.Write([]byte(replies[0]))
+				}()
+			}
+
+			return len(b), nil
+		}).
+		AnyTimes()
+
+	mc.EXPECT().
+		Close().
+		DoAndReturn(func() error {
+			return pw.Close()
+		}).
+		AnyTimes()
+
+	mrf.EXPECT().
+		NewReader(mc).
+		Return(pr)
+
+	return cam, mc
+}
+
+func (cam *camera) sentRequests() []amba.Request {
+	cam.mu.Lock()
+	defer cam.mu.Unlock()
+
+	return append([]amba.Request{}, cam.requests...)
+}
+
+// newAmbaMedia returns the amba media adapter of the camera, the data connections are dialed in order
+func newAmbaMedia(t *testing.T, ctrl *gomock.Controller, replies map[int][]string, dataConns ...amba.Conn) (*yi4kplus.AmbaMedia, *camera) {
+	t.Setenv("MEDIA_ADAPTER", yi4kplus.AdapterAmba)
+	t.Setenv("CAMERA_NAME", "yi4kplus")
+	t.Setenv("CAMERA_MEDIA_DIR", mediaDir)
+
+	mrf := mocks.NewMockReaderFactory(ctrl)
+	cam, mc := newCamera(ctrl, mrf, replies)
+
+	mcf := mocks.NewMockConnFactory(ctrl)
+	calls := []any{
+		mcf.EXPECT().
+			NewConn(gomock.Any(), "").
+			Return(mc, nil),
+	}
+
+	for _, dataConn := range dataConns {
+		calls = append(calls, mcf.EXPECT().
+			NewConn(gomock.Any(), "8787").
+			Return(dataConn, nil))
+	}
+
+	gomock.InOrder(calls...)
+
+	ambaClient := amba.New(amba.NewConfig(), logger.New(loggerEnv), mcf, mrf)
+
+	media := yi4kplus.NewMedia(yi4kplus.NewConfig(), logger.New(loggerEnv), ambaClient, nil, nil)
+
+	ambaMedia, ok := media.(*yi4kplus.AmbaMedia)
+	assert.True(t, ok)
+
+	return ambaMedia, cam
+}
+
+func TestAmbaMedia_GetFiles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	media, cam := newAmbaMedia(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1282: {
+			`{"rval": 0, "msg_id": 1282, "listing": [
+				{"100MEDIA/": "2023-06-03 10:00:00"},
+				{"MISC.INFO": "10 bytes|2023-06-03 10:00:00"}
+			]}`,
+			`{"rval": 0, "msg_id": 1282, "listing": [
+				{"YDXJ0001.MP4": "1048576 bytes|2023-06-03 10:01:02"},
+				{"YDXJ0001.THM": "1024 bytes|2023-06-03 10:01:02"},
+				{"YDXJ0002.MP4": "2048 bytes|2023-06-03 10:05:00"}
+			]}`,
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, media.SessionStart(ctx))
+
+	fileChan, errChan, err := media.GetFiles(ctx)
+	assert.Nil(t, err)
+
+	groups := make([]*file.File, 0)
+	for group := range fileChan {
+		groups = append(groups, group)
+	}
+
+	assert.Nil(t, <-errChan)
+	assert.Len(t, groups, 2)
+
+	assert.Equal(t, "YDXJ0001.MP4", groups[0].Name)
+	assert.Equal(t, "100MEDIA", groups[0].Path)
+	assert.Equal(t, "yi4kplus", groups[0].Camera)
+	assert.Equal(t, uint64(1048576), groups[0].Size)
+	assert.Equal(t, time.Date(2023, 6, 3, 10, 1, 2, 0, time.Local), groups[0].Time)
+	assert.Len(t, groups[0].Sidecars, 1)
+	assert.Equal(t, "yi4kplus", groups[0].Sidecars[0].Camera)
+
+	assert.Equal(t, "YDXJ0002.MP4", groups[1].Name)
+
+	requests := cam.sentRequests()
+	assert.Equal(t, mediaDir+" -D -S", requests[1].Param)
+	assert.Equal(t, mediaDir+"/100MEDIA -D -S", requests[2].Param)
+}
+
+func TestAmbaMedia_GetFilesListFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	media, _ := newAmbaMedia(t, ctrl, map[int][]string{
+		257:  {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1282: {`{"rval": -26, "msg_id": 1282}`},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, media.SessionStart(ctx))
+
+	_, _, err := media.GetFiles(ctx)
+	assert.ErrorIs(t, err, amba.ErrRequestRejected)
+}
+
+func TestAmbaMedia_GetReader(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	content := []byte("0123456789")
+
+	dataConn := mocks.NewMockConn(ctrl)
+	dataConn.EXPECT().
+		SetReadDeadline(gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	dataConn.EXPECT().
+		Read(gomock.Any()).
+		DoAndReturn(func(p []byte) (int, error) {
+			return copy(p, content[4:]), nil
+		})
+	dataConn.EXPECT().
+		Close()
+
+	media, cam := newAmbaMedia(t, ctrl, map[int][]string{
+		257:  {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1285: {`{"rval": 0, "msg_id": 1285, "size": 10, "rem_size": 6}`},
+	}, dataConn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, media.SessionStart(ctx))
+
+	f := file.New("YDXJ0001.MP4", "100MEDIA", time.Now(), uint64(len(content)))
+
+	reader, err := media.GetReader(f, 4)
+	assert.Nil(t, err)
+
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "456789", string(data))
+	assert.Nil(t, reader.Close())
+
+	requests := cam.sentRequests()
+	assert.Equal(t, 1285, requests[1].MsgId)
+	assert.Equal(t, mediaDir+"/100MEDIA/YDXJ0001.MP4", requests[1].Param)
+	assert.Equal(t, uint64(4), requests[1].Offset)
+	assert.Equal(t, 3, requests[1].Token)
+}
+
+func TestAmbaMedia_GetReaderOneTransferAtATime(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dataConns := make([]amba.Conn, 0, 2)
+	for i := 0; i < 2; i++ {
+		dataConn := mocks.NewMockConn(ctrl)
+		dataConn.EXPECT().
+			SetReadDeadline(gomock.Any()).
+			Return(nil).
+			AnyTimes()
+		dataConn.EXPECT().
+			Read(gomock.Any()).
+			DoAndReturn(func(p []byte) (int, error) {
+				return copy(p, "0123456789"), nil
+			})
+		dataConn.EXPECT().
+			Close()
+
+		dataConns = append(dataConns, dataConn)
+	}
+
+	media, cam := newAmbaMedia(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1285: {
+			`{"rval": 0, "msg_id": 1285, "size": 10, "rem_size": 10}`,
+			`{"rval": 0, "msg_id": 1285, "size": 10, "rem_size": 10}`,
+		},
+	}, dataConns...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, media.SessionStart(ctx))
+
+	first, err := media.GetReader(file.New("YDXJ0001.MP4", "100MEDIA", time.Now(), 10), 0)
+	assert.Nil(t, err)
+
+	secondReader := make(chan io.ReadCloser)
+	go func() {
+		reader, err := media.GetReader(file.New("YDXJ0002.MP4", "100MEDIA", time.Now(), 10), 0)
+		assert.Nil(t, err)
+		secondReader <- reader
+	}()
+
+	// the second transfer waits until the first reader is closed
+	select {
+	case <-secondReader:
+		t.Fatal("second transfer started while the first one is open")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	_, err = io.ReadAll(first)
+	assert.Nil(t, err)
+	assert.Nil(t, first.Close())
+
+	second := <-secondReader
+
+	data, err := io.ReadAll(second)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", string(data))
+	assert.Nil(t, second.Close())
+
+	requests := cam.sentRequests()
+	assert.Equal(t, mediaDir+"/100MEDIA/YDXJ0002.MP4", requests[len(requests)-1].Param)
+}
+
+func TestAmbaMedia_Delete(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	media, cam := newAmbaMedia(t, ctrl, map[int][]string{
+		257:  {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1281: {`{"rval": 0, "msg_id": 1281}`, `{"rval": -26, "msg_id": 1281}`},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, media.SessionStart(ctx))
+
+	f := file.New("YDXJ0001.MP4", "100MEDIA", time.Now(), 10)
+
+	assert.Nil(t, media.Delete(f))
+	assert.ErrorIs(t, media.Delete(f), amba.ErrRequestRejected)
+
+	requests := cam.sentRequests()
+	assert.Equal(t, 1281, requests[1].MsgId)
+	assert.Equal(t, mediaDir+"/100MEDIA/YDXJ0001.MP4", requests[1].Param)
+	assert.Equal(t, 3, requests[1].Token)
+}
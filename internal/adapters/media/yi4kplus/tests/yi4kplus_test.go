@@ -0,0 +1,405 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba"
+	ambamocks "github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba/mocks"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/ftp"
+	ftpmocks "github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/ftp/mocks"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/telnet"
+	telnetmocks "github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/telnet/mocks"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	clockLayout       = "2006-01-02 15:04:05"
+	clockCmd          = "date '+%Y-%m-%d %H:%M:%S'"
+	setClockCmdPrefix = "date -s "
+	startFtpServerCmd = "tcpsvd -u 'root' -vE 0.0.0.0 '21' ftpd -w '/tmp/fuse_d/DCIM' 1>/dev/null 2>&1 & echo $!"
+	netstatHeader     = "Active Internet connections (only servers)\n" +
+		"Proto Recv-Q Send-Q Local Address           Foreign Address         State\n"
+)
+
+var commandRegexp = regexp.MustCompile(`^(.*?)(?:; | )echo "(__status_\d+__=)\$\?"$`)
+
+// result is the reply of the shell to a command
+type result struct {
+	output string
+	status int
+}
+
+// shell is the camera side of the telnet connection without a login, a command is answered
+// with the result of the command line or of the longest prefix of it
+type shell struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	results  map[string]result
+	mu       sync.Mutex
+	commands []string
+}
+
+func newShell(t *testing.T, results map[string]result) (*shell, net.Conn) {
+	server, client := net.Pipe()
+
+	defaults := map[string]result{
+		"netstat -ltn":               {output: netstatHeader},
+		startFtpServerCmd:            {output: "412\n"},
+		"test -d '" + mediaDir + "'": {},
+	}
+	for command, res := range defaults {
+		if _, ok := results[command]; !ok {
+			results[command] = res
+		}
+	}
+
+	sh := &shell{
+		conn:    server,
+		reader:  bufio.NewReader(server),
+		results: results,
+	}
+
+	go sh.serve()
+
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	return sh, client
+}
+
+func (sh *shell) serve() {
+	// the client does not negotiate options unless the server asks for them
+	sh.write("/ # ")
+
+	for {
+		line, err := sh.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		sh.write(line + "\r\n")
+
+		matches := commandRegexp.FindStringSubmatch(line)
+		if matches == nil {
+			sh.record(line)
+			continue
+		}
+
+		sh.record(matches[1])
+
+		res := sh.result(matches[1])
+
+		sh.write(strings.ReplaceAll(res.output, "\n", "\r\n") + matches[2] + strconv.Itoa(res.status) + "\r\n/ # ")
+	}
+}
+
+func (sh *shell) result(command string) result {
+	if res, ok := sh.results[command]; ok {
+		return res
+	}
+
+	prefix := ""
+	res := result{output: "sh: not found\n", status: 127}
+
+	for p, r := range sh.results {
+		if strings.HasPrefix(command, p) && len(p) > len(prefix) {
+			prefix, res = p, r
+		}
+	}
+
+	return res
+}
+
+func (sh *shell) write(data string) {
+	_, _ = sh.conn.Write([]byte(data))
+}
+
+func (sh *shell) record(command string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.commands = append(sh.commands, command)
+}
+
+func (sh *shell) received() []string {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return append([]string{}, sh.commands...)
+}
+
+// newYi4kPlus returns the ftp media adapter of the camera with the amba replies and the shell results,
+// the ftp server accepts the login
+func newYi4kPlus(
+	t *testing.T,
+	ctrl *gomock.Controller,
+	replies map[int][]string,
+	results map[string]result,
+) (*yi4kplus.Yi4kPlus, *camera, *shell) {
+	t.Setenv("MEDIA_ADAPTER", yi4kplus.AdapterFtp)
+	t.Setenv("CAMERA_NAME", "yi4kplus")
+	t.Setenv("CAMERA_MEDIA_DIR", mediaDir)
+	t.Setenv("TELNET_SERVER_PORT", "23")
+	t.Setenv("TELNET_SERVER_USER", "root")
+	t.Setenv("FTP_SERVER_PORT", "21")
+	t.Setenv("FTP_SERVER_USER", "root")
+	t.Setenv("FTP_SERVER_MEDIA_DIR", mediaDir)
+
+	log := logger.New(loggerEnv)
+
+	mrf := ambamocks.NewMockReaderFactory(ctrl)
+	cam, mc := newCamera(ctrl, mrf, replies)
+
+	amcf := ambamocks.NewMockConnFactory(ctrl)
+	amcf.EXPECT().
+		NewConn(gomock.Any(), "").
+		Return(mc, nil)
+
+	ambaClient := amba.New(amba.NewConfig(), log, amcf, mrf)
+
+	sh, conn := newShell(t, results)
+
+	tmcf := telnetmocks.NewMockConnFactory(ctrl)
+	tmcf.EXPECT().
+		NewConn(gomock.Any(), "23").
+		Return(conn, nil)
+
+	// the ftp port accepts connections
+	tmcf.EXPECT().
+		NewConn(gomock.Any(), "21").
+		DoAndReturn(func(host, port string) (telnet.Conn, error) {
+			server, client := net.Pipe()
+			_ = server.Close()
+			return client, nil
+		}).
+		AnyTimes()
+
+	telnetClient := telnet.New(telnet.NewConfig(), log, tmcf, &telnet.BufioReaderFactory{})
+
+	ftpConn := ftpmocks.NewMockConn(ctrl)
+	ftpConn.EXPECT().
+		Login("root", "").
+		Return(nil)
+	ftpConn.EXPECT().
+		Quit().
+		Return(nil).
+		AnyTimes()
+
+	fmcf := ftpmocks.NewMockConnFactory(ctrl)
+	fmcf.EXPECT().
+		NewConn(gomock.Any()).
+		Return(ftpConn, nil)
+
+	ftpClient := ftp.New(ftp.NewConfig(), log, fmcf)
+
+	media := yi4kplus.NewMedia(yi4kplus.NewConfig(), log, ambaClient, ftpClient, telnetClient)
+
+	y, ok := media.(*yi4kplus.Yi4kPlus)
+	assert.True(t, ok)
+
+	return y, cam, sh
+}
+
+func clockReply(t time.Time) string {
+	return fmt.Sprintf(`{"rval": 0, "msg_id": 1, "type": "camera_clock", "param": "%s"}`, t.Format(clockLayout))
+}
+
+func setClockRequests(cam *camera) []amba.Request {
+	requests := make([]amba.Request, 0)
+	for _, request := range cam.sentRequests() {
+		if request.MsgId == 2 {
+			requests = append(requests, request)
+		}
+	}
+
+	return requests
+}
+
+func dateCommands(sh *shell) []string {
+	commands := make([]string, 0)
+	for _, command := range sh.received() {
+		if strings.HasPrefix(command, "date") {
+			commands = append(commands, command)
+		}
+	}
+
+	return commands
+}
+
+// assertNearNow checks that the clock value is the host time the clock was set to
+func assertNearNow(t *testing.T, value string) {
+	clock, err := time.ParseInLocation(clockLayout, value, time.Local)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), clock, 5*time.Second)
+}
+
+func TestYi4kPlus_SyncClock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	y, cam, sh := newYi4kPlus(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1:   {clockReply(time.Now().Add(-time.Hour))},
+		2:   {`{"rval": 0, "msg_id": 2}`},
+	}, map[string]result{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, y.SessionStart(ctx))
+
+	requests := setClockRequests(cam)
+	assert.Len(t, requests, 1)
+	assert.Equal(t, "camera_clock", requests[0].Type)
+	assertNearNow(t, requests[0].Param)
+
+	assert.Empty(t, dateCommands(sh))
+}
+
+func TestYi4kPlus_SyncClockInSync(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	y, cam, sh := newYi4kPlus(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1:   {clockReply(time.Now().Add(-3 * time.Second))},
+	}, map[string]result{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, y.SessionStart(ctx))
+
+	assert.Empty(t, setClockRequests(cam))
+	assert.Empty(t, dateCommands(sh))
+}
+
+func TestYi4kPlus_SyncClockDriftThreshold(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the same drift which is in sync by default is corrected with a tighter limit
+	t.Setenv("CAMERA_CLOCK_MAX_DRIFT_SECONDS", "1")
+
+	y, cam, _ := newYi4kPlus(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1:   {clockReply(time.Now().Add(-3 * time.Second))},
+		2:   {`{"rval": 0, "msg_id": 2}`},
+	}, map[string]result{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, y.SessionStart(ctx))
+
+	requests := setClockRequests(cam)
+	assert.Len(t, requests, 1)
+	assertNearNow(t, requests[0].Param)
+}
+
+func TestYi4kPlus_SyncClockDisabled(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	t.Setenv("CAMERA_CLOCK_SYNC", "false")
+
+	y, cam, sh := newYi4kPlus(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+	}, map[string]result{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, y.SessionStart(ctx))
+
+	for _, request := range cam.sentRequests() {
+		assert.NotEqual(t, 1, request.MsgId)
+		assert.NotEqual(t, 2, request.MsgId)
+	}
+	assert.Empty(t, dateCommands(sh))
+}
+
+func TestYi4kPlus_SyncClockReadByTelnet(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	y, cam, sh := newYi4kPlus(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1:   {`{"rval": -26, "msg_id": 1}`},
+		2:   {`{"rval": 0, "msg_id": 2}`},
+	}, map[string]result{
+		clockCmd: {output: time.Now().Add(-time.Hour).Format(clockLayout) + "\n"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, y.SessionStart(ctx))
+
+	assert.Equal(t, []string{clockCmd}, dateCommands(sh))
+
+	requests := setClockRequests(cam)
+	assert.Len(t, requests, 1)
+	assertNearNow(t, requests[0].Param)
+}
+
+func TestYi4kPlus_SyncClockSetByTelnet(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	y, cam, sh := newYi4kPlus(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1:   {clockReply(time.Now().Add(time.Hour))},
+		2:   {`{"rval": -26, "msg_id": 2}`},
+	}, map[string]result{
+		setClockCmdPrefix: {},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, y.SessionStart(ctx))
+
+	assert.Len(t, setClockRequests(cam), 1)
+
+	commands := dateCommands(sh)
+	assert.Len(t, commands, 1)
+
+	value := strings.TrimPrefix(commands[0], setClockCmdPrefix)
+	assert.True(t, strings.HasSuffix(value, " >/dev/null"))
+	assertNearNow(t, strings.Trim(strings.TrimSuffix(value, " >/dev/null"), "'"))
+}
+
+func TestYi4kPlus_SyncClockReadFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the session goes on with the camera clock as it is
+	y, cam, sh := newYi4kPlus(t, ctrl, map[int][]string{
+		257: {`{"rval": 0, "msg_id": 257, "param": 3}`},
+		1:   {`{"rval": -26, "msg_id": 1}`},
+	}, map[string]result{
+		clockCmd: {output: "date: can't get time\n", status: 1},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, y.SessionStart(ctx))
+
+	assert.Empty(t, setClockRequests(cam))
+	assert.Equal(t, []string{clockCmd}, dateCommands(sh))
+}
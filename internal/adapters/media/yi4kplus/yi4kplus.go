@@ -2,36 +2,73 @@ package yi4kplus
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/ftp"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/telnet"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/camera"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 	"io"
+	"log/slog"
+	"time"
+)
+
+// powerOffPollPeriod is how often the camera is checked to be gone after the power off request
+const powerOffPollPeriod = time.Second * 2
+
+var (
+	ErrStillOnline     = errors.New("camera is still online after power off")
+	ErrMediaDirMissing = errors.New("media dir is missing on the camera")
 )
 
 type Yi4kPlus struct {
+	config       *Config
+	logger       *logger.Logger
 	ambaClient   *amba.Client
+	ambaSession  *ambaSession
 	ftpClient    *ftp.Client
 	telnetClient *telnet.Client
 }
 
 func New(
+	config *Config,
+	logger *logger.Logger,
 	ambaClient *amba.Client,
 	ftpClient *ftp.Client,
 	telnetClient *telnet.Client,
 ) *Yi4kPlus {
 	return &Yi4kPlus{
+		config:       config,
+		logger:       logger,
 		ambaClient:   ambaClient,
+		ambaSession:  newAmbaSession(ambaClient),
 		ftpClient:    ftpClient,
 		telnetClient: telnetClient,
 	}
 }
 
+// NewMedia returns the media adapter chosen by the config, the amba one works without telnet and ftp server on the camera
+func NewMedia(
+	config *Config,
+	logger *logger.Logger,
+	ambaClient *amba.Client,
+	ftpClient *ftp.Client,
+	telnetClient *telnet.Client,
+) ports.Media {
+	if config.adapter == AdapterAmba {
+		return NewAmbaMedia(config, ambaClient)
+	}
+
+	return New(config, logger, ambaClient, ftpClient, telnetClient)
+}
+
 func (y *Yi4kPlus) SessionStart(ctx context.Context) error {
 	const op = "Yi4kPlus.SessionStart"
 
-	err := y.ambaClient.Run(ctx)
+	err := y.ambaSession.run(ctx)
 	if err != nil {
 		return y.errWrap(op, "amba client run", err)
 	}
@@ -41,30 +78,174 @@ func (y *Yi4kPlus) SessionStart(ctx context.Context) error {
 		return y.errWrap(op, "telnet client run", err)
 	}
 
+	err = y.preflight(ctx)
+	if err != nil {
+		return y.errWrap(op, "preflight", err)
+	}
+
+	y.syncClock(ctx)
+
 	err = y.ftpClient.Run(ctx)
 	if err != nil {
+		diagnosticsErr := y.diagnostics(ctx)
+		if diagnosticsErr != nil {
+			err = errors.Join(err, diagnosticsErr)
+		}
+
 		return y.errWrap(op, "ftp client run", err)
 	}
 
 	return nil
 }
 
-func (y *Yi4kPlus) GetFiles(ctx context.Context) (<-chan *file.File, error) {
+// preflight checks by telnet that the media dir is on the camera and logs the card usage,
+// the session fails only when the dir is surely missing, a check which can not run is logged
+func (y *Yi4kPlus) preflight(ctx context.Context) error {
+	const op = "Yi4kPlus.preflight"
+
+	log := y.logger.With(
+		slog.String("op", op),
+	)
+
+	isDir, err := y.telnetClient.IsDir(ctx, y.config.mediaDir)
+	if err != nil {
+		log.Error("Check media dir error, continue: " + err.Error())
+	} else if !isDir {
+		return y.errWrap(op, "check dir "+y.config.mediaDir, ErrMediaDirMissing)
+	}
+
+	usage, err := y.telnetClient.DiskUsage(ctx, y.config.mediaDir)
+	if err != nil {
+		log.Error("Read card usage error: " + err.Error())
+		return nil
+	}
+
+	log.Info(fmt.Sprintf(
+		"Card %s on %s: free %d of %d bytes",
+		usage.Filesystem,
+		usage.MountedOn,
+		usage.FreeBytes,
+		usage.TotalBytes,
+	))
+
+	return nil
+}
+
+// diagnostics logs the card usage and the processes of the camera, it helps to find a stuck process
+func (y *Yi4kPlus) diagnostics(ctx context.Context) error {
+	const op = "Yi4kPlus.diagnostics"
+
+	log := y.logger.With(
+		slog.String("op", op),
+	)
+
+	usage, err := y.telnetClient.DiskUsage(ctx, y.config.mediaDir)
+	if err != nil {
+		return y.errWrap(op, "disk usage", err)
+	}
+
+	log.Info("Card usage", slog.Any("usage", usage))
+
+	processes, err := y.telnetClient.Processes(ctx)
+	if err != nil {
+		return y.errWrap(op, "processes", err)
+	}
+
+	for _, p := range processes {
+		log.Info("Process", slog.Int("pid", p.PID), slog.String("user", p.User), slog.String("command", p.Command))
+	}
+
+	return nil
+}
+
+// syncClock sets the camera clock to the host time when the drift is over the limit,
+// the amba camera_clock setting is tried first and telnet date is the fallback.
+// A failure does not stop the session, the clips are still exported with the camera time.
+func (y *Yi4kPlus) syncClock(ctx context.Context) {
+	const op = "Yi4kPlus.syncClock"
+
+	log := y.logger.With(
+		slog.String("op", op),
+	)
+
+	if !y.config.syncClock {
+		return
+	}
+
+	cameraTime, err := y.ambaClient.Clock()
+	if err != nil {
+		log.Info("Read camera clock by amba failed, try telnet: " + err.Error())
+
+		cameraTime, err = y.telnetClient.Clock(ctx)
+		if err != nil {
+			log.Error("Read camera clock error: " + err.Error())
+			return
+		}
+	}
+
+	hostTime := time.Now()
+	drift := cameraTime.Sub(hostTime).Truncate(time.Second)
+
+	if drift.Abs() <= y.config.maxClockDrift {
+		log.Info("Camera clock is in sync, drift: " + drift.String())
+		return
+	}
+
+	err = y.ambaClient.SetClock(hostTime)
+	if err != nil {
+		log.Info("Set camera clock by amba failed, try telnet: " + err.Error())
+
+		err = y.telnetClient.SetClock(ctx, hostTime)
+		if err != nil {
+			log.Error("Set camera clock error: " + err.Error())
+			return
+		}
+	}
+
+	log.Info(fmt.Sprintf(
+		"Camera clock corrected by %s, was %s",
+		(-drift).String(),
+		cameraTime.Format(time.DateTime),
+	))
+}
+
+func (y *Yi4kPlus) GetFiles(ctx context.Context) (<-chan *file.File, <-chan error, error) {
 	const op = "Yi4kPlus.GetFiles"
 
-	fileChan, err := y.ftpClient.GetFiles(ctx)
+	ftpFileChan, ftpErrChan, err := y.ftpClient.GetFiles(ctx)
 	if err != nil {
-		return nil, y.errWrap(op, "ftp get files", err)
+		return nil, nil, y.errWrap(op, "ftp get files", err)
 	}
 
-	return fileChan, nil
+	fileChan := make(chan *file.File)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(errChan)
+
+		for group := range ftpFileChan {
+			for _, f := range group.Files() {
+				f.Camera = y.config.name
+			}
+
+			fileChan <- group
+		}
+
+		close(fileChan)
+
+		if err := <-ftpErrChan; err != nil {
+			errChan <- y.errWrap(op, "ftp walk", err)
+		}
+	}()
+
+	return fileChan, errChan, nil
 }
 
-func (y *Yi4kPlus) GetReader(f *file.File) (io.ReadCloser, error) {
+func (y *Yi4kPlus) GetReader(f *file.File, offset uint64) (io.ReadCloser, error) {
 	const op = "Yi4kPlus.GetReader"
 
 	filepath := f.Path + "/" + f.Name
-	reader, err := y.ftpClient.GetReader(filepath)
+	reader, err := y.ftpClient.GetReader(filepath, offset)
 	if err != nil {
 		return nil, y.errWrap(op, "ftp get reader "+filepath, err)
 	}
@@ -83,6 +264,117 @@ func (y *Yi4kPlus) Delete(f *file.File) error {
 	return nil
 }
 
+// Checksum returns md5 of the file calculated on the camera
+func (y *Yi4kPlus) Checksum(ctx context.Context, f *file.File) (string, error) {
+	const op = "Yi4kPlus.Checksum"
+
+	filepath := f.Path + "/" + f.Name
+	checksum, err := y.telnetClient.Md5sum(ctx, filepath)
+	if err != nil {
+		return "", y.errWrap(op, "telnet md5sum "+filepath, err)
+	}
+
+	return checksum, nil
+}
+
+// Status reads the state of the camera by amba, it may be called before SessionStart
+func (y *Yi4kPlus) Status(ctx context.Context) (*camera.Status, error) {
+	const op = "Yi4kPlus.Status"
+
+	err := y.ambaSession.run(ctx)
+	if err != nil {
+		return nil, y.errWrap(op, "amba client run", err)
+	}
+
+	status, err := cameraStatus(y.ambaClient)
+	if err != nil {
+		return nil, y.errWrap(op, "camera status", err)
+	}
+
+	return status, nil
+}
+
+// cameraStatus queries the state of the camera with amba requests
+func cameraStatus(ambaClient *amba.Client) (*camera.Status, error) {
+	const op = "yi4kplus.cameraStatus"
+
+	level, externalPower, err := ambaClient.BatteryLevel()
+	if err != nil {
+		return nil, fmt.Errorf("%s: battery level failed: %w", op, err)
+	}
+
+	free, total, err := ambaClient.Space()
+	if err != nil {
+		return nil, fmt.Errorf("%s: space failed: %w", op, err)
+	}
+
+	recording, err := ambaClient.IsRecording()
+	if err != nil {
+		return nil, fmt.Errorf("%s: is recording failed: %w", op, err)
+	}
+
+	return &camera.Status{
+		BatteryLevel:  level,
+		ExternalPower: externalPower,
+		FreeBytes:     free,
+		TotalBytes:    total,
+		Recording:     recording,
+	}, nil
+}
+
+// PowerOff switches the camera off with the amba request, if the camera stays online the telnet poweroff is used.
+// It returns when the amba port stops accepting connections.
+func (y *Yi4kPlus) PowerOff(ctx context.Context) error {
+	const op = "Yi4kPlus.PowerOff"
+
+	ambaErr := y.ambaClient.PowerOff()
+	if ambaErr == nil {
+		ambaErr = waitOffline(ctx, y.ambaClient, y.config.powerOffTimeout)
+	}
+
+	if ambaErr == nil {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return y.errWrap(op, "amba power off", ambaErr)
+	}
+
+	telnetErr := y.telnetClient.PowerOff()
+	if telnetErr == nil {
+		telnetErr = waitOffline(ctx, y.ambaClient, y.config.powerOffTimeout)
+	}
+
+	if telnetErr != nil {
+		return y.errWrap(op, "power off", errors.Join(ambaErr, telnetErr))
+	}
+
+	return nil
+}
+
+// waitOffline returns when the amba port of the camera stops accepting connections
+func waitOffline(ctx context.Context, ambaClient *amba.Client, timeout time.Duration) error {
+	const op = "yi4kplus.waitOffline"
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: wait failed: %w", op, ctx.Err())
+		case <-time.After(powerOffPollPeriod):
+		}
+
+		if !ambaClient.IsAlive() {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: wait %s failed: %w", op, timeout, ErrStillOnline)
+		}
+	}
+}
+
 func (y *Yi4kPlus) errWrap(methodName, message string, err error) error {
 	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
 }
@@ -0,0 +1,24 @@
+package jsonfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// defaultFileName is the queue in the local storage dir, the storage skips hidden files
+const defaultFileName = ".encoder_queue"
+
+type Config struct {
+	path string
+}
+
+func NewConfig() *Config {
+	path := os.Getenv("ENCODER_QUEUE_PATH")
+	if path == "" {
+		path = filepath.Join(os.Getenv("LOCAL_STORAGE_DIR"), defaultFileName)
+	}
+
+	return &Config{
+		path: path,
+	}
+}
@@ -0,0 +1,387 @@
+package jsonfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/encoding"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Queue is an append-only log of encoding jobs, every change appends the job as one json line.
+// The log is compacted on open: jobs of deleted source files are dropped,
+// jobs which were running when the process stopped are queued again.
+type Queue struct {
+	config *Config
+	logger *logger.Logger
+	mu     sync.Mutex
+	log    *os.File
+	jobs   map[string]*encoding.Job
+}
+
+func New(config *Config, logger *logger.Logger) *Queue {
+	return &Queue{
+		config: config,
+		logger: logger,
+	}
+}
+
+func (q *Queue) Enqueue(job *encoding.Job) error {
+	const op = "Queue.Enqueue"
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.open()
+	if err != nil {
+		return q.errWrap(op, "open", err)
+	}
+
+	if _, ok := q.jobs[job.ID]; ok {
+		return nil
+	}
+
+	err = q.append(q.copy(job))
+	if err != nil {
+		return q.errWrap(op, "append", err)
+	}
+
+	return nil
+}
+
+func (q *Queue) Dequeue() (*encoding.Job, error) {
+	const op = "Queue.Dequeue"
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.open()
+	if err != nil {
+		return nil, q.errWrap(op, "open", err)
+	}
+
+	var next *encoding.Job
+
+	for _, job := range q.jobs {
+		if job.Status != encoding.StatusQueued {
+			continue
+		}
+
+		if next == nil || job.Priority > next.Priority ||
+			job.Priority == next.Priority && job.CreatedAt.Before(next.CreatedAt) {
+			next = job
+		}
+	}
+
+	if next == nil {
+		return nil, nil
+	}
+
+	running := q.copy(next)
+	running.Status = encoding.StatusRunning
+	running.Attempts++
+	running.UpdatedAt = time.Now()
+
+	err = q.append(running)
+	if err != nil {
+		return nil, q.errWrap(op, "append", err)
+	}
+
+	return q.copy(running), nil
+}
+
+func (q *Queue) Update(job *encoding.Job) error {
+	const op = "Queue.Update"
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.open()
+	if err != nil {
+		return q.errWrap(op, "open", err)
+	}
+
+	updated := q.copy(job)
+	updated.UpdatedAt = time.Now()
+
+	err = q.append(updated)
+	if err != nil {
+		return q.errWrap(op, "append", err)
+	}
+
+	return nil
+}
+
+// Retry queues failed jobs with less than maxAttempts attempts again and returns their number
+func (q *Queue) Retry(maxAttempts int) (int, error) {
+	const op = "Queue.Retry"
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.open()
+	if err != nil {
+		return 0, q.errWrap(op, "open", err)
+	}
+
+	failed := make([]*encoding.Job, 0)
+	for _, job := range q.jobs {
+		if job.Status == encoding.StatusFailed && job.Attempts < maxAttempts {
+			failed = append(failed, job)
+		}
+	}
+
+	for _, job := range failed {
+		retried := q.copy(job)
+		retried.Status = encoding.StatusQueued
+		retried.UpdatedAt = time.Now()
+
+		err = q.append(retried)
+		if err != nil {
+			return 0, q.errWrap(op, "append", err)
+		}
+	}
+
+	return len(failed), nil
+}
+
+// Jobs returns all known jobs in order of creation
+func (q *Queue) Jobs() ([]*encoding.Job, error) {
+	const op = "Queue.Jobs"
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	err := q.open()
+	if err != nil {
+		return nil, q.errWrap(op, "open", err)
+	}
+
+	return q.sorted(), nil
+}
+
+func (q *Queue) open() error {
+	if q.log != nil {
+		return nil
+	}
+
+	const op = "Queue.open"
+
+	err := q.load()
+	if err != nil {
+		return q.errWrap(op, "load", err)
+	}
+
+	err = q.compact()
+	if err != nil {
+		return q.errWrap(op, "compact", err)
+	}
+
+	q.log, err = os.OpenFile(q.config.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return q.errWrap(op, "os open file, path: "+q.config.path, err)
+	}
+
+	return nil
+}
+
+func (q *Queue) load() error {
+	const op = "Queue.load"
+
+	log := q.logger.With(
+		slog.String("op", op),
+		slog.Any("config", q.config),
+	)
+
+	q.jobs = map[string]*encoding.Job{}
+
+	logFile, err := os.Open(q.config.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return q.errWrap(op, "os open, path: "+q.config.path, err)
+	}
+
+	defer func() {
+		_ = logFile.Close()
+	}()
+
+	scanner := bufio.NewScanner(logFile)
+	for scanner.Scan() {
+		job := &encoding.Job{}
+
+		// the last line may be cut off by a crash in the middle of a write
+		if err := json.Unmarshal(scanner.Bytes(), job); err != nil || job.ID == "" {
+			log.Info("Skip broken queue entry: " + scanner.Text())
+			continue
+		}
+
+		q.jobs[job.ID] = job
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return q.errWrap(op, "scan", err)
+	}
+
+	for id, job := range q.jobs {
+		// the source is gone, there is nothing to encode or to keep from encoding again
+		if _, err := os.Stat(job.SrcPath); errors.Is(err, os.ErrNotExist) {
+			delete(q.jobs, id)
+			continue
+		}
+
+		// the job was interrupted by the stop of the process
+		if job.Status == encoding.StatusRunning {
+			log.Info("Resume encoding job " + job.ID)
+			job.Status = encoding.StatusQueued
+		}
+	}
+
+	return nil
+}
+
+func (q *Queue) compact() error {
+	const op = "Queue.compact"
+
+	tmpPath := q.config.path + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return q.errWrap(op, "os create, path: "+tmpPath, err)
+	}
+
+	for _, job := range q.sorted() {
+		err = q.write(tmpFile, job)
+		if err != nil {
+			_ = tmpFile.Close()
+			return q.errWrap(op, "write job", err)
+		}
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		_ = tmpFile.Close()
+		return q.errWrap(op, "sync", err)
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return q.errWrap(op, "close, path: "+tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, q.config.path)
+	if err != nil {
+		return q.errWrap(op, "os rename, path: "+tmpPath, err)
+	}
+
+	err = syncDir(filepath.Dir(q.config.path))
+	if err != nil {
+		return q.errWrap(op, "sync dir, path: "+q.config.path, err)
+	}
+
+	return nil
+}
+
+// syncDir flushes the directory entry, so the rename survives a power loss
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if err != nil {
+		_ = d.Close()
+		return err
+	}
+
+	return d.Close()
+}
+
+// append writes the new state of the job to the log and applies it once it is on disk
+func (q *Queue) append(job *encoding.Job) error {
+	const op = "Queue.append"
+
+	err := q.write(q.log, job)
+	if err != nil {
+		return q.errWrap(op, "write job", err)
+	}
+
+	err = q.log.Sync()
+	if err != nil {
+		return q.errWrap(op, "sync", err)
+	}
+
+	q.jobs[job.ID] = job
+
+	return nil
+}
+
+func (q *Queue) write(dst *os.File, job *encoding.Job) error {
+	const op = "Queue.write"
+
+	rawJob, err := json.Marshal(job)
+	if err != nil {
+		return q.errWrap(op, "json marshal", err)
+	}
+
+	_, err = dst.Write(append(rawJob, '\n'))
+	if err != nil {
+		return q.errWrap(op, "write", err)
+	}
+
+	return nil
+}
+
+// sorted returns copies of the jobs in order of creation
+func (q *Queue) sorted() []*encoding.Job {
+	jobs := make([]*encoding.Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, q.copy(job))
+	}
+
+	sort.Slice(jobs, func(a, b int) bool {
+		return jobs[a].CreatedAt.Before(jobs[b].CreatedAt)
+	})
+
+	return jobs
+}
+
+// Close releases the queue file, next call opens it again
+func (q *Queue) Close() error {
+	const op = "Queue.Close"
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.log == nil {
+		return nil
+	}
+
+	err := q.log.Close()
+	q.log = nil
+
+	if err != nil {
+		return q.errWrap(op, "close", err)
+	}
+
+	return nil
+}
+
+func (q *Queue) copy(job *encoding.Job) *encoding.Job {
+	c := *job
+	return &c
+}
+
+func (q *Queue) errWrap(methodName, message string, err error) error {
+	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
+}
@@ -0,0 +1,217 @@
+package jsonfile
+
+import (
+	"bufio"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/encoding"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewConfig_DefaultPath(t *testing.T) {
+	t.Setenv("ENCODER_QUEUE_PATH", "")
+	t.Setenv("LOCAL_STORAGE_DIR", "/data/videos")
+
+	// the queue is never written to an empty path
+	assert.Equal(t, "/data/videos/.encoder_queue", NewConfig().path)
+
+	t.Setenv("ENCODER_QUEUE_PATH", "/data/queue")
+
+	assert.Equal(t, "/data/queue", NewConfig().path)
+}
+
+func TestQueue_Dequeue(t *testing.T) {
+	config := NewConfig()
+	config.path = t.TempDir() + "/queue"
+
+	q := New(config, logger.New(logger.EnvTest))
+
+	now := time.Now()
+	low := encoding.New("ffmpeg", "/data/videos/low.MP4", "/data/encoded/low", 0, now)
+	first := encoding.New("ffmpeg", "/data/videos/first.MP4", "/data/encoded/first", 10, now)
+	second := encoding.New("ffmpeg", "/data/videos/second.MP4", "/data/encoded/second", 10, now.Add(time.Second))
+
+	assert.Nil(t, q.Enqueue(low))
+	assert.Nil(t, q.Enqueue(second))
+	assert.Nil(t, q.Enqueue(first))
+	// a known job is not queued twice
+	assert.Nil(t, q.Enqueue(first))
+
+	job, err := q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, first.ID, job.ID)
+	assert.Equal(t, encoding.StatusRunning, job.Status)
+	assert.Equal(t, 1, job.Attempts)
+
+	job.Status = encoding.StatusDone
+	assert.Nil(t, q.Update(job))
+
+	job, err = q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, second.ID, job.ID)
+
+	job, err = q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, low.ID, job.ID)
+
+	job, err = q.Dequeue()
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+}
+
+func TestQueue_Resume(t *testing.T) {
+	config := NewConfig()
+	config.path = t.TempDir() + "/queue"
+
+	q := New(config, logger.New(logger.EnvTest))
+
+	assert.Nil(t, q.Enqueue(encoding.New("ffmpeg", sourceFile(t, "a.MP4"), "/data/encoded/a", 0, time.Now())))
+
+	running, err := q.Dequeue()
+	assert.Nil(t, err)
+	assert.NotNil(t, running)
+
+	// emulate a restart of the process in the middle of the encoding
+	q = New(config, logger.New(logger.EnvTest))
+
+	jobs, err := q.Jobs()
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, encoding.StatusQueued, jobs[0].Status)
+
+	job, err := q.Dequeue()
+	assert.Nil(t, err)
+	assert.Equal(t, running.ID, job.ID)
+	assert.Equal(t, 2, job.Attempts)
+}
+
+func TestQueue_Retry(t *testing.T) {
+	config := NewConfig()
+	config.path = t.TempDir() + "/queue"
+
+	q := New(config, logger.New(logger.EnvTest))
+
+	assert.Nil(t, q.Enqueue(encoding.New("ffmpeg", "/data/videos/a.MP4", "/data/encoded/a", 0, time.Now())))
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		job, err := q.Dequeue()
+		assert.Nil(t, err)
+		assert.Equal(t, attempt, job.Attempts)
+
+		job.Status = encoding.StatusFailed
+		assert.Nil(t, q.Update(job))
+
+		// a failed job is not dequeued until it is retried
+		job, err = q.Dequeue()
+		assert.Nil(t, err)
+		assert.Nil(t, job)
+
+		retried, err := q.Retry(2)
+		assert.Nil(t, err)
+
+		if attempt < 2 {
+			assert.Equal(t, 1, retried)
+		} else {
+			// the job is out of attempts and stays failed
+			assert.Equal(t, 0, retried)
+		}
+	}
+
+	jobs, err := q.Jobs()
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, encoding.StatusFailed, jobs[0].Status)
+}
+
+func TestQueue_Compact(t *testing.T) {
+	config := NewConfig()
+	config.path = t.TempDir() + "/queue"
+
+	q := New(config, logger.New(logger.EnvTest))
+
+	kept := encoding.New("ffmpeg", sourceFile(t, "kept.MP4"), "/data/encoded/kept", 0, time.Now())
+	deleted := encoding.New("ffmpeg", sourceFile(t, "deleted.MP4"), "/data/encoded/deleted", 0, time.Now())
+
+	assert.Nil(t, q.Enqueue(kept))
+	assert.Nil(t, q.Enqueue(deleted))
+
+	for i := 0; i < 2; i++ {
+		job, err := q.Dequeue()
+		assert.Nil(t, err)
+
+		job.Status = encoding.StatusDone
+		assert.Nil(t, q.Update(job))
+	}
+
+	// every change is appended instead of rewriting the file
+	assert.Equal(t, 6, countLines(t, config.path))
+
+	assert.Nil(t, os.Remove(deleted.SrcPath))
+	assert.Nil(t, q.Close())
+
+	// the last state of every job with an existing source is left after the reopen
+	jobs, err := q.Jobs()
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, kept.ID, jobs[0].ID)
+	assert.Equal(t, encoding.StatusDone, jobs[0].Status)
+	assert.Equal(t, 1, countLines(t, config.path))
+
+	// a done job is remembered, the file is not queued again
+	assert.Nil(t, q.Enqueue(kept))
+
+	job, err := q.Dequeue()
+	assert.Nil(t, err)
+	assert.Nil(t, job)
+}
+
+func TestQueue_SkipBrokenEntry(t *testing.T) {
+	config := NewConfig()
+	config.path = t.TempDir() + "/queue"
+
+	q := New(config, logger.New(logger.EnvTest))
+
+	assert.Nil(t, q.Enqueue(encoding.New("ffmpeg", sourceFile(t, "a.MP4"), "/data/encoded/a", 0, time.Now())))
+	assert.Nil(t, q.Close())
+
+	// emulate a crash in the middle of a write
+	logFile, err := os.OpenFile(config.path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = logFile.WriteString(`{"ID":"ffmpeg:`)
+	assert.Nil(t, err)
+	assert.Nil(t, logFile.Close())
+
+	q = New(config, logger.New(logger.EnvTest))
+
+	jobs, err := q.Jobs()
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, encoding.StatusQueued, jobs[0].Status)
+}
+
+func sourceFile(t *testing.T, name string) string {
+	p := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(p, []byte("video"), 0644))
+
+	return p
+}
+
+func countLines(t *testing.T, p string) int {
+	logFile, err := os.Open(p)
+	assert.Nil(t, err)
+
+	defer func() {
+		_ = logFile.Close()
+	}()
+
+	lines := 0
+	scanner := bufio.NewScanner(logFile)
+	for scanner.Scan() {
+		lines++
+	}
+
+	return lines
+}
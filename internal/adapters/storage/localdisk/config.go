@@ -1,13 +1,83 @@
 package localdisk
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultPathTemplate = "{{.Name}}"
 
 type Config struct {
-	storageDir string
+	storageDir           string
+	encodedDir           string
+	pathTemplate         string
+	stalePartTimeout     time.Duration
+	minFreeBytes         uint64
+	retentionMaxAge      time.Duration
+	retentionMaxBytes    uint64
+	retentionEncodedOnly bool
+	retentionOnLowSpace  bool
 }
 
 func NewConfig() *Config {
+	pathTemplate := os.Getenv("LOCAL_STORAGE_PATH_TEMPLATE")
+	if pathTemplate == "" {
+		pathTemplate = defaultPathTemplate
+	}
+
+	stalePartTimeout := time.Hour * 72
+	rawStalePartHours := os.Getenv("LOCAL_STORAGE_STALE_PART_HOURS")
+
+	if i, err := strconv.Atoi(rawStalePartHours); err == nil && i > 0 {
+		stalePartTimeout = time.Hour * time.Duration(i)
+	}
+
+	minFreeBytes := uint64(1024 * 1024 * 1024)
+	rawMinFreeMegaBytes := os.Getenv("LOCAL_STORAGE_MIN_FREE_MB")
+
+	if i, err := strconv.ParseUint(rawMinFreeMegaBytes, 10, 64); err == nil {
+		minFreeBytes = i * 1024 * 1024
+	}
+
+	// zero disables the retention by age or by size
+	retentionMaxAge := time.Duration(0)
+	rawRetentionMaxAgeDays := os.Getenv("LOCAL_STORAGE_RETENTION_MAX_AGE_DAYS")
+
+	if i, err := strconv.Atoi(rawRetentionMaxAgeDays); err == nil && i > 0 {
+		retentionMaxAge = time.Hour * 24 * time.Duration(i)
+	}
+
+	retentionMaxBytes := uint64(0)
+	rawRetentionMaxGigaBytes := os.Getenv("LOCAL_STORAGE_RETENTION_MAX_SIZE_GB")
+
+	if i, err := strconv.ParseUint(rawRetentionMaxGigaBytes, 10, 64); err == nil {
+		retentionMaxBytes = i * 1024 * 1024 * 1024
+	}
+
+	retentionEncodedOnly := false
+	rawRetentionEncodedOnly := os.Getenv("LOCAL_STORAGE_RETENTION_ENCODED_ONLY")
+
+	if b, err := strconv.ParseBool(rawRetentionEncodedOnly); err == nil {
+		retentionEncodedOnly = b
+	}
+
+	retentionOnLowSpace := false
+	rawRetentionOnLowSpace := os.Getenv("LOCAL_STORAGE_RETENTION_ON_LOW_SPACE")
+
+	if b, err := strconv.ParseBool(rawRetentionOnLowSpace); err == nil {
+		retentionOnLowSpace = b
+	}
+
 	return &Config{
-		storageDir: os.Getenv("LOCAL_STORAGE_DIR"),
+		storageDir:           os.Getenv("LOCAL_STORAGE_DIR"),
+		encodedDir:           os.Getenv("LOCAL_ENCODED_DIR"),
+		pathTemplate:         pathTemplate,
+		stalePartTimeout:     stalePartTimeout,
+		minFreeBytes:         minFreeBytes,
+		retentionMaxAge:      retentionMaxAge,
+		retentionMaxBytes:    retentionMaxBytes,
+		retentionEncodedOnly: retentionEncodedOnly,
+		retentionOnLowSpace:  retentionOnLowSpace,
 	}
 }
@@ -0,0 +1,196 @@
+package localdisk
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// exportIndexName is the hidden file with the export time of every committed clip, one json record per line.
+// The modification time of a clip is its capture time, so it can not tell how long the copy is kept.
+const exportIndexName = ".export_times"
+
+type exportRecord struct {
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+}
+
+func (s *Storage) exportIndexPath() string {
+	return filepath.Join(s.config.storageDir, exportIndexName)
+}
+
+// recordExport appends the export time of the committed clip to the index
+func (s *Storage) recordExport(path string, exportedAt time.Time) error {
+	const op = "Storage.recordExport"
+
+	relPath, err := filepath.Rel(s.config.storageDir, path)
+	if err != nil {
+		return s.errWrap(op, "relative path of "+path, err)
+	}
+
+	line, err := json.Marshal(exportRecord{Path: relPath, Time: exportedAt})
+	if err != nil {
+		return s.errWrap(op, "json marshal", err)
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	indexPath := s.exportIndexPath()
+
+	index, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return s.errWrap(op, "os open file, path: "+indexPath, err)
+	}
+
+	_, err = index.Write(append(line, '\n'))
+	if err != nil {
+		_ = index.Close()
+		return s.errWrap(op, "write, path: "+indexPath, err)
+	}
+
+	err = index.Sync()
+	if err != nil {
+		_ = index.Close()
+		return s.errWrap(op, "sync, path: "+indexPath, err)
+	}
+
+	err = index.Close()
+	if err != nil {
+		return s.errWrap(op, "close, path: "+indexPath, err)
+	}
+
+	return nil
+}
+
+// exportTimes returns the last export time of every clip in the index by the path in the storage dir
+func (s *Storage) exportTimes() (map[string]time.Time, error) {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	return s.readExportIndex()
+}
+
+// readExportIndex reads the index, the caller holds indexMu
+func (s *Storage) readExportIndex() (map[string]time.Time, error) {
+	const op = "Storage.readExportIndex"
+
+	log := s.logger.With(
+		slog.String("op", op),
+	)
+
+	times := map[string]time.Time{}
+	indexPath := s.exportIndexPath()
+
+	index, err := os.Open(indexPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return times, nil
+	}
+
+	if err != nil {
+		return nil, s.errWrap(op, "os open, path: "+indexPath, err)
+	}
+
+	defer func() {
+		_ = index.Close()
+	}()
+
+	scanner := bufio.NewScanner(index)
+	for scanner.Scan() {
+		record := exportRecord{}
+
+		// the last line may be cut off by a crash in the middle of a write
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.Path == "" {
+			log.Info("Skip broken export record: " + scanner.Text())
+			continue
+		}
+
+		times[filepath.Join(s.config.storageDir, record.Path)] = record.Time
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, s.errWrap(op, "scan, path: "+indexPath, err)
+	}
+
+	return times, nil
+}
+
+// compactExportIndex rewrites the index with one record of every clip which is still in the storage dir
+func (s *Storage) compactExportIndex() error {
+	const op = "Storage.compactExportIndex"
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	times, err := s.readExportIndex()
+	if err != nil {
+		return s.errWrap(op, "read export index", err)
+	}
+
+	records := make([]exportRecord, 0, len(times))
+	for p, exportTime := range times {
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+
+		relPath, err := filepath.Rel(s.config.storageDir, p)
+		if err != nil {
+			return s.errWrap(op, "relative path of "+p, err)
+		}
+
+		records = append(records, exportRecord{Path: relPath, Time: exportTime})
+	}
+
+	sort.Slice(records, func(a, b int) bool {
+		return records[a].Time.Before(records[b].Time)
+	})
+
+	indexPath := s.exportIndexPath()
+	tmpPath := indexPath + ".tmp"
+
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return s.errWrap(op, "os create, path: "+tmpPath, err)
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(writer)
+
+	for _, record := range records {
+		err = encoder.Encode(record)
+		if err != nil {
+			_ = tmpFile.Close()
+			return s.errWrap(op, "json encode", err)
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		_ = tmpFile.Close()
+		return s.errWrap(op, "flush, path: "+tmpPath, err)
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		_ = tmpFile.Close()
+		return s.errWrap(op, "sync, path: "+tmpPath, err)
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return s.errWrap(op, "close, path: "+tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, indexPath)
+	if err != nil {
+		return s.errWrap(op, "os rename, path: "+tmpPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package localdisk
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// maxCollisions limits the number of suffixes tried for the file name taken by another clip
+const maxCollisions = 1000
+
+var (
+	ErrPathOutsideStorage = errors.New("the path template leads outside the storage dir")
+	ErrTooManyCollisions  = errors.New("too many files with the same name")
+)
+
+// layout places files in the storage dir by the path template, e.g. {{.Time.Format "2006/01-02"}}/{{.Camera}}/{{.Name}}.
+// The camera reuses names after the counter reset, so a name taken by another clip gets a numeric suffix.
+// A resolved path is reserved for the clip until it is committed or deleted, so clips exported
+// at the same time never share a path, and a part file carries the capture time and the size of its clip in the name.
+type layout struct {
+	template *template.Template
+	mu       sync.Mutex
+	reserved map[string]string
+}
+
+func newLayout(pathTemplate string) (*layout, error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(pathTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parse path template %q: %w", pathTemplate, err)
+	}
+
+	return &layout{
+		template: tmpl,
+		reserved: map[string]string{},
+	}, nil
+}
+
+// path returns the location of the file in the storage dir and reserves it for the file
+func (l *layout) path(storageDir string, f *file.File) (string, error) {
+	base, err := l.render(storageDir, f)
+	if err != nil {
+		return "", err
+	}
+
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	id := clipID(f)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	candidate := base
+	for i := 1; i <= maxCollisions; i++ {
+		owner, reserved := l.reserved[candidate]
+		if reserved && owner == id {
+			return candidate, nil
+		}
+
+		if !reserved && l.owns(candidate, f) {
+			l.reserved[candidate] = id
+			return candidate, nil
+		}
+
+		candidate = fmt.Sprintf("%s_%d%s", stem, i, ext)
+	}
+
+	return "", ErrTooManyCollisions
+}
+
+// release drops the reservation of the path, the committed copy is recognised by its modification time and size
+func (l *layout) release(path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.reserved, path)
+}
+
+// partPath returns the part file of the file at the path, e.g. YDXJ0001.MP4.1685786462.3145728.part
+func (l *layout) partPath(path string, f *file.File) string {
+	return path + "." + strconv.FormatInt(f.Time.Unix(), 10) + "." + strconv.FormatUint(f.Size, 10) + partSuffix
+}
+
+func (l *layout) render(storageDir string, f *file.File) (string, error) {
+	rendered := &strings.Builder{}
+
+	err := l.template.Execute(rendered, f)
+	if err != nil {
+		return "", fmt.Errorf("execute path template: %w", err)
+	}
+
+	relPath := filepath.Clean(rendered.String())
+	if filepath.IsAbs(relPath) || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", ErrPathOutsideStorage
+	}
+
+	return filepath.Join(storageDir, relPath), nil
+}
+
+// owns reports whether the path is free or holds a copy of the same clip and no part file of another clip is there,
+// a copy is recognised by the size and the modification time which is set to the capture time of the clip,
+// so clips with the same name captured in the same second are told apart
+func (l *layout) owns(path string, f *file.File) bool {
+	info, err := os.Stat(path)
+	if err == nil && (!info.Mode().IsRegular() || info.ModTime().Unix() != f.Time.Unix() || uint64(info.Size()) != f.Size) {
+		return false
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return false
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+
+	prefix := filepath.Base(path) + "."
+	own := filepath.Base(l.partPath(path, f))
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != own && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, partSuffix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// clipID tells clips with the same name apart by the dir on the camera and the capture time
+func clipID(f *file.File) string {
+	return fmt.Sprintf("%s/%s/%s@%d", f.Camera, f.Path, f.Name, f.Time.Unix())
+}
@@ -0,0 +1,230 @@
+package localdisk
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// clip is an exported file in the storage dir, the export time comes from the export index
+type clip struct {
+	path       string
+	size       uint64
+	exportTime time.Time
+}
+
+// applyRetention removes the oldest exported clips which are kept longer than the max age or do not fit into the max size,
+// records of removed clips are dropped from the export index
+func (s *Storage) applyRetention() error {
+	const op = "Storage.applyRetention"
+
+	clips, err := s.clips()
+	if err != nil {
+		return s.errWrap(op, "clips", err)
+	}
+
+	if s.config.retentionMaxAge == 0 && s.config.retentionMaxBytes == 0 {
+		return s.compactExportIndex()
+	}
+
+	totalBytes := uint64(0)
+	for _, c := range clips {
+		totalBytes += c.size
+	}
+
+	expiredBefore := time.Now().Add(-s.config.retentionMaxAge)
+
+	for _, c := range clips {
+		expired := s.config.retentionMaxAge > 0 && c.exportTime.Before(expiredBefore)
+		oversize := s.config.retentionMaxBytes > 0 && totalBytes > s.config.retentionMaxBytes
+
+		if !expired && !oversize {
+			continue
+		}
+
+		removed, err := s.removeClip(c)
+		if err != nil {
+			return s.errWrap(op, "remove clip", err)
+		}
+
+		if removed {
+			totalBytes -= c.size
+		}
+	}
+
+	err = s.compactExportIndex()
+	if err != nil {
+		return s.errWrap(op, "compact export index", err)
+	}
+
+	return nil
+}
+
+// makeRoom removes the oldest clips until the bytes are freed, it returns the number of freed bytes
+func (s *Storage) makeRoom(bytes uint64) (uint64, error) {
+	const op = "Storage.makeRoom"
+
+	clips, err := s.clips()
+	if err != nil {
+		return 0, s.errWrap(op, "clips", err)
+	}
+
+	freed := uint64(0)
+
+	for _, c := range clips {
+		if freed >= bytes {
+			break
+		}
+
+		removed, err := s.removeClip(c)
+		if err != nil {
+			return freed, s.errWrap(op, "remove clip", err)
+		}
+
+		if removed {
+			freed += c.size
+		}
+	}
+
+	return freed, nil
+}
+
+// clips returns the clips of the export index in the order of export, other files of the storage dir
+// (e.g. copied by hand or the encoded dir inside the storage dir) are never removed,
+// clips exported in the current session are kept until the media files are deleted
+func (s *Storage) clips() ([]clip, error) {
+	const op = "Storage.clips"
+
+	exportTimes, err := s.exportTimes()
+	if err != nil {
+		return nil, s.errWrap(op, "export times", err)
+	}
+
+	sessionStart := s.sessionStart.Load()
+	clips := make([]clip, 0, len(exportTimes))
+
+	for p, exportTime := range exportTimes {
+		if s.inEncodedDir(p) {
+			continue
+		}
+
+		if sessionStart != 0 && !exportTime.Before(time.Unix(0, sessionStart)) {
+			continue
+		}
+
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, s.errWrap(op, "os lstat, path: "+p, err)
+		}
+
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		clips = append(clips, clip{
+			path:       p,
+			size:       uint64(info.Size()),
+			exportTime: exportTime,
+		})
+	}
+
+	sort.SliceStable(clips, func(a, b int) bool {
+		if clips[a].exportTime.Equal(clips[b].exportTime) {
+			return clips[a].path < clips[b].path
+		}
+
+		return clips[a].exportTime.Before(clips[b].exportTime)
+	})
+
+	return clips, nil
+}
+
+// inEncodedDir reports whether the path is in the encoded dir, it may be inside the storage dir
+func (s *Storage) inEncodedDir(p string) bool {
+	if s.config.encodedDir == "" {
+		return false
+	}
+
+	relPath, err := filepath.Rel(s.config.encodedDir, p)
+
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
+// removeClip deletes the clip and its dir if it gets empty, clips without encoded copy are kept if configured so
+func (s *Storage) removeClip(c clip) (bool, error) {
+	const op = "Storage.removeClip"
+
+	log := s.logger.With(
+		slog.String("op", op),
+	)
+
+	if s.config.retentionEncodedOnly {
+		encoded, err := s.isEncoded(c.path)
+		if err != nil {
+			return false, s.errWrap(op, "is encoded, path: "+c.path, err)
+		}
+
+		if !encoded {
+			return false, nil
+		}
+	}
+
+	err := os.Remove(c.path)
+	if err != nil {
+		return false, s.errWrap(op, "os remove, path: "+c.path, err)
+	}
+
+	log.Info(fmt.Sprintf("Retention removed %s, %d bytes", c.path, c.size))
+
+	storageDir := filepath.Clean(s.config.storageDir)
+	for dir := filepath.Dir(c.path); dir != storageDir && strings.HasPrefix(dir, storageDir); dir = filepath.Dir(dir) {
+		// fails on the first dir which is not empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return true, nil
+}
+
+// isEncoded reports whether the encoded dir has a finished file with the same relative dir and base name as the clip,
+// the part file of an encoding in progress does not count
+func (s *Storage) isEncoded(clipPath string) (bool, error) {
+	if s.config.encodedDir == "" {
+		return false, nil
+	}
+
+	relPath, err := filepath.Rel(s.config.storageDir, clipPath)
+	if err != nil {
+		return false, err
+	}
+
+	stem := filepath.Join(s.config.encodedDir, strings.TrimSuffix(relPath, filepath.Ext(relPath)))
+
+	matches, err := filepath.Glob(stem + ".*")
+	if err != nil {
+		return false, err
+	}
+
+	for _, match := range matches {
+		// the output is the stem with the extension of the encoder, e.g. not stem.mp4.part
+		if strings.TrimSuffix(match, filepath.Ext(match)) != stem {
+			continue
+		}
+
+		info, err := os.Stat(match)
+		if err == nil && info.Mode().IsRegular() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
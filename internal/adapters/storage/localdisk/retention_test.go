@@ -0,0 +1,231 @@
+package localdisk
+
+import (
+	"context"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeClip(t *testing.T, path string, size int, age time.Duration) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, os.WriteFile(path, make([]byte, size), 0644))
+
+	modTime := time.Now().Add(-age)
+	assert.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+// exportClip writes the clip and records its export the age ago
+func exportClip(t *testing.T, storage *Storage, path string, size int, age time.Duration) {
+	writeClip(t, path, size, age)
+	assert.Nil(t, storage.recordExport(path, time.Now().Add(-age)))
+}
+
+func TestStorage_ApplyRetentionByAge(t *testing.T) {
+	config := newTestConfig(t)
+	config.retentionMaxAge = time.Hour * 24
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	oldPath := filepath.Join(config.storageDir, "2023/06-01/old.MP4")
+	newPath := filepath.Join(config.storageDir, "2023/06-03/new.MP4")
+	journalPath := filepath.Join(config.storageDir, ".export_journal")
+
+	exportClip(t, storage, oldPath, 10, time.Hour*48)
+	exportClip(t, storage, newPath, 10, time.Hour)
+	writeClip(t, journalPath, 10, time.Hour*48)
+
+	assert.Nil(t, storage.applyRetention())
+
+	_, err := os.Stat(oldPath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(filepath.Dir(oldPath))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(newPath)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(journalPath)
+	assert.Nil(t, err)
+}
+
+func TestStorage_ApplyRetentionByExportTime(t *testing.T) {
+	config := newTestConfig(t)
+	config.retentionMaxAge = time.Hour * 24
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	// an old clip exported just now is stamped with its capture time, the export time keeps it
+	oldClip := file.New("old.MP4", "100MEDIA", time.Now().Add(-time.Hour*24*30), 10)
+
+	writer, err := storage.GetWriter(oldClip, 0)
+	assert.Nil(t, err)
+	_, err = writer.Write(make([]byte, 10))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	oldPath, err := storage.Commit(oldClip)
+	assert.Nil(t, err)
+
+	// a fresh clip exported long ago is expired
+	expiredPath := filepath.Join(config.storageDir, "expired.MP4")
+	writeClip(t, expiredPath, 10, 0)
+	assert.Nil(t, storage.recordExport(expiredPath, time.Now().Add(-time.Hour*48)))
+
+	assert.Nil(t, storage.applyRetention())
+
+	_, err = os.Stat(oldPath)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(expiredPath)
+	assert.True(t, os.IsNotExist(err))
+
+	exportTimes, err := storage.exportTimes()
+	assert.Nil(t, err)
+	assert.Len(t, exportTimes, 1)
+	assert.Contains(t, exportTimes, oldPath)
+}
+
+func TestStorage_ApplyRetentionBySize(t *testing.T) {
+	config := newTestConfig(t)
+	config.retentionMaxBytes = 25
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	oldestPath := filepath.Join(config.storageDir, "oldest.MP4")
+	olderPath := filepath.Join(config.storageDir, "older.MP4")
+	newPath := filepath.Join(config.storageDir, "new.MP4")
+
+	exportClip(t, storage, oldestPath, 10, time.Hour*3)
+	exportClip(t, storage, olderPath, 10, time.Hour*2)
+	exportClip(t, storage, newPath, 10, time.Hour)
+
+	assert.Nil(t, storage.applyRetention())
+
+	_, err := os.Stat(oldestPath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(olderPath)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(newPath)
+	assert.Nil(t, err)
+}
+
+func TestStorage_ApplyRetentionEncodedOnly(t *testing.T) {
+	config := newTestConfig(t)
+	config.encodedDir = t.TempDir()
+	config.retentionMaxAge = time.Hour
+	config.retentionEncodedOnly = true
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	encodedPath := filepath.Join(config.storageDir, "2023/06-01/encoded.MP4")
+	notEncodedPath := filepath.Join(config.storageDir, "2023/06-01/not_encoded.MP4")
+
+	encodingPath := filepath.Join(config.storageDir, "2023/06-01/encoding.MP4")
+
+	exportClip(t, storage, encodedPath, 10, time.Hour*2)
+	exportClip(t, storage, notEncodedPath, 10, time.Hour*2)
+	exportClip(t, storage, encodingPath, 10, time.Hour*2)
+	writeClip(t, filepath.Join(config.encodedDir, "2023/06-01/encoded.mp4"), 1, 0)
+
+	// the encoder writes to a part file until the output is finished
+	writeClip(t, filepath.Join(config.encodedDir, "2023/06-01/encoding.mp4.part"), 1, 0)
+
+	assert.Nil(t, storage.applyRetention())
+
+	_, err := os.Stat(encodedPath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(notEncodedPath)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(encodingPath)
+	assert.Nil(t, err)
+}
+
+func TestStorage_ApplyRetentionIndexedOnly(t *testing.T) {
+	config := newTestConfig(t)
+	config.retentionMaxAge = time.Hour
+	config.encodedDir = filepath.Join(config.storageDir, "encoded")
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	exportedPath := filepath.Join(config.storageDir, "exported.MP4")
+	copiedPath := filepath.Join(config.storageDir, "usb/copied.MP4")
+	encodedPath := filepath.Join(config.encodedDir, "exported.mp4")
+
+	exportClip(t, storage, exportedPath, 10, time.Hour*2)
+
+	// files which the exporter did not write are never removed, even if they are old
+	writeClip(t, copiedPath, 10, time.Hour*48)
+	writeClip(t, encodedPath, 10, time.Hour*48)
+
+	assert.Nil(t, storage.applyRetention())
+
+	_, err := os.Stat(exportedPath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(copiedPath)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(encodedPath)
+	assert.Nil(t, err)
+}
+
+func TestStorage_MakeRoomKeepsSessionClips(t *testing.T) {
+	config := newTestConfig(t)
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	previousPath := filepath.Join(config.storageDir, "previous.MP4")
+	exportClip(t, storage, previousPath, 10, time.Hour)
+
+	assert.Nil(t, storage.SessionStart(context.Background()))
+
+	// the clip of the session may be still on the media, it is not removed to make room
+	f := file.New("current.MP4", "100MEDIA", time.Now().Add(-time.Hour*24), 10)
+
+	writer, err := storage.GetWriter(f, 0)
+	assert.Nil(t, err)
+	_, err = writer.Write(make([]byte, 10))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	currentPath, err := storage.Commit(f)
+	assert.Nil(t, err)
+
+	freed, err := storage.makeRoom(20)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), freed)
+
+	_, err = os.Stat(previousPath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(currentPath)
+	assert.Nil(t, err)
+
+	exportTimes, err := storage.exportTimes()
+	assert.Nil(t, err)
+	assert.Contains(t, exportTimes, currentPath)
+}
+
+func TestStorage_GetWriterNotEnoughSpace(t *testing.T) {
+	config := newTestConfig(t)
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	availableBytes, err := storage.availableBytes()
+	assert.Nil(t, err)
+
+	f := file.New("huge.MP4", "100MEDIA", time.Now(), availableBytes+1)
+
+	_, err = storage.GetWriter(f, 0)
+	assert.ErrorIs(t, err, ErrNotEnoughSpace)
+}
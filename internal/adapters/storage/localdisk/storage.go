@@ -2,33 +2,70 @@ package localdisk
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// partSuffix marks files which are being downloaded or are not verified yet
+const partSuffix = ".part"
+
 var (
-	ErrNotEnoughSpace = errors.New("the disk has run out of free space")
+	ErrNotEnoughSpace = fmt.Errorf("the disk has run out of free space: %w", ports.ErrStorageFull)
 )
 
 type Storage struct {
-	config *Config
-	logger *logger.Logger
+	config    *Config
+	logger    *logger.Logger
+	layout    *layout
+	layoutErr error
+	mu        sync.Mutex
+	// indexMu serialises the access to the export index
+	indexMu sync.Mutex
+	// sessionStart is the unix nano time of the session start, clips exported in the session may be
+	// still on the media and are not removed to make room
+	sessionStart atomic.Int64
 }
 
 func New(config *Config, logger *logger.Logger) *Storage {
+	l, err := newLayout(config.pathTemplate)
+
 	return &Storage{
-		config: config,
-		logger: logger,
+		config:    config,
+		logger:    logger,
+		layout:    l,
+		layoutErr: err,
+	}
+}
+
+func (s *Storage) availableBytes() (uint64, error) {
+	const op = "Storage.availableBytes"
+
+	fs := syscall.Statfs_t{}
+	err := syscall.Statfs(s.config.storageDir, &fs)
+	if err != nil {
+		return 0, s.errWrap(op, "syscall statfs", err)
 	}
+
+	// Bavail excludes blocks reserved for root, the exporter can not use them
+	return fs.Bavail * uint64(fs.Bsize), nil
 }
 
-func (s *Storage) checkFreeMemory() error {
+// checkFreeMemory makes sure the needed bytes fit on the disk and the configured minimum stays free,
+// the oldest clips are removed to make room if it is enabled
+func (s *Storage) checkFreeMemory(needed uint64) error {
 	const op = "Storage.checkFreeMemory"
 
 	log := s.logger.With(
@@ -36,19 +73,33 @@ func (s *Storage) checkFreeMemory() error {
 		slog.Any("config", s.config),
 	)
 
-	fs := syscall.Statfs_t{}
-	err := syscall.Statfs(s.config.storageDir, &fs)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	availableBytes, err := s.availableBytes()
 	if err != nil {
-		return s.errWrap(op, "syscall statfs", err)
+		return s.errWrap(op, "available bytes", err)
 	}
 
-	availableBytes := fs.Bfree * uint64(fs.Bsize)
 	availableGigaBytes := float64(availableBytes) / float64(1024*1024*1024)
 
-	log.Info(fmt.Sprintf("Free: %.2f Gb\n", availableGigaBytes))
+	log.Info(fmt.Sprintf("Free: %.2f Gb", availableGigaBytes))
+
+	required := needed + s.config.minFreeBytes
+	if availableBytes >= required {
+		return nil
+	}
+
+	if !s.config.retentionOnLowSpace {
+		return ErrNotEnoughSpace
+	}
+
+	freed, err := s.makeRoom(required - availableBytes)
+	if err != nil {
+		return s.errWrap(op, "make room", err)
+	}
 
-	//TODO: добавить в конфиг "10"
-	if availableBytes < 10 {
+	if availableBytes+freed < required {
 		return ErrNotEnoughSpace
 	}
 
@@ -56,34 +107,270 @@ func (s *Storage) checkFreeMemory() error {
 }
 
 func (s *Storage) SessionStart(ctx context.Context) error {
-	return s.checkFreeMemory()
+	const op = "Storage.SessionStart"
+
+	if s.layoutErr != nil {
+		return s.errWrap(op, "layout", s.layoutErr)
+	}
+
+	s.sessionStart.Store(time.Now().UnixNano())
+
+	err := s.cleanStaleParts()
+	if err != nil {
+		return s.errWrap(op, "clean stale parts", err)
+	}
+
+	err = s.applyRetention()
+	if err != nil {
+		return s.errWrap(op, "apply retention", err)
+	}
+
+	return s.checkFreeMemory(0)
+}
+
+// filepath returns the location of the file by the path template
+func (s *Storage) filepath(f *file.File) (string, error) {
+	const op = "Storage.filepath"
+
+	if s.layoutErr != nil {
+		return "", s.errWrap(op, "layout", s.layoutErr)
+	}
+
+	filepath, err := s.layout.path(s.config.storageDir, f)
+	if err != nil {
+		return "", s.errWrap(op, "layout path of "+f.Name, err)
+	}
+
+	return filepath, nil
+}
+
+// existing returns the committed copy of the file if there is one, otherwise the part file
+func (s *Storage) existing(f *file.File) (string, error) {
+	const op = "Storage.existing"
+
+	filepath, err := s.filepath(f)
+	if err != nil {
+		return "", s.errWrap(op, "filepath", err)
+	}
+
+	_, err = os.Stat(filepath)
+	if err == nil {
+		return filepath, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", s.errWrap(op, "os stat, path: "+filepath, err)
+	}
+
+	return s.layout.partPath(filepath, f), nil
+}
+
+// Size returns the length of the local copy of the file, zero when there is no local copy yet
+func (s *Storage) Size(f *file.File) (uint64, error) {
+	const op = "Storage.Size"
+
+	filepath, err := s.existing(f)
+	if err != nil {
+		return 0, s.errWrap(op, "existing", err)
+	}
+
+	info, err := os.Stat(filepath)
+
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, s.errWrap(op, "os stat, path: "+filepath, err)
+	}
+
+	return uint64(info.Size()), nil
 }
 
-func (s *Storage) GetWriter(f *file.File) (io.WriteCloser, error) {
+// GetWriter opens the part file of the file for writing from offset, everything after offset is discarded.
+// The part file is synced on close and gets the final name on Commit.
+func (s *Storage) GetWriter(f *file.File, offset uint64) (io.WriteCloser, error) {
 	const op = "Storage.GetWriter"
 
-	filepath := s.config.storageDir + "/" + f.Name
-	err := os.Remove(filepath)
+	filepath, err := s.filepath(f)
+	if err != nil {
+		return nil, s.errWrap(op, "filepath", err)
+	}
+
+	err = os.MkdirAll(path.Dir(filepath), 0755)
+	if err != nil {
+		return nil, s.errWrap(op, "os mkdir all, path: "+filepath, err)
+	}
 
-	if os.IsNotExist(err) || err == nil {
-		localFile, err := os.Create(filepath)
+	if offset < f.Size {
+		err = s.checkFreeMemory(f.Size - offset)
 		if err != nil {
-			return nil, s.errWrap(op, "os create, path: "+filepath, err)
+			return nil, s.errWrap(op, "check free memory for "+f.Name, err)
 		}
+	}
+
+	partPath := s.layout.partPath(filepath, f)
 
-		return localFile, nil
+	if offset > 0 {
+		if _, err := os.Stat(partPath); os.IsNotExist(err) {
+			// the copy is committed already, continue it in the part file
+			err = os.Rename(filepath, partPath)
+			if err != nil {
+				return nil, s.errWrap(op, "os rename, path: "+filepath, err)
+			}
+		}
+	}
+
+	localFile, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, s.errWrap(op, "os open file, path: "+partPath, err)
 	}
 
-	return nil, s.errWrap(op, "os remove, path: "+filepath, err)
+	err = localFile.Truncate(int64(offset))
+	if err != nil {
+		_ = localFile.Close()
+		return nil, s.errWrap(op, "truncate, path: "+partPath, err)
+	}
+
+	_, err = localFile.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		_ = localFile.Close()
+		return nil, s.errWrap(op, "seek, path: "+partPath, err)
+	}
+
+	return &writer{File: localFile}, nil
+}
+
+func (s *Storage) GetReader(f *file.File) (io.ReadCloser, error) {
+	const op = "Storage.GetReader"
+
+	filepath, err := s.existing(f)
+	if err != nil {
+		return nil, s.errWrap(op, "existing", err)
+	}
+
+	localFile, err := os.Open(filepath)
+	if err != nil {
+		return nil, s.errWrap(op, "os open, path: "+filepath, err)
+	}
+
+	return localFile, nil
 }
 
+// Commit moves the verified part file to its final name and returns the final location of the file.
+// The file is stamped with the capture time of the clip, so the layout recognises the copy,
+// the export time is kept in the export index for the retention.
+func (s *Storage) Commit(f *file.File) (string, error) {
+	const op = "Storage.Commit"
+
+	filepath, err := s.filepath(f)
+	if err != nil {
+		return "", s.errWrap(op, "filepath", err)
+	}
+
+	partPath := s.layout.partPath(filepath, f)
+
+	_, err = os.Stat(partPath)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath); err == nil {
+			s.layout.release(filepath)
+			return filepath, nil
+		}
+	}
+
+	err = os.Chtimes(partPath, f.Time, f.Time)
+	if err != nil {
+		return "", s.errWrap(op, "os chtimes, path: "+partPath, err)
+	}
+
+	err = os.Rename(partPath, filepath)
+	if err != nil {
+		return "", s.errWrap(op, "os rename, path: "+partPath, err)
+	}
+
+	err = syncDir(path.Dir(filepath))
+	if err != nil {
+		return "", s.errWrap(op, "sync dir, path: "+filepath, err)
+	}
+
+	s.layout.release(filepath)
+
+	err = s.recordExport(filepath, time.Now())
+	if err != nil {
+		return "", s.errWrap(op, "record export", err)
+	}
+
+	return filepath, nil
+}
+
+// Delete removes the local copy of the file, both committed and part
 func (s *Storage) Delete(f *file.File) error {
 	const op = "Storage.Delete"
 
-	filepath := s.config.storageDir + "/" + f.Name
-	err := os.Remove(filepath)
+	filepath, err := s.filepath(f)
+	if err != nil {
+		return s.errWrap(op, "filepath", err)
+	}
+
+	removed := false
+
+	for _, p := range []string{filepath, s.layout.partPath(filepath, f)} {
+		err = os.Remove(p)
+		if err == nil {
+			removed = true
+			continue
+		}
+
+		if !os.IsNotExist(err) {
+			return s.errWrap(op, "os remove, path: "+p, err)
+		}
+	}
+
+	if !removed {
+		return s.errWrap(op, "os remove, path: "+filepath, os.ErrNotExist)
+	}
+
+	s.layout.release(filepath)
+
+	return nil
+}
+
+// cleanStaleParts removes part files which have not been written for the stale timeout,
+// the download of those files is abandoned and nothing resumes them
+func (s *Storage) cleanStaleParts() error {
+	const op = "Storage.cleanStaleParts"
+
+	log := s.logger.With(
+		slog.String("op", op),
+	)
+
+	staleBefore := time.Now().Add(-s.config.stalePartTimeout)
+
+	err := filepath.WalkDir(s.config.storageDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !strings.HasSuffix(d.Name(), partSuffix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.ModTime().After(staleBefore) {
+			return nil
+		}
+
+		log.Info("Remove stale part file: " + p)
+
+		return os.Remove(p)
+	})
+
 	if err != nil {
-		return s.errWrap(op, "os remove, path: "+filepath, err)
+		return s.errWrap(op, "walk storage dir", err)
 	}
 
 	return nil
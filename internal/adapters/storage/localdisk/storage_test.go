@@ -5,53 +5,113 @@ import (
 	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
 	"testing"
 	"time"
 )
 
-func TestStorage_SessionStart(t *testing.T) {
-	storage := New(NewConfig(), logger.New(logger.EnvTest))
+// newTestConfig returns the config of a storage in a temp dir, the free space and the retention settings
+// of the environment do not apply
+func newTestConfig(t *testing.T) *Config {
+	config := NewConfig()
+	config.storageDir = t.TempDir()
+	config.encodedDir = ""
+	config.pathTemplate = defaultPathTemplate
+	config.minFreeBytes = 0
+	config.retentionMaxAge = 0
+	config.retentionMaxBytes = 0
+	config.retentionEncodedOnly = false
+	config.retentionOnLowSpace = false
 
-	storage.config.storageDir = "./"
+	return config
+}
+
+func TestStorage_SessionStart(t *testing.T) {
+	storage := New(newTestConfig(t), logger.New(logger.EnvTest))
 
 	err := storage.SessionStart(context.Background())
 	assert.Nil(t, err)
 }
 
 func TestStorage_GetWriter(t *testing.T) {
-	storage := New(NewConfig(), logger.New(logger.EnvTest))
+	config := newTestConfig(t)
 
-	storage.config.storageDir = "."
+	storage := New(config, logger.New(logger.EnvTest))
 
-	filePath := "./test_write.file"
+	// the part file is tagged with the capture time and the size of the clip
+	filePath := config.storageDir + "/test_write.file.1685786462.12.part"
 	fileContent := "some content"
 
 	f := file.New(
 		"test_write.file",
 		"./",
-		time.Now(),
+		time.Unix(1685786462, 0),
 		uint64(len(fileContent)),
 	)
 
-	wc, err := storage.GetWriter(f)
+	wc, err := storage.GetWriter(f, 0)
 	assert.Nil(t, err)
 
 	w, err := wc.Write([]byte(fileContent))
 
 	assert.Nil(t, err)
 	assert.Equal(t, len(fileContent), w)
+	assert.Nil(t, wc.Close())
 
-	err = os.Remove(filePath)
+	_, err = os.Stat(filePath)
 	assert.Nil(t, err)
 }
 
+func TestStorage_GetWriterFromOffset(t *testing.T) {
+	storage := New(newTestConfig(t), logger.New(logger.EnvTest))
+
+	fileContent := "some content"
+
+	f := file.New(
+		"test_resume.file",
+		"./",
+		time.Now(),
+		uint64(len(fileContent)),
+	)
+
+	size, err := storage.Size(f)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), size)
+
+	wc, err := storage.GetWriter(f, 0)
+	assert.Nil(t, err)
+
+	_, err = wc.Write([]byte(fileContent[:5] + "garbage"))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	wc, err = storage.GetWriter(f, 5)
+	assert.Nil(t, err)
+
+	_, err = wc.Write([]byte(fileContent[5:]))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	size, err = storage.Size(f)
+	assert.Nil(t, err)
+	assert.Equal(t, f.Size, size)
+
+	rc, err := storage.GetReader(f)
+	assert.Nil(t, err)
+
+	content, err := io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, fileContent, string(content))
+	assert.Nil(t, rc.Close())
+}
+
 func TestStorage_Delete(t *testing.T) {
-	storage := New(NewConfig(), logger.New(logger.EnvTest))
+	config := newTestConfig(t)
 
-	storage.config.storageDir = "."
+	storage := New(config, logger.New(logger.EnvTest))
 
-	filePath := "./test_delete.file"
+	filePath := config.storageDir + "/test_delete.file"
 	fileContent := "some content"
 
 	_ = os.WriteFile(filePath, []byte(fileContent), 0644)
@@ -65,4 +125,262 @@ func TestStorage_Delete(t *testing.T) {
 
 	err := storage.Delete(f)
 	assert.Nil(t, err)
+
+	_, err = os.Stat(filePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStorage_PathTemplate(t *testing.T) {
+	config := newTestConfig(t)
+	config.pathTemplate = `{{.Time.Format "2006/01-02"}}/{{.Camera}}/{{.Name}}`
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	captureTime := time.Date(2023, 6, 3, 10, 0, 0, 0, time.Local)
+
+	f := file.New("YDXJ0001.MP4", "100MEDIA", captureTime, 3)
+	f.Camera = "yi4kplus"
+
+	wc, err := storage.GetWriter(f, 0)
+	assert.Nil(t, err)
+	_, err = wc.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	location, err := storage.Commit(f)
+	assert.Nil(t, err)
+	assert.Equal(t, config.storageDir+"/2023/06-03/yi4kplus/YDXJ0001.MP4", location)
+
+	_, err = os.Stat(config.storageDir + "/2023/06-03/yi4kplus/YDXJ0001.MP4")
+	assert.Nil(t, err)
+
+	// the counter of the camera is reset, a new clip has the same name
+	collision := file.New("YDXJ0001.MP4", "100MEDIA", captureTime.Add(time.Hour), 5)
+	collision.Camera = "yi4kplus"
+
+	size, err := storage.Size(collision)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), size)
+
+	wc, err = storage.GetWriter(collision, 0)
+	assert.Nil(t, err)
+	_, err = wc.Write([]byte("abcde"))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	_, err = storage.Commit(collision)
+	assert.Nil(t, err)
+
+	_, err = os.Stat(config.storageDir + "/2023/06-03/yi4kplus/YDXJ0001_1.MP4")
+	assert.Nil(t, err)
+
+	size, err = storage.Size(f)
+	assert.Nil(t, err)
+	assert.Equal(t, f.Size, size)
+
+	size, err = storage.Size(collision)
+	assert.Nil(t, err)
+	assert.Equal(t, collision.Size, size)
+}
+
+func TestStorage_PathTemplateSameNameClips(t *testing.T) {
+	config := newTestConfig(t)
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	captureTime := time.Date(2023, 6, 3, 10, 0, 0, 0, time.Local)
+
+	first := file.New("YDXJ0001.MP4", "100MEDIA", captureTime, 3)
+	second := file.New("YDXJ0001.MP4", "101MEDIA", captureTime.Add(time.Hour), 5)
+
+	// both clips are downloaded at the same time, the paths are resolved before any file is written
+	size, err := storage.Size(first)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), size)
+
+	size, err = storage.Size(second)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), size)
+
+	firstWriter, err := storage.GetWriter(first, 0)
+	assert.Nil(t, err)
+	secondWriter, err := storage.GetWriter(second, 0)
+	assert.Nil(t, err)
+
+	_, err = firstWriter.Write([]byte("abc"))
+	assert.Nil(t, err)
+	_, err = secondWriter.Write([]byte("abcde"))
+	assert.Nil(t, err)
+	assert.Nil(t, firstWriter.Close())
+	assert.Nil(t, secondWriter.Close())
+
+	secondLocation, err := storage.Commit(second)
+	assert.Nil(t, err)
+	assert.Equal(t, config.storageDir+"/YDXJ0001_1.MP4", secondLocation)
+
+	firstLocation, err := storage.Commit(first)
+	assert.Nil(t, err)
+	assert.Equal(t, config.storageDir+"/YDXJ0001.MP4", firstLocation)
+
+	content, err := os.ReadFile(firstLocation)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(content))
+
+	content, err = os.ReadFile(secondLocation)
+	assert.Nil(t, err)
+	assert.Equal(t, "abcde", string(content))
+}
+
+func TestStorage_PathTemplateForeignPart(t *testing.T) {
+	config := newTestConfig(t)
+
+	captureTime := time.Date(2023, 6, 3, 10, 0, 0, 0, time.Local)
+
+	first := file.New("YDXJ0001.MP4", "100MEDIA", captureTime, 3)
+	second := file.New("YDXJ0001.MP4", "101MEDIA", captureTime.Add(time.Hour), 5)
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	wc, err := storage.GetWriter(first, 0)
+	assert.Nil(t, err)
+	_, err = wc.Write([]byte("ab"))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	// after a restart the part file of the first clip is not reused by the second one
+	storage = New(config, logger.New(logger.EnvTest))
+
+	size, err := storage.Size(second)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), size)
+
+	size, err = storage.Size(first)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), size)
+
+	wc, err = storage.GetWriter(second, 0)
+	assert.Nil(t, err)
+	_, err = wc.Write([]byte("abcde"))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	location, err := storage.Commit(second)
+	assert.Nil(t, err)
+	assert.Equal(t, config.storageDir+"/YDXJ0001_1.MP4", location)
+}
+
+func TestStorage_PathTemplateSameSecondClips(t *testing.T) {
+	config := newTestConfig(t)
+
+	captureTime := time.Date(2023, 6, 3, 10, 0, 0, 0, time.Local)
+
+	first := file.New("YDXJ0001.MP4", "100MEDIA", captureTime, 3)
+	second := file.New("YDXJ0001.MP4", "101MEDIA", captureTime, 5)
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	wc, err := storage.GetWriter(first, 0)
+	assert.Nil(t, err)
+	_, err = wc.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	_, err = storage.Commit(first)
+	assert.Nil(t, err)
+
+	// after a restart the copy of the first clip is told apart from the second clip by the size
+	storage = New(config, logger.New(logger.EnvTest))
+
+	size, err := storage.Size(second)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), size)
+
+	wc, err = storage.GetWriter(second, 0)
+	assert.Nil(t, err)
+	_, err = wc.Write([]byte("abcde"))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	location, err := storage.Commit(second)
+	assert.Nil(t, err)
+	assert.Equal(t, config.storageDir+"/YDXJ0001_1.MP4", location)
+
+	content, err := os.ReadFile(config.storageDir + "/YDXJ0001.MP4")
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(content))
+
+	storage = New(config, logger.New(logger.EnvTest))
+
+	size, err = storage.Size(first)
+	assert.Nil(t, err)
+	assert.Equal(t, first.Size, size)
+}
+
+func TestStorage_PathTemplateOutsideStorage(t *testing.T) {
+	config := newTestConfig(t)
+	config.pathTemplate = `../{{.Name}}`
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	_, err := storage.GetWriter(file.New("YDXJ0001.MP4", "100MEDIA", time.Now(), 3), 0)
+	assert.ErrorIs(t, err, ErrPathOutsideStorage)
+}
+
+func TestStorage_Commit(t *testing.T) {
+	config := newTestConfig(t)
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	fileContent := "some content"
+	f := file.New("test_commit.file", "./", time.Now(), uint64(len(fileContent)))
+
+	wc, err := storage.GetWriter(f, 0)
+	assert.Nil(t, err)
+	_, err = wc.Write([]byte(fileContent))
+	assert.Nil(t, err)
+	assert.Nil(t, wc.Close())
+
+	_, err = os.Stat(config.storageDir + "/test_commit.file")
+	assert.True(t, os.IsNotExist(err))
+
+	size, err := storage.Size(f)
+	assert.Nil(t, err)
+	assert.Equal(t, f.Size, size)
+
+	location, err := storage.Commit(f)
+	assert.Nil(t, err)
+	assert.Equal(t, config.storageDir+"/test_commit.file", location)
+
+	_, err = os.Stat(storage.layout.partPath(location, f))
+	assert.True(t, os.IsNotExist(err))
+
+	// commit is idempotent
+	_, err = storage.Commit(f)
+	assert.Nil(t, err)
+
+	assert.Nil(t, storage.Delete(f))
+}
+
+func TestStorage_SessionStartCleansStaleParts(t *testing.T) {
+	config := newTestConfig(t)
+
+	storage := New(config, logger.New(logger.EnvTest))
+
+	stalePath := config.storageDir + "/stale.file.part"
+	freshPath := config.storageDir + "/fresh.file.part"
+
+	assert.Nil(t, os.WriteFile(stalePath, []byte("stale"), 0644))
+	assert.Nil(t, os.WriteFile(freshPath, []byte("fresh"), 0644))
+
+	staleTime := time.Now().Add(-config.stalePartTimeout - time.Hour)
+	assert.Nil(t, os.Chtimes(stalePath, staleTime, staleTime))
+
+	err := storage.SessionStart(context.Background())
+	assert.Nil(t, err)
+
+	_, err = os.Stat(stalePath)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = os.Stat(freshPath)
+	assert.Nil(t, err)
 }
@@ -0,0 +1,36 @@
+package localdisk
+
+import (
+	"os"
+)
+
+// writer flushes the file to the disk on close
+type writer struct {
+	*os.File
+}
+
+func (w *writer) Close() error {
+	err := w.File.Sync()
+	if err != nil {
+		_ = w.File.Close()
+		return err
+	}
+
+	return w.File.Close()
+}
+
+// syncDir flushes the directory entry, so a rename survives a power loss
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if err != nil {
+		_ = d.Close()
+		return err
+	}
+
+	return d.Close()
+}
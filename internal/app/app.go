@@ -1,17 +1,25 @@
 package app
 
 import (
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/encoder/ffmpeg"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/journal/logfile"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/amba"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/ftp"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/media/yi4kplus/telnet"
+	"github.com/ffonord/yi4kplus-video-export/internal/adapters/queue/jsonfile"
 	"github.com/ffonord/yi4kplus-video-export/internal/adapters/storage/localdisk"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/event"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/services/filehandler"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/services/mediaexporter"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/eventbus"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 )
 
+// eventBufferSize is the number of events a subscriber may lag behind, the file handler rescans storage for lost ones
+const eventBufferSize = 256
+
 type App struct {
 	MediaExporter *mediaexporter.MediaExporter
 	FileHandler   *filehandler.FileHandler
@@ -32,20 +40,36 @@ func New(env string) *App {
 	telnetClient := telnet.New(telnetConfig, log, telnetTCPConnFactory, telnetBufioReaderFactory)
 
 	ftpConfig := ftp.NewConfig()
-	ftpConnFactory := new(ftp.FTPConnFactory)
+	ftpConnFactory := &ftp.FTPConnFactory{Logger: log}
 	ftpClient := ftp.New(ftpConfig, log, ftpConnFactory)
 
-	mediaDevice := yi4kplus.New(ambaClient, ftpClient, telnetClient)
+	mediaDeviceConfig := yi4kplus.NewConfig()
+	mediaDevice := yi4kplus.NewMedia(mediaDeviceConfig, log, ambaClient, ftpClient, telnetClient)
 
 	storageConfig := localdisk.NewConfig()
 	storage := localdisk.New(storageConfig, log)
 
-	me := mediaexporter.New(mediaDevice, storage, log)
+	journalConfig := logfile.NewConfig()
+	exportJournal := logfile.New(journalConfig, log)
+
+	bus := eventbus.New[event.Event]()
+
+	mediaExporterConfig := mediaexporter.NewConfig()
+	me := mediaexporter.New(mediaExporterConfig, mediaDevice, storage, exportJournal, bus, log)
+
+	ffmpegConfig := ffmpeg.NewConfig()
+	ffmpegClient := ffmpeg.New(ffmpegConfig, log)
+
+	encoders := map[string]ports.Encoder{
+		"ffmpeg": ffmpegClient,
+	}
 
-	encoders := map[string]ports.Encoder{}
+	queueConfig := jsonfile.NewConfig()
+	encodingQueue := jsonfile.New(queueConfig, log)
 
 	fileHandlerConfig := filehandler.NewConfig()
-	fh := filehandler.New(fileHandlerConfig, log, encoders)
+	fileHandlerEvents := bus.Subscribe(eventBufferSize)
+	fh := filehandler.New(fileHandlerConfig, log, encodingQueue, encoders, fileHandlerEvents.C)
 
 	return &App{
 		MediaExporter: me,
@@ -0,0 +1,12 @@
+package camera
+
+// Status is the state of the camera before the export
+type Status struct {
+	// BatteryLevel is the charge in percent
+	BatteryLevel int
+	// ExternalPower is true when the camera is powered by usb
+	ExternalPower bool
+	FreeBytes     uint64
+	TotalBytes    uint64
+	Recording     bool
+}
@@ -0,0 +1,60 @@
+package encoding
+
+import "time"
+
+// Status is a state of the encoding job
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Job is the encoding of one stored file by one encoder
+type Job struct {
+	ID      string
+	Encoder string
+	SrcPath string
+	// DstPath is the output location without extension, the encoder adds the extension of its format
+	DstPath    string
+	OutputPath string
+	Priority   int
+	Status     Status
+	Attempts   int
+	Error      string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Result describes the output of the finished job
+type Result struct {
+	Path     string
+	Size     uint64
+	Duration time.Duration
+}
+
+func New(
+	encoder string,
+	srcPath string,
+	dstPath string,
+	priority int,
+	time time.Time,
+) *Job {
+	return &Job{
+		ID:        Key(encoder, srcPath),
+		Encoder:   encoder,
+		SrcPath:   srcPath,
+		DstPath:   dstPath,
+		Priority:  priority,
+		Status:    StatusQueued,
+		CreatedAt: time,
+		UpdatedAt: time,
+	}
+}
+
+// Key identifies the job, a file is encoded once by every encoder
+func Key(encoder, srcPath string) string {
+	return encoder + ":" + srcPath
+}
@@ -0,0 +1,48 @@
+package event
+
+import (
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"time"
+)
+
+// Event is a fact of the export published to subscribers
+type Event interface {
+	EventName() string
+}
+
+// FileDiscovered is published when a new media group is found on the camera
+type FileDiscovered struct {
+	File *file.File
+	Time time.Time
+}
+
+// FileDownloaded is published when every file of the group is transferred and checked, before it is committed to storage
+type FileDownloaded struct {
+	File *file.File
+	Time time.Time
+}
+
+// FileVerified is published when the group is committed to storage, Location is the stored primary file
+type FileVerified struct {
+	File     *file.File
+	Location string
+	Time     time.Time
+}
+
+// FileDeletedOnCamera is published when the group is removed from the camera
+type FileDeletedOnCamera struct {
+	File *file.File
+	Time time.Time
+}
+
+// SessionEnded is published when the export session is over, Err is the failure of the session if any
+type SessionEnded struct {
+	Err  error
+	Time time.Time
+}
+
+func (FileDiscovered) EventName() string      { return "file_discovered" }
+func (FileDownloaded) EventName() string      { return "file_downloaded" }
+func (FileVerified) EventName() string        { return "file_verified" }
+func (FileDeletedOnCamera) EventName() string { return "file_deleted_on_camera" }
+func (SessionEnded) EventName() string        { return "session_ended" }
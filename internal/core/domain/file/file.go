@@ -1,12 +1,23 @@
 package file
 
-import "time"
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
 
+// SidecarExtensions are companion files the camera writes next to the clip with the same base name
+var SidecarExtensions = []string{".SEC", ".THM", ".LRV"}
+
+// File is a media group: the primary clip and its sidecars
 type File struct {
-	Name string
-	Path string
-	Time time.Time
-	Size uint64
+	Name     string
+	Path     string
+	Time     time.Time
+	Size     uint64
+	Camera   string
+	Sidecars []*File
 }
 
 func New(
@@ -22,3 +33,57 @@ func New(
 		Size: size,
 	}
 }
+
+// Ext returns the upper-cased extension of the file name, e.g. ".MP4"
+func (f *File) Ext() string {
+	return strings.ToUpper(path.Ext(f.Name))
+}
+
+// IsSidecar reports whether the file is a companion of a clip
+func (f *File) IsSidecar() bool {
+	for _, ext := range SidecarExtensions {
+		if f.Ext() == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Files returns the primary file followed by its sidecars
+func (f *File) Files() []*File {
+	return append([]*File{f}, f.Sidecars...)
+}
+
+// Group joins files of the same directory and base name into media groups.
+// A group without a primary clip is headed by one of its sidecars.
+func Group(files []*File) []*File {
+	members := map[string][]*File{}
+	keys := make([]string, 0)
+
+	for _, f := range files {
+		key := f.Path + "/" + strings.TrimSuffix(f.Name, path.Ext(f.Name))
+
+		if _, ok := members[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		members[key] = append(members[key], f)
+	}
+
+	groups := make([]*File, 0, len(keys))
+
+	for _, key := range keys {
+		group := members[key]
+
+		sort.SliceStable(group, func(a, b int) bool {
+			return !group[a].IsSidecar() && group[b].IsSidecar()
+		})
+
+		primary := group[0]
+		primary.Sidecars = group[1:]
+		groups = append(groups, primary)
+	}
+
+	return groups
+}
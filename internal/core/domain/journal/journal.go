@@ -0,0 +1,39 @@
+package journal
+
+import (
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"time"
+)
+
+// Stage is a step of the file export, stages follow each other in order of declaration
+type Stage string
+
+const (
+	StageDiscovered  Stage = "discovered"
+	StageDownloading Stage = "downloading"
+	StageVerified    Stage = "verified"
+	StageDeleted     Stage = "deleted"
+)
+
+type Entry struct {
+	File  *file.File
+	Stage Stage
+	Time  time.Time
+}
+
+func New(
+	f *file.File,
+	stage Stage,
+	time time.Time,
+) *Entry {
+	return &Entry{
+		File:  f,
+		Stage: stage,
+		Time:  time,
+	}
+}
+
+// Key identifies the file on the media device
+func Key(f *file.File) string {
+	return f.Path + "/" + f.Name
+}
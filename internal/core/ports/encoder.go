@@ -1,7 +1,11 @@
 package ports
 
-import "context"
+import (
+	"context"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/encoding"
+)
 
 type Encoder interface {
-	Encode(ctx context.Context, dstDirName, srcDirName string) error
+	// Encode encodes the source file of the job, the output is visible only when encoding succeeds
+	Encode(ctx context.Context, job *encoding.Job) (*encoding.Result, error)
 }
@@ -0,0 +1,12 @@
+package ports
+
+import "errors"
+
+var (
+	// ErrNotFound is returned by adapters when the file does not exist
+	ErrNotFound = errors.New("file not found")
+	// ErrStorageFull is returned by storage adapters when there is no space left for the file
+	ErrStorageFull = errors.New("storage is full")
+	// ErrNotSupported is returned by adapters when the device can not do the operation
+	ErrNotSupported = errors.New("operation is not supported")
+)
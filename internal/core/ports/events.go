@@ -0,0 +1,8 @@
+package ports
+
+import "github.com/ffonord/yi4kplus-video-export/internal/core/domain/event"
+
+type Publisher interface {
+	// Publish delivers the event to subscribers without waiting for them to handle it
+	Publish(e event.Event)
+}
@@ -0,0 +1,11 @@
+package ports
+
+import (
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/journal"
+)
+
+type Journal interface {
+	Record(f *file.File, stage journal.Stage) error
+	Pending() ([]*journal.Entry, error)
+}
@@ -2,13 +2,21 @@ package ports
 
 import (
 	"context"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/camera"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
 	"io"
 )
 
 type Media interface {
 	SessionStart(ctx context.Context) error
-	GetFiles(ctx context.Context) (<-chan *file.File, error)
-	GetReader(f *file.File) (io.ReadCloser, error)
+	// GetFiles sends the media groups of the device, the error channel gets at most one error
+	// of the listing and is closed after the file channel
+	GetFiles(ctx context.Context) (<-chan *file.File, <-chan error, error)
+	GetReader(f *file.File, offset uint64) (io.ReadCloser, error)
 	Delete(f *file.File) error
+	Checksum(ctx context.Context, f *file.File) (string, error)
+	// Status returns battery, power and card state of the device, it is called before SessionStart
+	Status(ctx context.Context) (*camera.Status, error)
+	// PowerOff switches the device off and returns when it is gone from the network
+	PowerOff(ctx context.Context) error
 }
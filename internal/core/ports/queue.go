@@ -0,0 +1,14 @@
+package ports
+
+import "github.com/ffonord/yi4kplus-video-export/internal/core/domain/encoding"
+
+type JobQueue interface {
+	// Enqueue adds the job, a job with the same id which is already known is left as is
+	Enqueue(job *encoding.Job) error
+	// Dequeue marks the queued job with the highest priority as running and returns it, nil when nothing is queued
+	Dequeue() (*encoding.Job, error)
+	// Update saves the status of the job
+	Update(job *encoding.Job) error
+	// Retry queues failed jobs with less than maxAttempts attempts again and returns their number
+	Retry(maxAttempts int) (int, error)
+}
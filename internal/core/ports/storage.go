@@ -8,6 +8,9 @@ import (
 
 type Storage interface {
 	SessionStart(ctx context.Context) error
-	GetWriter(f *file.File) (io.WriteCloser, error)
+	Size(f *file.File) (uint64, error)
+	GetWriter(f *file.File, offset uint64) (io.WriteCloser, error)
+	GetReader(f *file.File) (io.ReadCloser, error)
+	Commit(f *file.File) (string, error)
 	Delete(f *file.File) error
 }
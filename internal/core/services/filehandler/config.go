@@ -3,26 +3,102 @@ package filehandler
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Mode is the way new files of the storage dir are found besides the exporter events
+type Mode string
+
+const (
+	ModePoll  Mode = "poll"
+	ModeWatch Mode = "watch"
+)
+
 type Config struct {
-	storageDir     string
-	encodedDir     string
-	pollingMinutes time.Duration
+	storageDir      string
+	encodedDir      string
+	pollingMinutes  time.Duration
+	inputExtensions []string
+	concurrency     int
+	maxAttempts     int
+	priorities      map[string]int
+	mode            Mode
+	watchDebounce   time.Duration
 }
 
 func NewConfig() *Config {
 	pollingMinutes := time.Minute * 2
 	rawPollingMinutes := os.Getenv("FILE_HANDLER_POLLING_MINUTES")
 
-	if i, err := strconv.Atoi(rawPollingMinutes); err == nil {
+	if i, err := strconv.Atoi(rawPollingMinutes); err == nil && i > 0 {
 		pollingMinutes = time.Minute * time.Duration(i)
 	}
 
+	inputExtensions := []string{".MP4"}
+	rawInputExtensions := os.Getenv("FILE_HANDLER_INPUT_EXTENSIONS")
+
+	if rawInputExtensions != "" {
+		inputExtensions = inputExtensions[:0]
+		for _, ext := range strings.Split(rawInputExtensions, ",") {
+			inputExtensions = append(inputExtensions, "."+strings.ToUpper(strings.TrimPrefix(strings.TrimSpace(ext), ".")))
+		}
+	}
+
+	concurrency := 1
+	rawConcurrency := os.Getenv("FILE_HANDLER_CONCURRENCY")
+
+	if i, err := strconv.Atoi(rawConcurrency); err == nil && i > 0 {
+		concurrency = i
+	}
+
+	// a failed job is retried on the next rescan until it has run maxAttempts times
+	maxAttempts := 3
+	rawMaxAttempts := os.Getenv("FILE_HANDLER_MAX_ATTEMPTS")
+
+	if i, err := strconv.Atoi(rawMaxAttempts); err == nil && i > 0 {
+		maxAttempts = i
+	}
+
+	mode := ModePoll
+	if Mode(os.Getenv("FILE_HANDLER_MODE")) == ModeWatch {
+		mode = ModeWatch
+	}
+
+	watchDebounce := time.Second * 2
+	rawWatchDebounce := os.Getenv("FILE_HANDLER_WATCH_DEBOUNCE_SECONDS")
+
+	if i, err := strconv.Atoi(rawWatchDebounce); err == nil && i > 0 {
+		watchDebounce = time.Second * time.Duration(i)
+	}
+
 	return &Config{
-		storageDir:     os.Getenv("LOCAL_STORAGE_DIR"),
-		encodedDir:     os.Getenv("LOCAL_ENCODED_DIR"),
-		pollingMinutes: pollingMinutes,
+		storageDir:      os.Getenv("LOCAL_STORAGE_DIR"),
+		encodedDir:      os.Getenv("LOCAL_ENCODED_DIR"),
+		pollingMinutes:  pollingMinutes,
+		inputExtensions: inputExtensions,
+		concurrency:     concurrency,
+		maxAttempts:     maxAttempts,
+		priorities:      parsePriorities(os.Getenv("FILE_HANDLER_ENCODER_PRIORITIES")),
+		mode:            mode,
+		watchDebounce:   watchDebounce,
 	}
 }
+
+// parsePriorities parses a list like "ffmpeg:10,other:0", jobs of encoders with higher priority run first
+func parsePriorities(raw string) map[string]int {
+	priorities := map[string]int{}
+
+	for _, item := range strings.Split(raw, ",") {
+		name, rawPriority, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found {
+			continue
+		}
+
+		if i, err := strconv.Atoi(rawPriority); err == nil {
+			priorities[name] = i
+		}
+	}
+
+	return priorities
+}
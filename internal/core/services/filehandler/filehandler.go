@@ -3,58 +3,412 @@ package filehandler
 import (
 	"context"
 	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/encoding"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/event"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/fswatch"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"io/fs"
 	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+const partSuffix = ".part"
+
 type FileHandler struct {
 	config   *Config
 	logger   *logger.Logger
+	queue    ports.JobQueue
 	encoders map[string]ports.Encoder
+	events   <-chan event.Event
 }
 
-func New(config *Config, logger *logger.Logger, encoders map[string]ports.Encoder) *FileHandler {
+func New(
+	config *Config,
+	logger *logger.Logger,
+	queue ports.JobQueue,
+	encoders map[string]ports.Encoder,
+	events <-chan event.Event,
+) *FileHandler {
 	return &FileHandler{
 		config:   config,
 		logger:   logger,
+		queue:    queue,
 		encoders: encoders,
+		events:   events,
 	}
 }
 
-func (fe *FileHandler) Run(ctx context.Context) {
+// Run queues encoding jobs for files verified by the exporter as soon as the event arrives.
+// Files which came from elsewhere are found by a rescan of the storage dir every polling period
+// or, in watch mode, as soon as they are completely written; watch falls back to polling if it fails.
+// Failed jobs are retried on every rescan until they run out of attempts, then they stay failed.
+// The queue is processed in the background, running encoders are waited for so they can stop cleanly.
+func (fe *FileHandler) Run(ctx context.Context) error {
 	const op = "FileHandler.Run"
 
 	log := fe.logger.With(
 		slog.String("op", op),
 	)
 
+	trigger := make(chan struct{}, 1)
 	wg := &sync.WaitGroup{}
+	wg.Add(1)
 
-	for {
-		for name, encoder := range fe.encoders {
-			wg.Add(1)
+	go func() {
+		defer wg.Done()
 
-			go func(encoder ports.Encoder, name string) {
-				defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+				fe.ProcessQueue(ctx)
+			}
+		}
+	}()
 
-				err := encoder.Encode(ctx, fe.config.storageDir, fe.config.encodedDir)
+	rescan := func() {
+		err := fe.retryFailed()
+		if err != nil {
+			log.Error(err.Error())
+		}
 
-				if err != nil {
-					log.Error(fmt.Errorf("failed encode file with %s-encoder, err: %w", name, err).Error())
-				}
-			}(encoder, name)
+		err = fe.EnqueueFiles()
+		if err != nil {
+			log.Error(err.Error())
 		}
 
-		wg.Wait()
+		fe.notify(trigger)
+	}
+
+	rescan()
+
+	// the ticker is created only for polling, watch mode starts it when the watch fails
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+
+	startPolling := func() {
+		ticker = time.NewTicker(fe.config.pollingMinutes)
+		tick = ticker.C
+	}
+
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	watched := make(chan string)
+	watchErr := make(chan error, 1)
+
+	if fe.config.mode == ModeWatch {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			watchErr <- fe.watch(ctx, watched)
+		}()
+	} else {
+		startPolling()
+	}
+
+	events := fe.events
 
+	for {
 		select {
 		case <-ctx.Done():
+			wg.Wait()
 			log.Info(fmt.Sprintf("Success stop %s", op))
-			return
-		case <-time.After(fe.config.pollingMinutes):
+			return ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				// the subscription is closed, rely on rescans only
+				events = nil
+				continue
+			}
+
+			fe.handleEvent(e, trigger)
+		case p := <-watched:
+			// an empty path means the watch lost events
+			if p == "" {
+				rescan()
+				continue
+			}
+
+			if !fe.isSource(p) {
+				continue
+			}
+
+			err := fe.enqueueFile(p)
+			if err != nil {
+				log.Error(err.Error())
+				continue
+			}
+
+			fe.notify(trigger)
+		case err := <-watchErr:
+			if err != nil {
+				log.Error("Watch failed, fall back to polling: " + err.Error())
+				startPolling()
+			}
+		case <-tick:
+			rescan()
+		}
+	}
+}
+
+// watch sends completely written files of the storage dir to the channel until the context is done
+func (fe *FileHandler) watch(ctx context.Context, watched chan<- string) error {
+	const op = "FileHandler.watch"
+
+	send := func(p string) {
+		select {
+		case watched <- p:
+		case <-ctx.Done():
+		}
+	}
+
+	err := fswatch.Watch(ctx, fe.config.storageDir, fe.config.watchDebounce, send, func() {
+		send("")
+	})
+	if err != nil {
+		return fe.errWrap(op, "fswatch watch", err)
+	}
+
+	return nil
+}
+
+func (fe *FileHandler) handleEvent(e event.Event, trigger chan struct{}) {
+	const op = "FileHandler.handleEvent"
+
+	log := fe.logger.With(
+		slog.String("op", op),
+		slog.String("event", e.EventName()),
+	)
+
+	verified, ok := e.(event.FileVerified)
+	if !ok || verified.Location == "" || !fe.isSource(verified.Location) {
+		return
+	}
+
+	err := fe.enqueueFile(verified.Location)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	fe.notify(trigger)
+}
+
+// notify wakes the queue processing up, a wake-up which is already pending is enough
+func (fe *FileHandler) notify(trigger chan struct{}) {
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+// retryFailed queues failed jobs again which have attempts left
+func (fe *FileHandler) retryFailed() error {
+	const op = "FileHandler.retryFailed"
+
+	retried, err := fe.queue.Retry(fe.config.maxAttempts)
+	if err != nil {
+		return fe.errWrap(op, "retry", err)
+	}
+
+	if retried > 0 {
+		fe.logger.With(
+			slog.String("op", op),
+		).Info(fmt.Sprintf("Retry %d failed jobs", retried))
+	}
+
+	return nil
+}
+
+// EnqueueFiles queues a job of every encoder for every media file of the storage dir
+func (fe *FileHandler) EnqueueFiles() error {
+	const op = "FileHandler.EnqueueFiles"
+
+	srcFiles, err := fe.sourceFiles()
+	if err != nil {
+		return fe.errWrap(op, "source files", err)
+	}
+
+	for _, srcFile := range srcFiles {
+		err = fe.enqueueFile(srcFile)
+		if err != nil {
+			return fe.errWrap(op, "enqueue file", err)
+		}
+	}
+
+	return nil
+}
+
+// enqueueFile queues a job of every encoder for the stored file
+func (fe *FileHandler) enqueueFile(srcFile string) error {
+	const op = "FileHandler.enqueueFile"
+
+	relPath, err := filepath.Rel(fe.config.storageDir, srcFile)
+	if err != nil {
+		return fe.errWrap(op, "rel path, path: "+srcFile, err)
+	}
+
+	dstPath := filepath.Join(fe.config.encodedDir, strings.TrimSuffix(relPath, filepath.Ext(relPath)))
+
+	names := make([]string, 0, len(fe.encoders))
+	for name := range fe.encoders {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		job := encoding.New(name, srcFile, dstPath, fe.config.priorities[name], time.Now())
+
+		err = fe.queue.Enqueue(job)
+		if err != nil {
+			return fe.errWrap(op, "enqueue job "+job.ID, err)
 		}
 	}
+
+	return nil
+}
+
+// ProcessQueue runs queued jobs with the configured concurrency until the queue is empty or the context is done
+func (fe *FileHandler) ProcessQueue(ctx context.Context) {
+	const op = "FileHandler.ProcessQueue"
+
+	log := fe.logger.With(
+		slog.String("op", op),
+	)
+
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < fe.config.concurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for ctx.Err() == nil {
+				job, err := fe.queue.Dequeue()
+				if err != nil {
+					log.Error(err.Error())
+					return
+				}
+
+				if job == nil {
+					return
+				}
+
+				err = fe.handle(ctx, job)
+				if err != nil {
+					log.Error(err.Error())
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (fe *FileHandler) handle(ctx context.Context, job *encoding.Job) error {
+	const op = "FileHandler.handle"
+
+	log := fe.logger.With(
+		slog.String("op", op),
+		slog.String("job", job.ID),
+	)
+
+	encoder, ok := fe.encoders[job.Encoder]
+	if !ok {
+		job.Status = encoding.StatusFailed
+		job.Error = "unknown encoder " + job.Encoder
+		return fe.update(job)
+	}
+
+	result, err := encoder.Encode(ctx, job)
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// the job is interrupted by the shutdown and is resumed on the next run
+		job.Status = encoding.StatusQueued
+	case err != nil:
+		log.Error(fmt.Errorf("failed encode file with %s-encoder, attempt %d of %d, err: %w",
+			job.Encoder, job.Attempts, fe.config.maxAttempts, err).Error())
+		// the job is retried on the next rescan, the last attempt leaves it failed for good
+		job.Status = encoding.StatusFailed
+		job.Error = err.Error()
+	default:
+		log.Info(fmt.Sprintf("Success encode to %s, %d bytes in %s", result.Path, result.Size, result.Duration))
+		job.Status = encoding.StatusDone
+		job.OutputPath = result.Path
+		job.Error = ""
+	}
+
+	return fe.update(job)
+}
+
+func (fe *FileHandler) update(job *encoding.Job) error {
+	const op = "FileHandler.update"
+
+	err := fe.queue.Update(job)
+	if err != nil {
+		return fe.errWrap(op, "update job "+job.ID, err)
+	}
+
+	return nil
+}
+
+// sourceFiles returns media files of the storage dir, part files and hidden files are skipped
+func (fe *FileHandler) sourceFiles() ([]string, error) {
+	files := make([]string, 0)
+
+	err := filepath.WalkDir(fe.config.storageDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() && fe.isSource(p) {
+			files = append(files, p)
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+// isSource reports whether the file should be encoded, part files and hidden files are skipped
+func (fe *FileHandler) isSource(p string) bool {
+	name := filepath.Base(p)
+
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, partSuffix) {
+		return false
+	}
+
+	return fe.isMedia(name)
+}
+
+func (fe *FileHandler) isMedia(name string) bool {
+	ext := strings.ToUpper(filepath.Ext(name))
+
+	for _, inputExtension := range fe.config.inputExtensions {
+		if ext == inputExtension {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fe *FileHandler) errWrap(methodName, message string, err error) error {
+	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
 }
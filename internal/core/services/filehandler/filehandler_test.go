@@ -0,0 +1,442 @@
+package filehandler
+
+import (
+	"context"
+	"errors"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/encoding"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/event"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQueue keeps jobs in memory with the semantics of the queue port
+type fakeQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*encoding.Job
+	retries int
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{jobs: map[string]*encoding.Job{}}
+}
+
+func (q *fakeQueue) Enqueue(job *encoding.Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.jobs[job.ID]; !ok {
+		c := *job
+		q.jobs[job.ID] = &c
+	}
+
+	return nil
+}
+
+func (q *fakeQueue) Dequeue() (*encoding.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var next *encoding.Job
+
+	for _, job := range q.jobs {
+		if job.Status != encoding.StatusQueued {
+			continue
+		}
+
+		if next == nil || job.Priority > next.Priority ||
+			job.Priority == next.Priority && job.CreatedAt.Before(next.CreatedAt) {
+			next = job
+		}
+	}
+
+	if next == nil {
+		return nil, nil
+	}
+
+	next.Status = encoding.StatusRunning
+	next.Attempts++
+
+	c := *next
+	return &c, nil
+}
+
+func (q *fakeQueue) Update(job *encoding.Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c := *job
+	q.jobs[job.ID] = &c
+
+	return nil
+}
+
+func (q *fakeQueue) Retry(maxAttempts int) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.retries++
+	retried := 0
+
+	for _, job := range q.jobs {
+		if job.Status == encoding.StatusFailed && job.Attempts < maxAttempts {
+			job.Status = encoding.StatusQueued
+			retried++
+		}
+	}
+
+	return retried, nil
+}
+
+func (q *fakeQueue) job(id string) *encoding.Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil
+	}
+
+	c := *job
+	return &c
+}
+
+// rescans returns the number of rescans, every rescan retries failed jobs first
+func (q *fakeQueue) rescans() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.retries
+}
+
+func (q *fakeQueue) ids() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := make([]string, 0, len(q.jobs))
+	for id := range q.jobs {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// fakeEncoder records encoded jobs, encode decides the outcome, nil encodes successfully
+type fakeEncoder struct {
+	mu     sync.Mutex
+	calls  []string
+	encode func(ctx context.Context, job *encoding.Job) error
+}
+
+func (e *fakeEncoder) Encode(ctx context.Context, job *encoding.Job) (*encoding.Result, error) {
+	e.mu.Lock()
+	e.calls = append(e.calls, job.ID)
+	encode := e.encode
+	e.mu.Unlock()
+
+	if encode != nil {
+		err := encode(ctx, job)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &encoding.Result{Path: job.DstPath + ".mp4", Size: 1}, nil
+}
+
+func (e *fakeEncoder) called() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]string(nil), e.calls...)
+}
+
+func newTestConfig(t *testing.T) *Config {
+	config := NewConfig()
+	config.storageDir = t.TempDir()
+	config.encodedDir = t.TempDir()
+	config.pollingMinutes = time.Hour
+	config.inputExtensions = []string{".MP4"}
+	config.concurrency = 1
+	config.maxAttempts = 3
+	config.priorities = map[string]int{}
+	config.mode = ModePoll
+
+	return config
+}
+
+func newTestFileHandler(config *Config, queue *fakeQueue, encoders map[string]*fakeEncoder, events <-chan event.Event) *FileHandler {
+	portEncoders := make(map[string]ports.Encoder, len(encoders))
+	for name, encoder := range encoders {
+		portEncoders[name] = encoder
+	}
+
+	return New(config, logger.New(logger.EnvTest), queue, portEncoders, events)
+}
+
+func writeSource(t *testing.T, p string) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+	assert.Nil(t, os.WriteFile(p, []byte("video"), 0644))
+}
+
+func TestFileHandler_HandleEvent(t *testing.T) {
+	config := newTestConfig(t)
+	queue := newFakeQueue()
+	fe := newTestFileHandler(config, queue, map[string]*fakeEncoder{"ffmpeg": {}, "other": {}}, nil)
+
+	trigger := make(chan struct{}, 1)
+	src := filepath.Join(config.storageDir, "2026", "a.MP4")
+
+	// only verified media files are queued
+	fe.handleEvent(event.FileDownloaded{Time: time.Now()}, trigger)
+	fe.handleEvent(event.FileVerified{Location: src + partSuffix}, trigger)
+	fe.handleEvent(event.FileVerified{Location: filepath.Join(config.storageDir, "a.LRV")}, trigger)
+	fe.handleEvent(event.FileVerified{}, trigger)
+
+	assert.Empty(t, queue.ids())
+	assert.Len(t, trigger, 0)
+
+	fe.handleEvent(event.FileVerified{Location: src}, trigger)
+
+	// a job for every encoder and a wake-up of the queue processing
+	assert.Equal(t, []string{encoding.Key("ffmpeg", src), encoding.Key("other", src)}, queue.ids())
+	assert.Len(t, trigger, 1)
+	assert.Equal(t, filepath.Join(config.encodedDir, "2026", "a"), queue.job(encoding.Key("ffmpeg", src)).DstPath)
+}
+
+func TestFileHandler_RunEncodesVerifiedFile(t *testing.T) {
+	config := newTestConfig(t)
+	queue := newFakeQueue()
+	encoder := &fakeEncoder{}
+	events := make(chan event.Event)
+	fe := newTestFileHandler(config, queue, map[string]*fakeEncoder{"ffmpeg": encoder}, events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- fe.Run(ctx)
+	}()
+
+	// the file is not on disk, so only the event can queue it
+	src := filepath.Join(config.storageDir, "a.MP4")
+	events <- event.FileVerified{Location: src, Time: time.Now()}
+
+	id := encoding.Key("ffmpeg", src)
+
+	assert.Eventually(t, func() bool {
+		job := queue.job(id)
+		return job != nil && job.Status == encoding.StatusDone
+	}, time.Second, time.Millisecond*10)
+
+	assert.Equal(t, []string{id}, encoder.called())
+	assert.Equal(t, filepath.Join(config.encodedDir, "a.mp4"), queue.job(id).OutputPath)
+
+	cancel()
+
+	assert.ErrorIs(t, <-runErr, context.Canceled)
+}
+
+func TestFileHandler_ProcessQueue(t *testing.T) {
+	config := newTestConfig(t)
+	config.priorities = map[string]int{"fast": 10}
+
+	queue := newFakeQueue()
+
+	var order []string
+	fast := &fakeEncoder{
+		encode: func(ctx context.Context, job *encoding.Job) error {
+			order = append(order, "fast")
+			return nil
+		},
+	}
+	broken := &fakeEncoder{
+		encode: func(ctx context.Context, job *encoding.Job) error {
+			order = append(order, "broken")
+			return errors.New("encoder crashed")
+		},
+	}
+
+	fe := newTestFileHandler(config, queue, map[string]*fakeEncoder{"fast": fast, "broken": broken}, nil)
+
+	src := filepath.Join(config.storageDir, "a.MP4")
+	writeSource(t, src)
+
+	assert.Nil(t, fe.EnqueueFiles())
+
+	fe.ProcessQueue(context.Background())
+
+	// the job of the encoder with higher priority runs first
+	assert.Equal(t, []string{"fast", "broken"}, order)
+
+	done := queue.job(encoding.Key("fast", src))
+	assert.Equal(t, encoding.StatusDone, done.Status)
+	assert.Equal(t, filepath.Join(config.encodedDir, "a.mp4"), done.OutputPath)
+
+	failed := queue.job(encoding.Key("broken", src))
+	assert.Equal(t, encoding.StatusFailed, failed.Status)
+	assert.Equal(t, "encoder crashed", failed.Error)
+	assert.Equal(t, 1, failed.Attempts)
+}
+
+func TestFileHandler_ProcessQueueConcurrency(t *testing.T) {
+	config := newTestConfig(t)
+	config.concurrency = 2
+
+	queue := newFakeQueue()
+
+	// both jobs have to run at the same time to pass the barrier
+	barrier := &sync.WaitGroup{}
+	barrier.Add(2)
+
+	encoder := &fakeEncoder{
+		encode: func(ctx context.Context, job *encoding.Job) error {
+			barrier.Done()
+
+			waited := make(chan struct{})
+			go func() {
+				barrier.Wait()
+				close(waited)
+			}()
+
+			select {
+			case <-waited:
+				return nil
+			case <-time.After(time.Second):
+				return errors.New("jobs run one by one")
+			}
+		},
+	}
+
+	fe := newTestFileHandler(config, queue, map[string]*fakeEncoder{"ffmpeg": encoder}, nil)
+
+	writeSource(t, filepath.Join(config.storageDir, "a.MP4"))
+	writeSource(t, filepath.Join(config.storageDir, "b.MP4"))
+
+	assert.Nil(t, fe.EnqueueFiles())
+
+	fe.ProcessQueue(context.Background())
+
+	for _, id := range queue.ids() {
+		assert.Equal(t, encoding.StatusDone, queue.job(id).Status)
+	}
+}
+
+func TestFileHandler_RetryFailedJob(t *testing.T) {
+	config := newTestConfig(t)
+	config.maxAttempts = 2
+
+	queue := newFakeQueue()
+	encoder := &fakeEncoder{
+		encode: func(ctx context.Context, job *encoding.Job) error {
+			return errors.New("encoder crashed")
+		},
+	}
+
+	fe := newTestFileHandler(config, queue, map[string]*fakeEncoder{"ffmpeg": encoder}, nil)
+
+	src := filepath.Join(config.storageDir, "a.MP4")
+	writeSource(t, src)
+
+	id := encoding.Key("ffmpeg", src)
+
+	assert.Nil(t, fe.EnqueueFiles())
+
+	// a failed job is not retried in the same pass
+	fe.ProcessQueue(context.Background())
+
+	assert.Len(t, encoder.called(), 1)
+	assert.Equal(t, encoding.StatusFailed, queue.job(id).Status)
+
+	// the rescan retries it
+	assert.Nil(t, fe.retryFailed())
+	assert.Equal(t, encoding.StatusQueued, queue.job(id).Status)
+
+	fe.ProcessQueue(context.Background())
+
+	assert.Len(t, encoder.called(), 2)
+	assert.Equal(t, 2, queue.job(id).Attempts)
+
+	// out of attempts, the job stays failed and the file is not queued again
+	assert.Nil(t, fe.retryFailed())
+	assert.Nil(t, fe.EnqueueFiles())
+
+	fe.ProcessQueue(context.Background())
+
+	assert.Len(t, encoder.called(), 2)
+	assert.Equal(t, encoding.StatusFailed, queue.job(id).Status)
+}
+
+func TestFileHandler_InterruptedJobQueuedAgain(t *testing.T) {
+	config := newTestConfig(t)
+	queue := newFakeQueue()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	encoder := &fakeEncoder{
+		encode: func(ctx context.Context, job *encoding.Job) error {
+			cancel()
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+
+	fe := newTestFileHandler(config, queue, map[string]*fakeEncoder{"ffmpeg": encoder}, nil)
+
+	src := filepath.Join(config.storageDir, "a.MP4")
+	writeSource(t, src)
+
+	assert.Nil(t, fe.EnqueueFiles())
+
+	fe.ProcessQueue(ctx)
+
+	// the shutdown is not a failure, the job is resumed on the next run
+	job := queue.job(encoding.Key("ffmpeg", src))
+	assert.Equal(t, encoding.StatusQueued, job.Status)
+	assert.Empty(t, job.Error)
+}
+
+func TestFileHandler_WatchFallsBackToPolling(t *testing.T) {
+	config := newTestConfig(t)
+	// the watch of a missing dir fails
+	config.storageDir = filepath.Join(t.TempDir(), "videos")
+	config.mode = ModeWatch
+	config.pollingMinutes = time.Millisecond * 10
+
+	queue := newFakeQueue()
+	encoder := &fakeEncoder{}
+	fe := newTestFileHandler(config, queue, map[string]*fakeEncoder{"ffmpeg": encoder}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- fe.Run(ctx)
+	}()
+
+	// the first rescan runs on start, the next ones are ticks of the polling
+	assert.Eventually(t, func() bool {
+		return queue.rescans() > 1
+	}, time.Second, time.Millisecond*10)
+
+	src := filepath.Join(config.storageDir, "a.MP4")
+	writeSource(t, src)
+
+	// the file is found by polling
+	assert.Eventually(t, func() bool {
+		job := queue.job(encoding.Key("ffmpeg", src))
+		return job != nil && job.Status == encoding.StatusDone
+	}, time.Second, time.Millisecond*10)
+
+	cancel()
+
+	assert.ErrorIs(t, <-runErr, context.Canceled)
+}
@@ -0,0 +1,123 @@
+package mediaexporter
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SidecarPolicy describes what to do with a sidecar of the clip
+type SidecarPolicy string
+
+const (
+	// SidecarKeep exports the sidecar with the clip and deletes it on media
+	SidecarKeep SidecarPolicy = "keep"
+	// SidecarSkip leaves the sidecar on media untouched
+	SidecarSkip SidecarPolicy = "skip"
+	// SidecarDelete deletes the sidecar on media together with the clip without export
+	SidecarDelete SidecarPolicy = "delete"
+)
+
+type Config struct {
+	workers        int
+	maxAttempts    int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	verifyOnMedia  bool
+	sidecarPolicy  map[string]SidecarPolicy
+	// powerOffWhenDone switches the camera off when the session finds nothing to export
+	powerOffWhenDone bool
+	// minBatteryLevel postpones the export while the camera is on battery with less charge in percent, zero disables it
+	minBatteryLevel int
+}
+
+func NewConfig() *Config {
+	workers := 1
+	rawWorkers := os.Getenv("MEDIA_EXPORTER_WORKERS")
+
+	if i, err := strconv.Atoi(rawWorkers); err == nil && i > 0 {
+		workers = i
+	}
+
+	maxAttempts := 5
+	rawMaxAttempts := os.Getenv("MEDIA_EXPORTER_MAX_ATTEMPTS")
+
+	if i, err := strconv.Atoi(rawMaxAttempts); err == nil && i > 0 {
+		maxAttempts = i
+	}
+
+	retryBaseDelay := time.Second * 2
+	rawRetryBaseDelay := os.Getenv("MEDIA_EXPORTER_RETRY_BASE_DELAY_SECONDS")
+
+	if i, err := strconv.Atoi(rawRetryBaseDelay); err == nil && i > 0 {
+		retryBaseDelay = time.Second * time.Duration(i)
+	}
+
+	retryMaxDelay := time.Minute * 1
+	rawRetryMaxDelay := os.Getenv("MEDIA_EXPORTER_RETRY_MAX_DELAY_SECONDS")
+
+	if i, err := strconv.Atoi(rawRetryMaxDelay); err == nil && i > 0 {
+		retryMaxDelay = time.Second * time.Duration(i)
+	}
+
+	verifyOnMedia := false
+	rawVerifyOnMedia := os.Getenv("MEDIA_EXPORTER_VERIFY_ON_MEDIA")
+
+	if b, err := strconv.ParseBool(rawVerifyOnMedia); err == nil {
+		verifyOnMedia = b
+	}
+
+	powerOffWhenDone := false
+	rawPowerOffWhenDone := os.Getenv("MEDIA_EXPORTER_POWER_OFF_WHEN_DONE")
+
+	if b, err := strconv.ParseBool(rawPowerOffWhenDone); err == nil {
+		powerOffWhenDone = b
+	}
+
+	minBatteryLevel := 0
+	rawMinBatteryLevel := os.Getenv("MEDIA_EXPORTER_MIN_BATTERY_PERCENT")
+
+	if i, err := strconv.Atoi(rawMinBatteryLevel); err == nil && i > 0 {
+		minBatteryLevel = i
+	}
+
+	return &Config{
+		workers:          workers,
+		maxAttempts:      maxAttempts,
+		retryBaseDelay:   retryBaseDelay,
+		retryMaxDelay:    retryMaxDelay,
+		verifyOnMedia:    verifyOnMedia,
+		sidecarPolicy:    parseSidecarPolicy(os.Getenv("MEDIA_EXPORTER_SIDECAR_POLICY")),
+		powerOffWhenDone: powerOffWhenDone,
+		minBatteryLevel:  minBatteryLevel,
+	}
+}
+
+// parseSidecarPolicy parses a list like "SEC:delete,THM:skip,LRV:keep", unknown policies are ignored
+func parseSidecarPolicy(raw string) map[string]SidecarPolicy {
+	policy := map[string]SidecarPolicy{}
+
+	for _, item := range strings.Split(raw, ",") {
+		ext, rawPolicy, found := strings.Cut(strings.TrimSpace(item), ":")
+		if !found {
+			continue
+		}
+
+		switch p := SidecarPolicy(strings.ToLower(rawPolicy)); p {
+		case SidecarKeep, SidecarSkip, SidecarDelete:
+			policy["."+strings.ToUpper(strings.TrimPrefix(ext, "."))] = p
+		}
+	}
+
+	return policy
+}
+
+// policyFor returns the policy for the sidecar extension, sidecars are kept by default
+func (c *Config) policyFor(ext string) SidecarPolicy {
+	if p, ok := c.sidecarPolicy[ext]; ok {
+		return p
+	}
+
+	return SidecarKeep
+}
@@ -0,0 +1,41 @@
+package mediaexporter
+
+import (
+	"errors"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
+	"os"
+	"syscall"
+)
+
+var (
+	// ErrLowBattery postpones the export until the camera is charged or plugged in
+	ErrLowBattery = errors.New("camera battery is low")
+	// ErrRecording postpones the export until the camera stops recording
+	ErrRecording = errors.New("camera is recording")
+	// ErrChecksumMismatch means the local copy differs from the file on media, it is retried like a transfer hiccup
+	// and poisoned when it keeps failing, so a broken file is not downloaded over and over
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// errorClass tells the exporter how to react on a failed export of the file
+type errorClass int
+
+const (
+	// errorTransient is a network or device hiccup, the export is retried
+	errorTransient errorClass = iota
+	// errorStorageFull stops the session, other files will not fit too
+	errorStorageFull
+	// errorPermanent will not go away on retry, the file goes to the poison list
+	errorPermanent
+)
+
+func classify(err error) errorClass {
+	switch {
+	case errors.Is(err, ports.ErrStorageFull), errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return errorStorageFull
+	case errors.Is(err, ports.ErrNotFound), errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission):
+		return errorPermanent
+	default:
+		return errorTransient
+	}
+}
@@ -1,27 +1,62 @@
 package mediaexporter
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/event"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/journal"
 	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/backoff"
 	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
 	"io"
 	"log/slog"
+	"sort"
+	"sync"
 	"time"
 )
 
+// job is a media group with its last journal entry, if any
+type job struct {
+	group *file.File
+	entry *journal.Entry
+	known bool
+}
+
 type MediaExporter struct {
+	config         *Config
 	mediaAdapter   ports.Media
 	storageAdapter ports.Storage
+	journal        ports.Journal
+	publisher      ports.Publisher
 	logger         *logger.Logger
+	backoff        *backoff.Backoff
+	mu             sync.Mutex
+	poisoned       map[string]error
 }
 
-func New(media ports.Media, storage ports.Storage, logger *logger.Logger) *MediaExporter {
+func New(
+	config *Config,
+	media ports.Media,
+	storage ports.Storage,
+	journal ports.Journal,
+	publisher ports.Publisher,
+	logger *logger.Logger,
+) *MediaExporter {
 	return &MediaExporter{
+		config:         config,
 		mediaAdapter:   media,
 		storageAdapter: storage,
+		journal:        journal,
+		publisher:      publisher,
 		logger:         logger,
+		backoff:        backoff.New(config.retryBaseDelay, config.retryMaxDelay),
+		poisoned:       map[string]error{},
 	}
 }
 
@@ -46,15 +81,28 @@ func (e *MediaExporter) Run(ctx context.Context, surveyPeriod, delayPeriod time.
 		if err == nil {
 			waitTime = delayPeriod
 		} else {
-			log.Info(errors.Unwrap(err).Error())
+			log.Info(err.Error())
 		}
 
-		time.Sleep(waitTime)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitTime):
+		}
 	}
 }
 
+// ExportFiles runs the export session and publishes its end to subscribers
 func (e *MediaExporter) ExportFiles(ctx context.Context) error {
-	const op = "MediaExporter.ExportFiles"
+	err := e.exportFiles(ctx)
+
+	e.publisher.Publish(event.SessionEnded{Err: err, Time: time.Now()})
+
+	return err
+}
+
+func (e *MediaExporter) exportFiles(ctx context.Context) error {
+	const op = "MediaExporter.exportFiles"
 
 	log := e.logger.With(
 		slog.String("op", op),
@@ -63,7 +111,13 @@ func (e *MediaExporter) ExportFiles(ctx context.Context) error {
 	ffCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	err := e.mediaAdapter.SessionStart(ffCtx)
+	// the status is checked before the session starts the transfer stack on the camera
+	err := e.checkStatus(ffCtx)
+	if err != nil {
+		return e.errWrap(op, "check camera status", err)
+	}
+
+	err = e.mediaAdapter.SessionStart(ffCtx)
 	if err != nil {
 		return e.errWrap(op, "media adapter session start", err)
 	}
@@ -73,58 +127,588 @@ func (e *MediaExporter) ExportFiles(ctx context.Context) error {
 		return e.errWrap(op, "storage adapter session start", err)
 	}
 
-	fileChan, err := e.mediaAdapter.GetFiles(ffCtx)
+	err = e.replay()
+	if err != nil {
+		return e.errWrap(op, "journal replay", err)
+	}
+
+	pending, err := e.pendingEntries()
+	if err != nil {
+		return e.errWrap(op, "journal pending entries", err)
+	}
+
+	fileChan, listErrChan, err := e.mediaAdapter.GetFiles(ffCtx)
 	if err != nil {
 		return e.errWrap(op, "media adapter get files", err)
 	}
 
-	for f := range fileChan {
+	jobChan := make(chan *job)
+	errChan := make(chan error)
+	wg := &sync.WaitGroup{}
+
+	for worker := 0; worker < e.config.workers; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			workerLog := log.With(slog.Int("worker", worker))
+
+			for j := range jobChan {
+				err := e.exportWithRetry(ffCtx, j)
+				if err == nil {
+					continue
+				}
+
+				workerLog.Error(err.Error())
+
+				if classify(err) == errorStorageFull {
+					cancel()
+				}
+
+				errChan <- err
+			}
+		}(worker)
+	}
+
+	go func() {
+		wg.Wait()
+		close(errChan)
+	}()
+
+	// found counts the groups left to export and poisoned the ones of them which wait for a restart,
+	// they are written by the dispatcher only and read after the workers are done
+	found := 0
+	poisoned := 0
+
+	go func() {
+		defer close(jobChan)
+
+		for f := range fileChan {
+			if e.needsExport(f) {
+				found++
+
+				if e.poisonedErr(journal.Key(f)) != nil {
+					poisoned++
+				}
+			}
+
+			entry, known := pending[journal.Key(f)]
+			delete(pending, journal.Key(f))
+
+			jobChan <- &job{group: f, entry: entry, known: known}
+		}
+	}()
+
+	var errs []error
+	for err := range errChan {
+		errs = append(errs, err)
+	}
+
+	// the listing is complete only without an error, a partial one must not forget journal entries or power off
+	listErr := <-listErrChan
+	if listErr != nil && ffCtx.Err() == nil {
+		errs = append(errs, e.errWrap(op, "media adapter list files", listErr))
+	}
+
+	if len(errs) > 0 {
+		return e.errWrap(op, "export files", errors.Join(errs...))
+	}
+
+	if ffCtx.Err() != nil {
+		return nil
+	}
+
+	// files left in the journal are gone from the camera, they were deleted before the journal got the record
+	for _, entry := range pending {
+		log.Info(fmt.Sprintf("File %s with stage %s is missing on media, forget it", entry.File.Name, entry.Stage))
 
-		dstFileWriter, err := e.storageAdapter.GetWriter(f)
+		err = e.journal.Record(entry.File, journal.StageDeleted)
 		if err != nil {
-			return e.errWrap(op, "storage adapter get writer", err)
+			return e.errWrap(op, "journal record deleted", err)
 		}
+	}
+
+	if found > 0 && e.config.powerOffWhenDone {
+		log.Info(fmt.Sprintf("%d groups left on media, %d of them poisoned until restart, keep the camera on", found, poisoned))
+	}
 
-		srcFileReader, err := e.mediaAdapter.GetReader(f)
+	// the listing finished without an error here, so nothing found means nothing left
+	if found == 0 && e.config.powerOffWhenDone {
+		log.Info("Nothing left to export on media, power off")
+
+		err = e.mediaAdapter.PowerOff(ffCtx)
 		if err != nil {
-			return e.errWrap(op, "media adapter get reader", err)
+			return e.errWrap(op, "media adapter power off", err)
 		}
 
-		log.Info("Start download: " + f.Name)
+		log.Info("Success power off")
+	}
 
-		written, err := io.Copy(dstFileWriter, srcFileReader)
+	return nil
+}
+
+// checkStatus postpones the export while the camera records or runs on low battery,
+// the battery check is skipped if it is disabled and the whole check if the camera can not report the status
+func (e *MediaExporter) checkStatus(ctx context.Context) error {
+	const op = "MediaExporter.checkStatus"
+
+	log := e.logger.With(
+		slog.String("op", op),
+	)
+
+	status, err := e.mediaAdapter.Status(ctx)
+	if err != nil {
+		log.Info("Camera status is unknown, export anyway: " + err.Error())
+		return nil
+	}
+
+	log.Info(fmt.Sprintf(
+		"Camera status: battery %d%%, external power %t, card free %d of %d bytes, recording %t",
+		status.BatteryLevel,
+		status.ExternalPower,
+		status.FreeBytes,
+		status.TotalBytes,
+		status.Recording,
+	))
+
+	if status.Recording {
+		return e.errWrap(op, "check recording", ErrRecording)
+	}
+
+	if e.config.minBatteryLevel > 0 && !status.ExternalPower && status.BatteryLevel < e.config.minBatteryLevel {
+		return e.errWrap(op, fmt.Sprintf("check battery %d%% of %d%%", status.BatteryLevel, e.config.minBatteryLevel), ErrLowBattery)
+	}
+
+	return nil
+}
+
+// exportWithRetry retries transient failures of the group export with backoff,
+// groups which fail permanently or run out of attempts go to the poison list and are skipped until restart
+func (e *MediaExporter) exportWithRetry(ctx context.Context, j *job) error {
+	const op = "MediaExporter.exportWithRetry"
+
+	log := e.logger.With(
+		slog.String("op", op),
+	)
+
+	key := journal.Key(j.group)
+
+	if err := e.poisonedErr(key); err != nil {
+		log.Info("Skip poisoned file: " + j.group.Name)
+		return nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := e.exportGroup(ctx, j)
+		if err == nil {
+			return nil
+		}
+
+		switch classify(err) {
+		case errorStorageFull:
+			return e.errWrap(op, "export "+j.group.Name, err)
+		case errorPermanent:
+			e.poison(key, err)
+			return e.errWrap(op, "export "+j.group.Name+", poisoned", err)
+		}
+
+		if attempt >= e.config.maxAttempts {
+			e.poison(key, err)
+			return e.errWrap(op, fmt.Sprintf("export %s, poisoned after %d attempts", j.group.Name, attempt), err)
+		}
+
+		log.Info(fmt.Sprintf("Export %s attempt %d failed, retry: %s", j.group.Name, attempt, err.Error()))
+
+		if ctxErr := e.backoff.Wait(ctx, attempt); ctxErr != nil {
+			return e.errWrap(op, "export "+j.group.Name, err)
+		}
+	}
+}
+
+func (e *MediaExporter) poison(key string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.poisoned[key] = err
+}
+
+func (e *MediaExporter) poisonedErr(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.poisoned[key]
+}
+
+// exportGroup downloads, verifies and deletes on media the group of the job
+func (e *MediaExporter) exportGroup(ctx context.Context, j *job) error {
+	const op = "MediaExporter.exportGroup"
+
+	log := e.logger.With(
+		slog.String("op", op),
+	)
+
+	f := j.group
+
+	transfer, deleteOnly := e.split(f)
+	if len(transfer) == 0 && len(deleteOnly) == 0 {
+		return nil
+	}
+
+	if !j.known {
+		err := e.journal.Record(f, journal.StageDiscovered)
 		if err != nil {
-			return e.errWrap(op, "io copy "+f.Path, err)
+			return e.errWrap(op, "journal record discovered "+f.Name, err)
 		}
 
-		err = srcFileReader.Close()
+		j.known = true
+		j.entry = journal.New(f, journal.StageDiscovered, time.Now())
+
+		e.publisher.Publish(event.FileDiscovered{File: f, Time: j.entry.Time})
+	}
+
+	if j.entry.Stage != journal.StageVerified {
+		verified, err := e.downloadGroup(ctx, f, transfer)
 		if err != nil {
-			return e.errWrap(op, "media adapter reader close", err)
+			return e.errWrap(op, "download group "+f.Name, err)
+		}
+
+		if !verified {
+			return nil
+		}
+
+		j.entry = journal.New(f, journal.StageVerified, time.Now())
+	}
+
+	err := e.deleteOnMedia(f)
+	if err != nil {
+		return e.errWrap(op, "delete on media "+f.Name, err)
+	}
+
+	log.Info("Success pop file: " + f.Name)
+
+	return nil
+}
+
+// needsExport reports whether the group is left to export, groups whose files are all skipped by the sidecar policy
+// are never exported. Poisoned groups are left too: they are skipped until a restart but still are on media.
+func (e *MediaExporter) needsExport(group *file.File) bool {
+	transfer, deleteOnly := e.split(group)
+
+	return len(transfer) > 0 || len(deleteOnly) > 0
+}
+
+// split divides the media group by sidecar policy into files to export and files to delete on media only
+func (e *MediaExporter) split(group *file.File) (transfer, deleteOnly []*file.File) {
+	for _, f := range group.Files() {
+		policy := SidecarKeep
+		if f.IsSidecar() {
+			policy = e.config.policyFor(f.Ext())
 		}
 
-		err = dstFileWriter.Close()
+		switch policy {
+		case SidecarKeep:
+			transfer = append(transfer, f)
+		case SidecarDelete:
+			deleteOnly = append(deleteOnly, f)
+		}
+	}
+
+	return transfer, deleteOnly
+}
+
+// downloadGroup transfers every file of the group and commits them to storage when all of them are complete and verified
+func (e *MediaExporter) downloadGroup(ctx context.Context, group *file.File, transfer []*file.File) (bool, error) {
+	const op = "MediaExporter.downloadGroup"
+
+	log := e.logger.With(
+		slog.String("op", op),
+	)
+
+	err := e.journal.Record(group, journal.StageDownloading)
+	if err != nil {
+		return false, e.errWrap(op, "journal record downloading", err)
+	}
+
+	for _, f := range transfer {
+		verified, err := e.download(ctx, f)
 		if err != nil {
-			return e.errWrap(op, "storage adapter writer close", err)
+			return false, e.errWrap(op, "download "+f.Name, err)
 		}
 
-		if uint64(written) == f.Size {
-			err := e.mediaAdapter.Delete(f)
-			if err != nil {
-				return e.errWrap(op, "media adapter delete", err)
-			}
+		if !verified {
+			return false, nil
+		}
+	}
 
-			log.Info("Success pop file: " + f.Name)
-		} else {
-			err := e.storageAdapter.Delete(f)
-			if err != nil {
-				return e.errWrap(op, "storage adapter delete", err)
-			}
+	e.publisher.Publish(event.FileDownloaded{File: group, Time: time.Now()})
+
+	groupLocation := ""
+
+	for _, f := range transfer {
+		location, err := e.storageAdapter.Commit(f)
+		if err != nil {
+			return false, e.errWrap(op, "storage adapter commit "+f.Name, err)
+		}
+
+		if f == group {
+			groupLocation = location
+		}
+
+		log.Info("Stored file: " + location)
+	}
+
+	err = e.journal.Record(group, journal.StageVerified)
+	if err != nil {
+		return false, e.errWrap(op, "journal record verified", err)
+	}
+
+	e.publisher.Publish(event.FileVerified{File: group, Location: groupLocation, Time: time.Now()})
+
+	return true, nil
+}
+
+// download resumes or starts the transfer of the file, it reports whether the local copy is complete and verified,
+// a copy which fails the verification is deleted and ErrChecksumMismatch is returned
+func (e *MediaExporter) download(ctx context.Context, f *file.File) (bool, error) {
+	const op = "MediaExporter.download"
+
+	log := e.logger.With(
+		slog.String("op", op),
+	)
+
+	offset, err := e.storageAdapter.Size(f)
+	if err != nil {
+		return false, e.errWrap(op, "storage adapter size", err)
+	}
+
+	if offset > f.Size {
+		log.Info("Local copy is larger than source, restart download: " + f.Name)
+		offset = 0
+	}
+
+	streamHash := sha256.New()
+	mediaHash := md5.New()
+	hashWriter := io.Writer(streamHash)
+
+	if e.config.verifyOnMedia {
+		hashWriter = io.MultiWriter(streamHash, mediaHash)
+	}
+
+	if offset > 0 {
+		err = e.hashLocal(f, offset, hashWriter)
+		if err != nil {
+			return false, e.errWrap(op, "hash downloaded part", err)
+		}
+	}
+
+	written := int64(0)
+
+	if offset < f.Size {
+		written, err = e.transfer(f, offset, hashWriter)
+		if err != nil {
+			return false, e.errWrap(op, "transfer", err)
+		}
+	}
+
+	if offset+uint64(written) != f.Size {
+		log.Info(fmt.Sprintf("Partial download: %s %d of %d bytes, resume next session", f.Name, offset+uint64(written), f.Size))
+		return false, nil
+	}
+
+	verified, err := e.verify(ctx, f, streamHash.Sum(nil), hex.EncodeToString(mediaHash.Sum(nil)))
+	if err != nil {
+		return false, e.errWrap(op, "verify", err)
+	}
+
+	if !verified {
+		err = e.storageAdapter.Delete(f)
+		if err != nil {
+			return false, e.errWrap(op, "storage adapter delete", err)
+		}
+
+		log.Info("Checksum mismatch, local copy is deleted: " + f.Name)
+		return false, e.errWrap(op, "verify "+f.Name, ErrChecksumMismatch)
+	}
+
+	return true, nil
+}
+
+// transfer copies the file from media to storage starting at offset, the copied bytes are written to the hash too
+func (e *MediaExporter) transfer(f *file.File, offset uint64, hash io.Writer) (written int64, err error) {
+	const op = "MediaExporter.transfer"
+
+	log := e.logger.With(
+		slog.String("op", op),
+	)
+
+	dstFileWriter, err := e.storageAdapter.GetWriter(f, offset)
+	if err != nil {
+		return 0, e.errWrap(op, "storage adapter get writer", err)
+	}
+
+	defer func() {
+		closeErr := dstFileWriter.Close()
+		if closeErr != nil && err == nil {
+			err = e.errWrap(op, "storage adapter writer close", closeErr)
+		}
+	}()
+
+	srcFileReader, err := e.mediaAdapter.GetReader(f, offset)
+	if err != nil {
+		return 0, e.errWrap(op, "media adapter get reader", err)
+	}
+
+	defer func() {
+		closeErr := srcFileReader.Close()
+		if closeErr != nil && err == nil {
+			err = e.errWrap(op, "media adapter reader close", closeErr)
+		}
+	}()
+
+	if offset == 0 {
+		log.Info("Start download: " + f.Name)
+	} else {
+		log.Info(fmt.Sprintf("Resume download: %s from %d of %d bytes", f.Name, offset, f.Size))
+	}
+
+	written, err = io.Copy(io.MultiWriter(dstFileWriter, hash), srcFileReader)
+	if err != nil {
+		return written, e.errWrap(op, "io copy "+f.Path, err)
+	}
+
+	return written, nil
+}
+
+// verify compares the hash of the stream with the hash of the stored file and, if enabled, md5 with the one calculated on media
+func (e *MediaExporter) verify(ctx context.Context, f *file.File, streamSum []byte, streamMd5 string) (bool, error) {
+	const op = "MediaExporter.verify"
+
+	storedHash := sha256.New()
+
+	err := e.hashLocal(f, f.Size, storedHash)
+	if err != nil {
+		return false, e.errWrap(op, "hash stored file", err)
+	}
+
+	if !bytes.Equal(streamSum, storedHash.Sum(nil)) {
+		return false, nil
+	}
+
+	if !e.config.verifyOnMedia {
+		return true, nil
+	}
+
+	mediaMd5, err := e.mediaAdapter.Checksum(ctx, f)
+	if errors.Is(err, ports.ErrNotSupported) {
+		// the stream is already checked against the stored file
+		return true, nil
+	}
+
+	if err != nil {
+		return false, e.errWrap(op, "media adapter checksum", err)
+	}
+
+	return mediaMd5 == streamMd5, nil
+}
+
+// hashLocal writes the first limit bytes of the stored file to the hash
+func (e *MediaExporter) hashLocal(f *file.File, limit uint64, hash io.Writer) error {
+	const op = "MediaExporter.hashLocal"
+
+	reader, err := e.storageAdapter.GetReader(f)
+	if err != nil {
+		return e.errWrap(op, "storage adapter get reader", err)
+	}
+
+	_, err = io.CopyN(hash, reader, int64(limit))
+	if err != nil {
+		_ = reader.Close()
+		return e.errWrap(op, "io copy "+f.Name, err)
+	}
+
+	err = reader.Close()
+	if err != nil {
+		return e.errWrap(op, "storage adapter reader close", err)
+	}
+
+	return nil
+}
+
+// deleteOnMedia deletes the media group on media, the primary file goes last so a broken group is still recognised
+func (e *MediaExporter) deleteOnMedia(group *file.File) error {
+	const op = "MediaExporter.deleteOnMedia"
+
+	transfer, deleteOnly := e.split(group)
+	files := append(transfer, deleteOnly...)
+
+	sort.SliceStable(files, func(a, b int) bool {
+		return files[a] != group && files[b] == group
+	})
+
+	for _, f := range files {
+		err := e.mediaAdapter.Delete(f)
+		if err != nil {
+			return e.errWrap(op, "media adapter delete "+f.Name, err)
+		}
+	}
+
+	err := e.journal.Record(group, journal.StageDeleted)
+	if err != nil {
+		return e.errWrap(op, "journal record deleted", err)
+	}
+
+	e.publisher.Publish(event.FileDeletedOnCamera{File: group, Time: time.Now()})
+
+	return nil
+}
+
+// replay finishes the steps interrupted by the previous run: verified files are deleted on the camera
+func (e *MediaExporter) replay() error {
+	const op = "MediaExporter.replay"
+
+	log := e.logger.With(
+		slog.String("op", op),
+	)
+
+	entries, err := e.journal.Pending()
+	if err != nil {
+		return e.errWrap(op, "journal pending", err)
+	}
+
+	for _, entry := range entries {
+		if entry.Stage != journal.StageVerified {
+			continue
 		}
+
+		err = e.deleteOnMedia(entry.File)
+		if err != nil {
+			log.Info(fmt.Sprintf("Replay delete of %s failed, retry after survey: %s", entry.File.Name, err.Error()))
+			continue
+		}
+
+		log.Info("Replay success pop file: " + entry.File.Name)
 	}
 
 	return nil
 }
 
+func (e *MediaExporter) pendingEntries() (map[string]*journal.Entry, error) {
+	const op = "MediaExporter.pendingEntries"
+
+	entries, err := e.journal.Pending()
+	if err != nil {
+		return nil, e.errWrap(op, "journal pending", err)
+	}
+
+	pending := make(map[string]*journal.Entry, len(entries))
+	for _, entry := range entries {
+		pending[journal.Key(entry.File)] = entry
+	}
+
+	return pending, nil
+}
+
 func (e *MediaExporter) errWrap(methodName, message string, err error) error {
 	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
 }
@@ -0,0 +1,870 @@
+package mediaexporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/camera"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/event"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/file"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/domain/journal"
+	"github.com/ffonord/yi4kplus-video-export/internal/core/ports"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMedia is a camera with the groups in memory, failures of GetReader and wrong checksums are queued by file
+type fakeMedia struct {
+	mu        sync.Mutex
+	groups    []*file.File
+	content   map[string][]byte
+	readErrs  map[string][]error
+	reads     map[string][]uint64
+	checksums map[string][]string
+	deleted   []string
+	status    camera.Status
+	// listErr is sent after the groups, the listing is partial
+	listErr    error
+	poweredOff bool
+	// sessionStarted is set when the transfer stack is started, the status must be read before it
+	sessionStarted   bool
+	statusAfterStart bool
+}
+
+func newFakeMedia(groups ...*file.File) *fakeMedia {
+	m := &fakeMedia{
+		groups:    groups,
+		content:   map[string][]byte{},
+		readErrs:  map[string][]error{},
+		reads:     map[string][]uint64{},
+		checksums: map[string][]string{},
+		status:    camera.Status{BatteryLevel: 100, ExternalPower: true},
+	}
+
+	for _, group := range groups {
+		for _, f := range group.Files() {
+			m.content[journal.Key(f)] = bytes.Repeat([]byte(f.Name[:1]), int(f.Size))
+		}
+	}
+
+	return m
+}
+
+func (m *fakeMedia) SessionStart(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessionStarted = true
+
+	return nil
+}
+
+func (m *fakeMedia) GetFiles(ctx context.Context) (<-chan *file.File, <-chan error, error) {
+	m.mu.Lock()
+	groups := append([]*file.File{}, m.groups...)
+	listErr := m.listErr
+	m.mu.Unlock()
+
+	fileChan := make(chan *file.File)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(errChan)
+
+		for _, group := range groups {
+			fileChan <- group
+		}
+
+		close(fileChan)
+
+		if listErr != nil {
+			errChan <- listErr
+		}
+	}()
+
+	return fileChan, errChan, nil
+}
+
+func (m *fakeMedia) GetReader(f *file.File, offset uint64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := journal.Key(f)
+	m.reads[key] = append(m.reads[key], offset)
+
+	if errs := m.readErrs[key]; len(errs) > 0 {
+		m.readErrs[key] = errs[1:]
+		return nil, errs[0]
+	}
+
+	content, ok := m.content[key]
+	if !ok {
+		return nil, ports.ErrNotFound
+	}
+
+	return io.NopCloser(bytes.NewReader(content[offset:])), nil
+}
+
+func (m *fakeMedia) Delete(f *file.File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := journal.Key(f)
+	m.deleted = append(m.deleted, key)
+	delete(m.content, key)
+
+	// the group is not listed once its primary file is gone
+	groups := m.groups[:0]
+	for _, group := range m.groups {
+		if journal.Key(group) != key {
+			groups = append(groups, group)
+		}
+	}
+	m.groups = groups
+
+	return nil
+}
+
+func (m *fakeMedia) Checksum(ctx context.Context, f *file.File) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := journal.Key(f)
+	if sums := m.checksums[key]; len(sums) > 0 {
+		m.checksums[key] = sums[1:]
+		return sums[0], nil
+	}
+
+	sum := md5.Sum(m.content[key])
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (m *fakeMedia) Status(ctx context.Context) (*camera.Status, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.statusAfterStart = m.sessionStarted
+	status := m.status
+
+	return &status, nil
+}
+
+func (m *fakeMedia) PowerOff(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.poweredOff = true
+
+	return nil
+}
+
+func (m *fakeMedia) isPoweredOff() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.poweredOff
+}
+
+func (m *fakeMedia) readOffsets(f *file.File) []uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]uint64{}, m.reads[journal.Key(f)]...)
+}
+
+// deleteOrder returns the deleted files in order of deletion
+func (m *fakeMedia) deleteOrder() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string{}, m.deleted...)
+}
+
+func (m *fakeMedia) deletedFiles() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := append([]string{}, m.deleted...)
+	sort.Strings(deleted)
+
+	return deleted
+}
+
+// fakeStorage keeps part and committed copies in memory, corrupt files are stored with a flipped first byte
+type fakeStorage struct {
+	mu        sync.Mutex
+	parts     map[string][]byte
+	committed map[string][]byte
+	corrupt   map[string]bool
+	writerErr error
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		parts:     map[string][]byte{},
+		committed: map[string][]byte{},
+		corrupt:   map[string]bool{},
+	}
+}
+
+func (s *fakeStorage) SessionStart(ctx context.Context) error {
+	return nil
+}
+
+func (s *fakeStorage) Size(f *file.File) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := journal.Key(f)
+	if content, ok := s.committed[key]; ok {
+		return uint64(len(content)), nil
+	}
+
+	return uint64(len(s.parts[key])), nil
+}
+
+func (s *fakeStorage) GetWriter(f *file.File, offset uint64) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writerErr != nil {
+		return nil, s.writerErr
+	}
+
+	key := journal.Key(f)
+	if content, ok := s.committed[key]; ok {
+		s.parts[key] = content
+		delete(s.committed, key)
+	}
+
+	return &fakeWriter{storage: s, key: key, data: append([]byte{}, s.parts[key][:offset]...)}, nil
+}
+
+func (s *fakeStorage) GetReader(f *file.File) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := journal.Key(f)
+	if content, ok := s.committed[key]; ok {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+
+	content, ok := s.parts[key]
+	if !ok {
+		return nil, ports.ErrNotFound
+	}
+
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (s *fakeStorage) Commit(f *file.File) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := journal.Key(f)
+	if content, ok := s.parts[key]; ok {
+		s.committed[key] = content
+		delete(s.parts, key)
+	}
+
+	return "/storage/" + key, nil
+}
+
+func (s *fakeStorage) Delete(f *file.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := journal.Key(f)
+	delete(s.parts, key)
+	delete(s.committed, key)
+
+	return nil
+}
+
+func (s *fakeStorage) stored(f *file.File) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, ok := s.committed[journal.Key(f)]
+
+	return content, ok
+}
+
+func (s *fakeStorage) hasCopy(f *file.File) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := journal.Key(f)
+	_, committed := s.committed[key]
+	_, part := s.parts[key]
+
+	return committed || part
+}
+
+type fakeWriter struct {
+	storage *fakeStorage
+	key     string
+	data    []byte
+}
+
+func (w *fakeWriter) Write(p []byte) (int, error) {
+	w.data = append(w.data, p...)
+	return len(p), nil
+}
+
+func (w *fakeWriter) Close() error {
+	w.storage.mu.Lock()
+	defer w.storage.mu.Unlock()
+
+	if w.storage.corrupt[w.key] && len(w.data) > 0 {
+		w.data[0] ^= 0xff
+	}
+
+	w.storage.parts[w.key] = w.data
+
+	return nil
+}
+
+// fakeJournal keeps the last stage of every file which is not deleted on media
+type fakeJournal struct {
+	mu      sync.Mutex
+	entries map[string]*journal.Entry
+}
+
+func newFakeJournal(entries ...*journal.Entry) *fakeJournal {
+	j := &fakeJournal{
+		entries: map[string]*journal.Entry{},
+	}
+
+	for _, entry := range entries {
+		j.entries[journal.Key(entry.File)] = entry
+	}
+
+	return j
+}
+
+func (j *fakeJournal) Record(f *file.File, stage journal.Stage) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if stage == journal.StageDeleted {
+		delete(j.entries, journal.Key(f))
+		return nil
+	}
+
+	j.entries[journal.Key(f)] = journal.New(f, stage, time.Now())
+
+	return nil
+}
+
+func (j *fakeJournal) Pending() ([]*journal.Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]*journal.Entry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Time.Before(entries[b].Time)
+	})
+
+	return entries, nil
+}
+
+func (j *fakeJournal) stage(f *file.File) (journal.Stage, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, ok := j.entries[journal.Key(f)]
+	if !ok {
+		return "", false
+	}
+
+	return entry.Stage, true
+}
+
+type nopPublisher struct{}
+
+func (nopPublisher) Publish(e event.Event) {}
+
+func newExporter(config *Config, media ports.Media, storage ports.Storage, j ports.Journal) *MediaExporter {
+	config.retryBaseDelay = time.Millisecond
+	config.retryMaxDelay = time.Millisecond
+
+	return New(config, media, storage, j, nopPublisher{}, logger.New(logger.EnvTest))
+}
+
+func newClip(name string, size uint64) *file.File {
+	return file.New(name, "100MEDIA", time.Date(2023, 6, 3, 10, 0, 0, 0, time.UTC), size)
+}
+
+func TestMediaExporter_RetryTransientError(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(clip)
+	media.readErrs[journal.Key(clip)] = []error{io.ErrUnexpectedEOF}
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	e := newExporter(NewConfig(), media, storage, j)
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+
+	assert.Len(t, media.readOffsets(clip), 2)
+	assert.Equal(t, []string{journal.Key(clip)}, media.deletedFiles())
+
+	content, ok := storage.stored(clip)
+	assert.True(t, ok)
+	assert.Equal(t, "YYYYYYYY", string(content))
+
+	_, pending := j.stage(clip)
+	assert.False(t, pending)
+}
+
+func TestMediaExporter_PermanentErrorPoisonsGroup(t *testing.T) {
+	broken := newClip("YDXJ0001.MP4", 8)
+	clip := newClip("YDXJ0002.MP4", 8)
+
+	media := newFakeMedia(broken, clip)
+	media.readErrs[journal.Key(broken)] = []error{ports.ErrNotFound}
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	e := newExporter(NewConfig(), media, storage, j)
+
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, ports.ErrNotFound)
+
+	// the permanent error is not retried and the other group is exported
+	assert.Len(t, media.readOffsets(broken), 1)
+	assert.Equal(t, []string{journal.Key(clip)}, media.deletedFiles())
+
+	// the next session skips the poisoned group
+	assert.Nil(t, e.ExportFiles(context.Background()))
+	assert.Len(t, media.readOffsets(broken), 1)
+	assert.NotNil(t, e.poisonedErr(journal.Key(broken)))
+}
+
+func TestMediaExporter_StorageFullCancelsSession(t *testing.T) {
+	first := newClip("YDXJ0001.MP4", 8)
+	second := newClip("YDXJ0002.MP4", 8)
+
+	media := newFakeMedia(first, second)
+	storage := newFakeStorage()
+	storage.writerErr = ports.ErrStorageFull
+	j := newFakeJournal()
+
+	e := newExporter(NewConfig(), media, storage, j)
+
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, ports.ErrStorageFull)
+
+	// storage full is not retried, does not poison the group and nothing is deleted on media
+	assert.Empty(t, media.readOffsets(first))
+	assert.Empty(t, media.readOffsets(second))
+	assert.Empty(t, media.deletedFiles())
+	assert.True(t, e.needsExport(first))
+
+	stage, _ := j.stage(first)
+	assert.Equal(t, journal.StageDownloading, stage)
+}
+
+func TestMediaExporter_FailingGroupDoesNotStopOthers(t *testing.T) {
+	broken := newClip("YDXJ0001.MP4", 8)
+	clips := []*file.File{
+		newClip("YDXJ0002.MP4", 8),
+		newClip("YDXJ0003.MP4", 8),
+		newClip("YDXJ0004.MP4", 8),
+	}
+
+	media := newFakeMedia(append([]*file.File{broken}, clips...)...)
+	media.readErrs[journal.Key(broken)] = []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF}
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.workers = 2
+	config.maxAttempts = 3
+
+	e := newExporter(config, media, storage, j)
+
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	assert.Len(t, media.readOffsets(broken), 3)
+	assert.Equal(t, []string{
+		journal.Key(clips[0]),
+		journal.Key(clips[1]),
+		journal.Key(clips[2]),
+	}, media.deletedFiles())
+
+	for _, clip := range clips {
+		_, ok := storage.stored(clip)
+		assert.True(t, ok)
+	}
+
+	assert.NotNil(t, e.poisonedErr(journal.Key(broken)))
+}
+
+func TestMediaExporter_ReplayVerifiedEntry(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	// the previous run verified the copy and stopped before the delete on media
+	media := newFakeMedia(clip)
+	storage := newFakeStorage()
+	storage.committed[journal.Key(clip)] = []byte("YYYYYYYY")
+	j := newFakeJournal(journal.New(clip, journal.StageVerified, time.Now()))
+
+	e := newExporter(NewConfig(), media, storage, j)
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+
+	assert.Equal(t, []string{journal.Key(clip)}, media.deletedFiles())
+	assert.Empty(t, media.readOffsets(clip))
+
+	_, pending := j.stage(clip)
+	assert.False(t, pending)
+}
+
+func TestMediaExporter_ResumeDownloadingEntry(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	// the previous run stopped in the middle of the download
+	media := newFakeMedia(clip)
+	storage := newFakeStorage()
+	storage.parts[journal.Key(clip)] = []byte("YYY")
+	j := newFakeJournal(journal.New(clip, journal.StageDownloading, time.Now()))
+
+	e := newExporter(NewConfig(), media, storage, j)
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+
+	assert.Equal(t, []uint64{3}, media.readOffsets(clip))
+	assert.Equal(t, []string{journal.Key(clip)}, media.deletedFiles())
+
+	content, ok := storage.stored(clip)
+	assert.True(t, ok)
+	assert.Equal(t, "YYYYYYYY", string(content))
+
+	_, pending := j.stage(clip)
+	assert.False(t, pending)
+}
+
+func TestMediaExporter_ForgetEntriesGoneFromMedia(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+	gone := newClip("YDXJ0002.MP4", 8)
+	discovered := newClip("YDXJ0003.MP4", 8)
+
+	media := newFakeMedia(clip)
+	storage := newFakeStorage()
+	j := newFakeJournal(
+		journal.New(gone, journal.StageDownloading, time.Now()),
+		journal.New(discovered, journal.StageDiscovered, time.Now()),
+	)
+
+	e := newExporter(NewConfig(), media, storage, j)
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+
+	// only the listed group is deleted on media, the entries of the others are dropped
+	assert.Equal(t, []string{journal.Key(clip)}, media.deletedFiles())
+
+	entries, err := j.Pending()
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestMediaExporter_ChecksumMismatchKeepsMediaFile(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(clip)
+	storage := newFakeStorage()
+	storage.corrupt[journal.Key(clip)] = true
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.maxAttempts = 3
+
+	e := newExporter(config, media, storage, j)
+
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// the local copy differs from the stream on every attempt, it is deleted and the clip stays on media
+	assert.Len(t, media.readOffsets(clip), 3)
+	assert.False(t, storage.hasCopy(clip))
+	assert.Empty(t, media.deletedFiles())
+
+	stage, _ := j.stage(clip)
+	assert.Equal(t, journal.StageDownloading, stage)
+
+	// the clip is poisoned, the next session does not download it again
+	assert.Nil(t, e.ExportFiles(context.Background()))
+	assert.Len(t, media.readOffsets(clip), 3)
+}
+
+func TestMediaExporter_MediaChecksumMismatchBlocksDelete(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(clip)
+	media.checksums[journal.Key(clip)] = []string{"d41d8cd98f00b204e9800998ecf8427e", "d41d8cd98f00b204e9800998ecf8427e"}
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.verifyOnMedia = true
+	config.maxAttempts = 2
+
+	e := newExporter(config, media, storage, j)
+
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// the camera reports another md5 than the transferred bytes have, the clip is not deleted on media
+	assert.Len(t, media.readOffsets(clip), 2)
+	assert.False(t, storage.hasCopy(clip))
+	assert.Empty(t, media.deletedFiles())
+
+	stage, _ := j.stage(clip)
+	assert.Equal(t, journal.StageDownloading, stage)
+}
+
+func TestMediaExporter_ChecksumMismatchRetried(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(clip)
+	// the md5 of the camera is right on the second attempt
+	media.checksums[journal.Key(clip)] = []string{"d41d8cd98f00b204e9800998ecf8427e"}
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.verifyOnMedia = true
+
+	e := newExporter(config, media, storage, j)
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+
+	assert.Len(t, media.readOffsets(clip), 2)
+	assert.True(t, storage.hasCopy(clip))
+	assert.Equal(t, []string{journal.Key(clip)}, media.deletedFiles())
+}
+
+func TestMediaExporter_MediaChecksumMatchDeletes(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(clip)
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.verifyOnMedia = true
+
+	e := newExporter(config, media, storage, j)
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+
+	_, ok := storage.stored(clip)
+	assert.True(t, ok)
+	assert.Equal(t, []string{journal.Key(clip)}, media.deletedFiles())
+}
+
+func TestMediaExporter_RecordingPostponesExport(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(clip)
+	media.status = camera.Status{BatteryLevel: 100, ExternalPower: true, Recording: true}
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	// the battery check is disabled, the recording is checked anyway
+	config := NewConfig()
+	config.minBatteryLevel = 0
+
+	e := newExporter(config, media, storage, j)
+
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, ErrRecording)
+
+	assert.False(t, media.sessionStarted)
+	assert.Empty(t, media.readOffsets(clip))
+}
+
+func TestMediaExporter_LowBatteryPostponesExport(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(clip)
+	media.status = camera.Status{BatteryLevel: 10}
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.minBatteryLevel = 20
+
+	e := newExporter(config, media, storage, j)
+
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, ErrLowBattery)
+	assert.False(t, media.sessionStarted)
+
+	// the camera is plugged in, the status is read before the session starts
+	media.status = camera.Status{BatteryLevel: 10, ExternalPower: true}
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+	assert.True(t, media.sessionStarted)
+	assert.False(t, media.statusAfterStart)
+	assert.Equal(t, []string{journal.Key(clip)}, media.deletedFiles())
+}
+
+func TestMediaExporter_PowerOffWhenNothingLeft(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(clip)
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.powerOffWhenDone = true
+
+	e := newExporter(config, media, storage, j)
+
+	// the clip is exported in the session, the camera is switched off when a session finds nothing
+	assert.Nil(t, e.ExportFiles(context.Background()))
+	assert.False(t, media.isPoweredOff())
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+	assert.True(t, media.isPoweredOff())
+}
+
+func TestMediaExporter_NoPowerOffAfterPartialListing(t *testing.T) {
+	media := newFakeMedia()
+	media.listErr = io.ErrUnexpectedEOF
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.powerOffWhenDone = true
+
+	e := newExporter(config, media, storage, j)
+
+	// nothing is listed before the listing fails, the rest of the media is unknown
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.False(t, media.isPoweredOff())
+}
+
+func TestMediaExporter_NoPowerOffWithPoisonedGroup(t *testing.T) {
+	broken := newClip("YDXJ0001.MP4", 8)
+
+	media := newFakeMedia(broken)
+	media.readErrs[journal.Key(broken)] = []error{ports.ErrNotFound}
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.powerOffWhenDone = true
+
+	e := newExporter(config, media, storage, j)
+
+	err := e.ExportFiles(context.Background())
+	assert.ErrorIs(t, err, ports.ErrNotFound)
+
+	// the poisoned group is skipped but it is still on media, so the camera stays on
+	assert.Nil(t, e.ExportFiles(context.Background()))
+	assert.Len(t, media.readOffsets(broken), 1)
+	assert.False(t, media.isPoweredOff())
+}
+
+func TestMediaExporter_PowerOffWithSkippedSidecarsOnly(t *testing.T) {
+	media := newFakeMedia(newClip("YDXJ0001.LRV", 8))
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.powerOffWhenDone = true
+	config.sidecarPolicy = map[string]SidecarPolicy{".LRV": SidecarSkip}
+
+	e := newExporter(config, media, storage, j)
+
+	// a file which is never exported is not left work
+	assert.Nil(t, e.ExportFiles(context.Background()))
+	assert.True(t, media.isPoweredOff())
+}
+
+func TestMediaExporter_SidecarPolicies(t *testing.T) {
+	groups := file.Group([]*file.File{
+		newClip("YDXJ0001.THM", 4),
+		newClip("YDXJ0001.MP4", 8),
+		newClip("YDXJ0001.SEC", 4),
+		newClip("YDXJ0001.LRV", 6),
+	})
+	assert.Len(t, groups, 1)
+
+	clip := groups[0]
+	thm, sec, lrv := clip.Sidecars[0], clip.Sidecars[1], clip.Sidecars[2]
+
+	media := newFakeMedia(clip)
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	config := NewConfig()
+	config.sidecarPolicy = map[string]SidecarPolicy{".THM": SidecarSkip, ".SEC": SidecarDelete, ".LRV": SidecarKeep}
+
+	e := newExporter(config, media, storage, j)
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+
+	// kept files are transferred and deleted on media
+	for _, f := range []*file.File{clip, lrv} {
+		content, ok := storage.stored(f)
+		assert.True(t, ok, f.Name)
+		assert.Len(t, content, int(f.Size), f.Name)
+	}
+
+	// a deleted sidecar is removed on media without transfer
+	assert.Empty(t, media.readOffsets(sec))
+	assert.False(t, storage.hasCopy(sec))
+
+	// a skipped sidecar is left on media untouched
+	assert.Empty(t, media.readOffsets(thm))
+	assert.False(t, storage.hasCopy(thm))
+
+	assert.Equal(t, []string{journal.Key(lrv), journal.Key(sec), journal.Key(clip)}, media.deleteOrder())
+
+	_, pending := j.stage(clip)
+	assert.False(t, pending)
+}
+
+func TestMediaExporter_DeletesPrimaryLast(t *testing.T) {
+	clip := newClip("YDXJ0001.MP4", 8)
+	sec := newClip("YDXJ0001.SEC", 4)
+	thm := newClip("YDXJ0001.THM", 4)
+
+	// the primary comes first in the group
+	clip.Sidecars = []*file.File{sec, thm}
+
+	media := newFakeMedia(clip)
+	storage := newFakeStorage()
+	j := newFakeJournal()
+
+	e := newExporter(NewConfig(), media, storage, j)
+
+	assert.Nil(t, e.ExportFiles(context.Background()))
+
+	// the group is recognised on media until its primary file is gone
+	assert.Equal(t, []string{journal.Key(sec), journal.Key(thm), journal.Key(clip)}, media.deleteOrder())
+
+	for _, f := range clip.Files() {
+		_, ok := storage.stored(f)
+		assert.True(t, ok, f.Name)
+	}
+}
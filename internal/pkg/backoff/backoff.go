@@ -0,0 +1,53 @@
+package backoff
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff is an exponential delay with jitter between attempts
+type Backoff struct {
+	base time.Duration
+	max  time.Duration
+}
+
+func New(base, max time.Duration) *Backoff {
+	return &Backoff{
+		base: base,
+		max:  max,
+	}
+}
+
+// Delay returns the pause before the next attempt, attempt starts from 1.
+// The delay doubles each attempt up to max, a random half of it is cut off so clients do not retry in step.
+func (b *Backoff) Delay(attempt int) time.Duration {
+	delay := b.max
+
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	if shift := attempt - 1; shift < 32 {
+		if d := b.base << shift; d > 0 && d < b.max {
+			delay = d
+		}
+	}
+
+	half := delay / 2
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Wait sleeps for the delay of the attempt, it returns the context error if the context is done first
+func (b *Backoff) Wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(b.Delay(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,36 @@
+package backoff
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	b := New(time.Second, time.Second*10)
+
+	for attempt, max := range map[int]time.Duration{
+		1:   time.Second,
+		2:   time.Second * 2,
+		3:   time.Second * 4,
+		5:   time.Second * 10,
+		100: time.Second * 10,
+	} {
+		delay := b.Delay(attempt)
+
+		assert.GreaterOrEqual(t, delay, max/2)
+		assert.LessOrEqual(t, delay, max)
+	}
+}
+
+func TestBackoff_Wait(t *testing.T) {
+	b := New(time.Minute, time.Minute)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+
+	err := b.Wait(ctx, 1)
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,73 @@
+package eventbus
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Bus delivers published values to every subscription in process.
+// A subscriber which does not keep up loses values instead of blocking the publisher.
+type Bus[T any] struct {
+	mu            sync.RWMutex
+	subscriptions map[*Subscription[T]]struct{}
+}
+
+// Subscription receives published values on C until it is closed
+type Subscription[T any] struct {
+	C       <-chan T
+	ch      chan T
+	bus     *Bus[T]
+	once    sync.Once
+	dropped atomic.Uint64
+}
+
+func New[T any]() *Bus[T] {
+	return &Bus[T]{
+		subscriptions: map[*Subscription[T]]struct{}{},
+	}
+}
+
+// Subscribe returns a subscription which buffers up to size values
+func (b *Bus[T]) Subscribe(size int) *Subscription[T] {
+	ch := make(chan T, size)
+	s := &Subscription[T]{
+		C:   ch,
+		ch:  ch,
+		bus: b,
+	}
+
+	b.mu.Lock()
+	b.subscriptions[s] = struct{}{}
+	b.mu.Unlock()
+
+	return s
+}
+
+func (b *Bus[T]) Publish(value T) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subscriptions {
+		select {
+		case s.ch <- value:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the number of values lost because the buffer of the subscription was full
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close removes the subscription from the bus and closes C
+func (s *Subscription[T]) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subscriptions, s)
+		s.bus.mu.Unlock()
+
+		close(s.ch)
+	})
+}
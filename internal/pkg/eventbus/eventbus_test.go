@@ -0,0 +1,32 @@
+package eventbus
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBus_Publish(t *testing.T) {
+	b := New[string]()
+
+	first := b.Subscribe(2)
+	second := b.Subscribe(1)
+
+	b.Publish("a")
+	b.Publish("b")
+
+	assert.Equal(t, "a", <-first.C)
+	assert.Equal(t, "b", <-first.C)
+	assert.Equal(t, uint64(0), first.Dropped())
+
+	assert.Equal(t, "a", <-second.C)
+	assert.Equal(t, uint64(1), second.Dropped())
+
+	second.Close()
+	second.Close()
+
+	_, ok := <-second.C
+	assert.False(t, ok)
+
+	b.Publish("c")
+	assert.Equal(t, "c", <-first.C)
+}
@@ -0,0 +1,6 @@
+// Package fswatch reports files which are completely written into a directory tree
+package fswatch
+
+import "errors"
+
+var ErrUnsupported = errors.New("file system watch is not supported on this platform")
@@ -0,0 +1,220 @@
+package fswatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	fileMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+	dirMask  = fileMask | syscall.IN_CREATE | syscall.IN_DELETE_SELF
+	// readBufferSize fits many events with names up to NAME_MAX
+	readBufferSize = 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)
+)
+
+// rawEvent is a path from the kernel queue, an empty path means the queue overflowed
+type rawEvent struct {
+	path string
+}
+
+// Watch watches root and its subdirs with inotify until the context is done.
+// A file is reported by onFile once it was closed after writing or moved in and then stayed quiet for debounce.
+// When the kernel drops events onOverflow is called, the caller should rescan root.
+func Watch(ctx context.Context, root string, debounce time.Duration, onFile func(path string), onOverflow func()) error {
+	const op = "fswatch.Watch"
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return errWrap(op, "inotify init", err)
+	}
+
+	// a non-blocking fd is served by the runtime poller, so Close interrupts the pending Read
+	inotifyFile := os.NewFile(uintptr(fd), "inotify")
+
+	w := &watcher{
+		fd:    fd,
+		dirs:  map[int]string{},
+		found: map[string]time.Time{},
+	}
+
+	err = w.addTree(root)
+	if err != nil {
+		_ = inotifyFile.Close()
+		return errWrap(op, "add tree "+root, err)
+	}
+
+	rawEvents := make(chan rawEvent)
+	readErr := make(chan error, 1)
+
+	go func() {
+		readErr <- w.read(ctx.Done(), inotifyFile, rawEvents)
+	}()
+
+	defer func() {
+		_ = inotifyFile.Close()
+		<-readErr
+	}()
+
+	ticker := time.NewTicker(debounce / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			readErr <- err
+			return errWrap(op, "read events", err)
+		case e := <-rawEvents:
+			if e.path == "" {
+				onOverflow()
+				continue
+			}
+
+			w.found[e.path] = time.Now()
+		case <-ticker.C:
+			for p, lastEvent := range w.found {
+				if time.Since(lastEvent) < debounce {
+					continue
+				}
+
+				delete(w.found, p)
+				onFile(p)
+			}
+		}
+	}
+}
+
+type watcher struct {
+	fd    int
+	dirs  map[int]string
+	found map[string]time.Time
+}
+
+// addTree watches the dir and its subdirs
+func (w *watcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// the dir may be removed while it is walked
+			if errors.Is(err, fs.ErrNotExist) && p != root {
+				return nil
+			}
+
+			return err
+		}
+
+		if d.IsDir() {
+			wd, err := syscall.InotifyAddWatch(w.fd, p, dirMask)
+			if err != nil {
+				return errWrap("watcher.addTree", "inotify add watch, path: "+p, err)
+			}
+
+			w.dirs[wd] = p
+		}
+
+		return nil
+	})
+}
+
+// read parses the kernel events until the file is closed
+func (w *watcher) read(done <-chan struct{}, inotifyFile *os.File, rawEvents chan<- rawEvent) error {
+	buf := make([]byte, readBufferSize)
+
+	for {
+		n, err := inotifyFile.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.send(done, rawEvents, rawEvent{})
+				continue
+			}
+
+			dir, ok := w.dirs[int(event.Wd)]
+			if !ok {
+				continue
+			}
+
+			if event.Mask&(syscall.IN_DELETE_SELF|syscall.IN_IGNORED) != 0 {
+				delete(w.dirs, int(event.Wd))
+				continue
+			}
+
+			p := filepath.Join(dir, cString(nameBytes))
+
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					w.addDir(done, p, rawEvents)
+				}
+
+				continue
+			}
+
+			if event.Mask&fileMask != 0 {
+				w.send(done, rawEvents, rawEvent{path: p})
+			}
+		}
+	}
+}
+
+// addDir watches the new dir, files which got into it before the watch are reported too
+func (w *watcher) addDir(done <-chan struct{}, dir string, rawEvents chan<- rawEvent) {
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if d.IsDir() {
+			wd, err := syscall.InotifyAddWatch(w.fd, p, dirMask)
+			if err == nil {
+				w.dirs[wd] = p
+			}
+
+			return nil
+		}
+
+		if d.Type().IsRegular() {
+			w.send(done, rawEvents, rawEvent{path: p})
+		}
+
+		return nil
+	})
+}
+
+func (w *watcher) send(done <-chan struct{}, rawEvents chan<- rawEvent, e rawEvent) {
+	select {
+	case rawEvents <- e:
+	case <-done:
+	}
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+
+	return string(b)
+}
+
+func errWrap(methodName, message string, err error) error {
+	return fmt.Errorf("%s: %s failed: %w", methodName, message, err)
+}
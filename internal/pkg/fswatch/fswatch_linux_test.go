@@ -0,0 +1,54 @@
+package fswatch
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	root := t.TempDir()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	mu := sync.Mutex{}
+	found := map[string]int{}
+
+	done := make(chan error)
+	go func() {
+		done <- Watch(ctx, root, 100*time.Millisecond, func(path string) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			found[path]++
+		}, func() {})
+	}()
+
+	// wait for the watches to be added
+	time.Sleep(100 * time.Millisecond)
+
+	written := filepath.Join(root, "written.MP4")
+	assert.Nil(t, os.WriteFile(written, []byte("video"), 0644))
+
+	assert.Nil(t, os.WriteFile(written+".part", []byte("video"), 0644))
+	moved := filepath.Join(root, "moved.MP4")
+	assert.Nil(t, os.Rename(written+".part", moved))
+
+	nested := filepath.Join(root, "2023/06-03/nested.MP4")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(nested), 0755))
+	assert.Nil(t, os.WriteFile(nested, []byte("video"), 0644))
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return found[written] == 1 && found[moved] == 1 && found[nested] == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	cancelFunc()
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package fswatch
+
+import (
+	"context"
+	"time"
+)
+
+func Watch(ctx context.Context, root string, debounce time.Duration, onFile func(path string), onOverflow func()) error {
+	return ErrUnsupported
+}
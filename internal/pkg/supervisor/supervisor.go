@@ -0,0 +1,85 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/backoff"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	restartBaseDelay = time.Second * 5
+	restartMaxDelay  = time.Minute * 5
+)
+
+// Supervisor runs services until the context is done, a service which panics or returns is restarted with backoff
+type Supervisor struct {
+	logger  *logger.Logger
+	wg      *sync.WaitGroup
+	backoff *backoff.Backoff
+}
+
+func New(logger *logger.Logger, wg *sync.WaitGroup) *Supervisor {
+	return &Supervisor{
+		logger:  logger,
+		wg:      wg,
+		backoff: backoff.New(restartBaseDelay, restartMaxDelay),
+	}
+}
+
+// Go starts the service in a goroutine counted by the wait group
+func (s *Supervisor) Go(ctx context.Context, name string, run func(ctx context.Context) error) {
+	const op = "Supervisor.Go"
+
+	log := s.logger.With(
+		slog.String("op", op),
+		slog.String("service", name),
+	)
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		for attempt := 1; ; attempt++ {
+			startedAt := time.Now()
+			err := s.runSafe(ctx, run)
+
+			if ctx.Err() != nil {
+				log.Info("Success stop service")
+				return
+			}
+
+			if err != nil {
+				log.Error("Service failed: " + err.Error())
+			} else {
+				log.Error("Service returned before shutdown")
+			}
+
+			// a service which worked long enough is restarted quickly again
+			if time.Since(startedAt) > restartMaxDelay {
+				attempt = 1
+			}
+
+			if s.backoff.Wait(ctx, attempt) != nil {
+				return
+			}
+
+			log.Info(fmt.Sprintf("Restart service, attempt %d", attempt))
+		}
+	}()
+}
+
+func (s *Supervisor) runSafe(ctx context.Context, run func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+
+	return run(ctx)
+}
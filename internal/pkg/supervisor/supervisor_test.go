@@ -0,0 +1,42 @@
+package supervisor
+
+import (
+	"context"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/backoff"
+	"github.com/ffonord/yi4kplus-video-export/internal/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSupervisor_Go(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	s := New(logger.New(logger.EnvTest), wg)
+	s.backoff = backoff.New(time.Millisecond, time.Millisecond)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	runs := int32(0)
+	s.Go(ctx, "test", func(ctx context.Context) error {
+		switch atomic.AddInt32(&runs, 1) {
+		case 1:
+			panic("service panic")
+		case 2:
+			return nil
+		default:
+			<-ctx.Done()
+			return ctx.Err()
+		}
+	})
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&runs) == 3
+	}, time.Second, time.Millisecond)
+
+	cancelFunc()
+	wg.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&runs))
+}